@@ -31,11 +31,21 @@ var rootCmd = &cobra.Command{
 	Use:   "abakus",
 	Short: "Abakus is a git-like utility for backups to the cloud",
 	Long:  ``,
+	PersistentPostRun: func(cmd *cobra.Command, args []string) {
+		releaseLock()
+	},
+}
+
+func init() {
+	rootCmd.PersistentFlags().DurationVar(&lockWait, "wait", 0,
+		"how long to wait for another command to release its lock on the repository")
 }
 
 func execute() {
 	if err := rootCmd.Execute(); err != nil {
-		fmt.Fprintln(os.Stderr, err)
+		// PersistentPostRun is skipped when a command returns an error
+		releaseLock()
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
 		os.Exit(1)
 	}
 }
@@ -21,20 +21,83 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/andybug/abakus/pkg/blob"
+	"github.com/andybug/abakus/pkg/crypt"
+	"github.com/andybug/abakus/pkg/filelist"
 	"github.com/andybug/abakus/pkg/repo"
+	"github.com/andybug/abakus/pkg/snapshot"
+	"github.com/golang/crypto/ssh/terminal"
 )
 
+// lockWait is how long to wait for a conflicting lock (--wait)
+var lockWait time.Duration
+
+// heldLock is the lock taken by lockRepo, or nil
+var heldLock *repo.Lock
+var heldLockMu sync.Mutex
+
 func exitError(err error) {
 	if err == nil {
 		return
 	}
 	fmt.Fprintf(os.Stderr, "error: %s\n", err)
+	releaseLock()
 	os.Exit(1)
 }
 
+// lockRepo takes a lock of the given kind on the repository for the rest of
+// the command, waiting up to --wait for a conflicting lock to be released.
+// The lock is released when the command finishes, exits with an error or
+// is interrupted.
+func lockRepo(root string, kind string) {
+	lock, err := repo.Acquire(repo.GetLocksDir(root), kind, lockWait)
+	if _, locked := err.(*repo.LockedError); locked {
+		exitError(errors.New(fmt.Sprintf("%s (use --wait to wait for it, or abakus unlock if it is stale)", err)))
+	}
+	exitError(err)
+
+	heldLockMu.Lock()
+	heldLock = lock
+	heldLockMu.Unlock()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		releaseLock()
+		fmt.Fprintf(os.Stderr, "error: %s\n", sig)
+		os.Exit(1)
+	}()
+}
+
+// releaseLock releases the lock taken by lockRepo, if any
+func releaseLock() {
+	heldLockMu.Lock()
+	defer heldLockMu.Unlock()
+
+	if heldLock == nil {
+		return
+	}
+
+	if err := heldLock.Release(); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: could not release lock: %s\n", err)
+	}
+	heldLock = nil
+}
+
 func getRoot() string {
 	cwd, _ := os.Getwd()
 	root, err := repo.FindRoot(cwd)
@@ -42,3 +105,161 @@ func getRoot() string {
 
 	return root
 }
+
+// getKey returns the master key of an encrypted repository, asking for the
+// passphrase if it is not in the environment. It returns nil for an
+// unencrypted repository.
+func getKey(root string) *crypt.MasterKey {
+	config, err := repo.ReadConfig(root)
+	exitError(err)
+
+	if config.Encryption == repo.ENCRYPTION_NONE {
+		return nil
+	}
+
+	key, _, _ := unlock(root)
+	return key
+}
+
+// unlock asks for the passphrase of an encrypted repository and returns the
+// master key, the id of the key file that opened it and the passphrase
+func unlock(root string) (*crypt.MasterKey, string, []byte) {
+	passphrase := readPassphrase("ABAKUS_PASSWORD", "Enter passphrase: ", false)
+	key, id, err := crypt.Unlock(repo.GetKeysDir(root), passphrase)
+	exitError(err)
+
+	return key, id, passphrase
+}
+
+// getStores opens the blob and snapshot stores, unlocking the repository
+// if it is encrypted. The caller must close both stores.
+func getStores(root string) (*blob.Store, *snapshot.Store) {
+	key := getKey(root)
+
+	blobStore, err := blob.GetStore(root, key)
+	exitError(err)
+
+	snapshotStore, err := snapshot.GetStore(root, key)
+	exitError(err)
+
+	return blobStore, snapshotStore
+}
+
+// scanWorkdir lists the files in the working directory, with the hashes of
+// those that the stat cache says are unchanged filled in unless rehash is
+// true. It warns about the special files that opts leaves out and returns
+// their paths. The caller must update the cache once the other files are
+// hashed, and close it.
+func scanWorkdir(root string, rehash bool, opts *filelist.ScanOptions) (*filelist.FileList, *filelist.StatCache, []string) {
+	if !filelist.IsSpecialPolicy(opts.Special) {
+		exitError(errors.New(fmt.Sprintf("unknown --special-files policy %s", opts.Special)))
+	}
+
+	var skipped []string
+	opts.Skipped = func(relPath string) {
+		fmt.Fprintf(os.Stderr, "warning: skipping special file %s\n", relPath)
+		skipped = append(skipped, relPath)
+	}
+
+	fl, err := filelist.Scan(root, opts)
+	exitError(err)
+
+	cache, err := filelist.OpenStatCache(repo.GetStatCacheDbPath(root))
+	exitError(err)
+
+	_, err = cache.Fill(root, fl, rehash)
+	exitError(err)
+
+	return fl, cache, skipped
+}
+
+// readPassphrase returns the passphrase from the env variable, from the
+// file named by the env variable with a _FILE suffix, or by prompting on the
+// terminal. When confirm is true the prompt is repeated and both entries
+// must match.
+func readPassphrase(env string, prompt string, confirm bool) []byte {
+	if passphrase, ok := os.LookupEnv(env); ok {
+		return []byte(passphrase)
+	}
+
+	if path, ok := os.LookupEnv(env + "_FILE"); ok {
+		contents, err := ioutil.ReadFile(path)
+		exitError(err)
+		return bytes.TrimRight(contents, "\r\n")
+	}
+
+	passphrase := promptPassphrase(prompt)
+	if len(passphrase) == 0 {
+		exitError(errors.New("Empty passphrase"))
+	}
+
+	if confirm && !bytes.Equal(passphrase, promptPassphrase("Confirm passphrase: ")) {
+		exitError(errors.New("Passphrases do not match"))
+	}
+
+	return passphrase
+}
+
+// promptPassphrase prints the prompt to stderr and reads a line from the
+// terminal without echoing it. If stdin is not a terminal the line is read
+// as is.
+func promptPassphrase(prompt string) []byte {
+	fmt.Fprint(os.Stderr, prompt)
+
+	fd := int(os.Stdin.Fd())
+	if terminal.IsTerminal(fd) {
+		passphrase, err := terminal.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		exitError(err)
+		return passphrase
+	}
+
+	line, err := bufio.NewReader(os.Stdin).ReadBytes('\n')
+	if len(line) == 0 {
+		exitError(err)
+	}
+
+	return bytes.TrimRight(line, "\r\n")
+}
+
+// describePath returns the path, with a slash after a directory, the
+// target of a symlink, the type of a special file or the first file of a
+// hard link group
+func describePath(relPath string, metadata *filelist.FileMetadata) string {
+	switch {
+	case metadata.LinkedTo(relPath) != "":
+		return fmt.Sprintf("%s (link to %s)", relPath, metadata.Link)
+	case metadata.Link != "":
+		return fmt.Sprintf("%s (linked)", relPath)
+	case metadata.Type == filelist.TYPE_DIRECTORY:
+		return relPath + "/"
+	case metadata.Type == filelist.TYPE_SYMLINK:
+		return fmt.Sprintf("%s -> %s", relPath, metadata.Target)
+	case metadata.IsDevice():
+		return fmt.Sprintf("%s (%s %d:%d)", relPath, metadata.Type, metadata.Major, metadata.Minor)
+	case !metadata.IsRegular():
+		return fmt.Sprintf("%s (%s)", relPath, metadata.Type)
+	}
+
+	return relPath
+}
+
+// relPaths converts the paths given on the command line to paths relative
+// to the root of the repository
+func relPaths(root string, paths []string) []string {
+	var rel []string
+	for _, path := range paths {
+		absPath, err := filepath.Abs(path)
+		exitError(err)
+
+		relPath, err := filepath.Rel(root, absPath)
+		exitError(err)
+		if relPath == ".." || strings.HasPrefix(relPath, "../") {
+			exitError(errors.New(fmt.Sprintf("%s is outside of the repository", path)))
+		}
+
+		rel = append(rel, relPath)
+	}
+
+	return rel
+}
@@ -21,41 +21,152 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"runtime"
 
 	"github.com/andybug/abakus/pkg/blob"
 	"github.com/andybug/abakus/pkg/filelist"
-	"github.com/andybug/abakus/pkg/snapshot"
+	"github.com/andybug/abakus/pkg/repo"
 	"github.com/spf13/cobra"
 )
 
+var createApplyRetention bool
+var createJobs int
+var createOnChange string
+var createFollowSymlinks bool
+var createRehash bool
+var createSpecial string
+var createResume bool
+
 func init() {
 	rootCmd.AddCommand(createCmd)
+	createCmd.Flags().BoolVar(&createApplyRetention, "apply-retention", false,
+		"forget snapshots according to the configured retention policy")
+	createCmd.Flags().IntVarP(&createJobs, "jobs", "j", runtime.GOMAXPROCS(0),
+		"number of files to read, hash and compress at once")
+	createCmd.Flags().StringVar(&createOnChange, "on-change", blob.ON_CHANGE_RETRY,
+		"what to do about a file that changes while it is read: retry, warn or fail")
+	createCmd.Flags().BoolVar(&createFollowSymlinks, "follow-symlinks", false,
+		"store symlinks to files as the files they point to")
+	createCmd.Flags().StringVar(&createSpecial, "special-files", filelist.SPECIAL_RECORD,
+		"what to do with FIFOs, sockets and devices: record or skip")
+	createCmd.Flags().BoolVar(&createRehash, "rehash", false,
+		"hash every file instead of trusting the stat cache")
+	createCmd.Flags().BoolVar(&createResume, "resume", false,
+		"reuse the work of an interrupted create")
 }
 
 var createCmd = &cobra.Command{
 	Use:   "create",
 	Short: "Create a new snapshot",
-	Long:  ``,
+	Long: `Create a new snapshot of the files in the working directory.
+
+While files are being stored, the files whose blobs are safely in the
+repository are recorded every 30 seconds. If create is interrupted,
+create --resume reuses what was recorded instead of reading those files
+again; otherwise the record is discarded.
+
+A file that changes while it is read is read again by default
+(--on-change=retry), and if it keeps changing it is stored as it was
+last read and listed as unstable in the snapshot. --on-change=warn does
+that without reading it again, and --on-change=fail stops create.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		root := getRoot()
+		lockRepo(root, repo.LOCK_EXCLUSIVE)
 
-		blobStore, err := blob.GetStore(root)
+		config, err := repo.ReadConfig(root)
 		exitError(err)
+		if createJobs < 1 {
+			exitError(errors.New("--jobs must be at least 1"))
+		}
+		if !blob.IsOnChange(createOnChange) {
+			exitError(errors.New(fmt.Sprintf("unknown --on-change policy %s", createOnChange)))
+		}
+		if createApplyRetention && config.Retention.Empty() {
+			exitError(errors.New("no retention policy configured"))
+		}
 
-		snapshotStore, err := snapshot.GetStore(root)
-		exitError(err)
+		blobStore, snapshotStore := getStores(root)
+		defer blobStore.Close()
 		defer snapshotStore.Close()
 
-		fl, err := filelist.NewFromRoot(root)
+		// files the stat cache does not know are hashed as they are stored
+		fl, cache, skipped := scanWorkdir(root, createRehash, &filelist.ScanOptions{
+			FollowSymlinks: createFollowSymlinks,
+			Special:        createSpecial,
+		})
+		defer cache.Close()
+
+		// unchanged files reuse the chunks from the latest snapshot
+		var previous *filelist.FileList
+		if snapshotStore.GetLatestId() != 0 {
+			latest, err := snapshotStore.GetLatestSnapshot()
+			exitError(err)
+			previous = latest.Files
+		}
+
+		checkpoint, err := snapshotStore.GetCheckpoint()
 		exitError(err)
+		if checkpoint != nil && !createResume {
+			exitError(snapshotStore.ClearCheckpoint())
+			checkpoint = nil
+		}
+
+		if checkpoint != nil {
+			// the hashes were added to the stat cache with the checkpoint,
+			// and the chunks are reused like those of the latest snapshot
+			fmt.Printf("Resuming with %d files stored by an interrupted create\n",
+				checkpoint.Files.Size())
+			if previous == nil {
+				previous = filelist.New()
+			}
+			it := checkpoint.Files.Iterator()
+			for it.Next() {
+				previous.Add(it.Key().(string), it.Value().(*filelist.FileMetadata))
+			}
+		} else if createResume {
+			fmt.Println("No interrupted create to resume")
+		}
 
-		_, _, err = blobStore.AddFiles(fl)
+		result, err := blobStore.AddFiles(fl, previous, &blob.AddOptions{
+			Jobs:     createJobs,
+			OnChange: createOnChange,
+			Checkpoint: func(done *filelist.FileList) error {
+				if err := snapshotStore.AddCheckpoint(done); err != nil {
+					return err
+				}
+				return cache.Add(done)
+			},
+		})
 		exitError(err)
 
-		_, err = snapshotStore.CreateSnapshot(fl)
+		// the blobs must be in the index before the snapshot refers to them
+		exitError(blobStore.Flush())
+
+		var warnings []string
+		for _, path := range skipped {
+			warnings = append(warnings, fmt.Sprintf("%s is a special file and was skipped", path))
+		}
+		for _, path := range result.Unstable {
+			warnings = append(warnings, fmt.Sprintf("%s changed while it was being read", path))
+		}
+
+		_, err = snapshotStore.CreateSnapshot(fl, warnings)
 		exitError(err)
+		exitError(cache.Update(fl))
 
 		fmt.Println("Snapshot created")
+		if len(result.Unstable) > 0 {
+			fmt.Printf("%d files changed while they were being read and may be inconsistent:\n",
+				len(result.Unstable))
+			for _, path := range result.Unstable {
+				fmt.Printf("    %s\n", path)
+			}
+		}
+
+		if createApplyRetention {
+			applyRetention(snapshotStore, blobStore, &config.Retention, false)
+		}
 	},
 }
@@ -0,0 +1,71 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/andybug/abakus/pkg/repo"
+	"github.com/andybug/abakus/pkg/snapshot"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(deleteCmd)
+}
+
+var deleteCmd = &cobra.Command{
+	Use:   "delete <id...>",
+	Short: "Delete snapshots from the repository",
+	Long: `Delete removes snapshots from the repository. The blobs they
+reference are left in place; run prune to reclaim the space.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		root := getRoot()
+		lockRepo(root, repo.LOCK_EXCLUSIVE)
+
+		if len(args) < 1 {
+			exitError(errors.New("delete requires at least one id argument"))
+		}
+
+		snapshotStore, err := snapshot.GetStore(root, getKey(root))
+		exitError(err)
+		defer snapshotStore.Close()
+
+		// check all of the ids before deleting anything
+		var ids []uint64
+		for _, arg := range args {
+			id, err := strconv.ParseUint(arg, 10, 64)
+			exitError(err)
+
+			if !snapshotStore.HasSnapshot(id) {
+				exitError(errors.New(fmt.Sprintf("No snapshot with id %d", id)))
+			}
+			ids = append(ids, id)
+		}
+
+		for _, id := range ids {
+			exitError(snapshotStore.DeleteSnapshot(id))
+			fmt.Printf("Snapshot %d deleted\n", id)
+		}
+	},
+}
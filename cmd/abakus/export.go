@@ -0,0 +1,92 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/andybug/abakus/pkg/export"
+	"github.com/andybug/abakus/pkg/repo"
+	"github.com/spf13/cobra"
+)
+
+var exportOutput string
+var exportFormat string
+
+func init() {
+	rootCmd.AddCommand(exportCmd)
+	exportCmd.Flags().StringVarP(&exportOutput, "output", "o", "-",
+		"archive to write, - for stdout")
+	exportCmd.Flags().StringVar(&exportFormat, "format", "",
+		"archive format: tar, tgz, or zip (guessed from the output name)")
+}
+
+var exportCmd = &cobra.Command{
+	Use:   "export <id> [paths...]",
+	Short: "Export files from a snapshot to an archive",
+	Long:  ``,
+	Run: func(cmd *cobra.Command, args []string) {
+		root := getRoot()
+		lockRepo(root, repo.LOCK_SHARED)
+
+		if len(args) < 1 {
+			exitError(errors.New("export requires an id argument"))
+		}
+
+		id, err := strconv.ParseUint(args[0], 10, 64)
+		exitError(err)
+
+		format := exportFormat
+		if format == "" {
+			format = export.FormatFromPath(exportOutput)
+		}
+
+		blobStore, snapshotStore := getStores(root)
+		defer blobStore.Close()
+		defer snapshotStore.Close()
+
+		snapshot, err := snapshotStore.GetSnapshot(id)
+		exitError(err)
+		fl := snapshot.Files.Select(relPaths(root, args[1:]))
+
+		var output io.Writer = os.Stdout
+		if exportOutput != "-" {
+			file, err := os.Create(exportOutput)
+			exitError(err)
+			defer file.Close()
+			output = file
+		}
+
+		w, err := export.NewWriter(format, output)
+		exitError(err)
+
+		count, err := export.Export(fl, blobStore, w)
+		exitError(err)
+		exitError(w.Close())
+
+		// keep stdout clean when the archive is written there
+		fmt.Fprintf(os.Stderr, "Exported %d files\n", count)
+	},
+}
@@ -0,0 +1,128 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/andybug/abakus/pkg/blob"
+	"github.com/andybug/abakus/pkg/repo"
+	"github.com/andybug/abakus/pkg/snapshot"
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+)
+
+var forgetPolicy repo.RetentionPolicy
+var forgetDryRun bool
+var forgetSave bool
+
+func init() {
+	rootCmd.AddCommand(forgetCmd)
+	flags := forgetCmd.Flags()
+	flags.IntVar(&forgetPolicy.Last, "keep-last", 0, "keep the last n snapshots")
+	flags.IntVar(&forgetPolicy.Hourly, "keep-hourly", 0, "keep the last snapshot of the last n hours")
+	flags.IntVar(&forgetPolicy.Daily, "keep-daily", 0, "keep the last snapshot of the last n days")
+	flags.IntVar(&forgetPolicy.Weekly, "keep-weekly", 0, "keep the last snapshot of the last n weeks")
+	flags.IntVar(&forgetPolicy.Monthly, "keep-monthly", 0, "keep the last snapshot of the last n months")
+	flags.IntVar(&forgetPolicy.Yearly, "keep-yearly", 0, "keep the last snapshot of the last n years")
+	flags.BoolVar(&forgetPolicy.Prune, "prune", false, "prune unreferenced blobs afterwards")
+	flags.BoolVarP(&forgetDryRun, "dry-run", "n", false, "show what would be deleted without deleting it")
+	flags.BoolVar(&forgetSave, "save", false, "store the policy in the repository config")
+}
+
+var forgetCmd = &cobra.Command{
+	Use:   "forget",
+	Short: "Delete snapshots according to a retention policy",
+	Long: `Forget keeps the snapshots selected by the --keep-* flags and
+deletes the rest. Without any --keep-* flags, the policy stored in the
+repository config is used. --save stores the given policy in the config
+so that create --apply-retention can enforce it.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		root := getRoot()
+		lockRepo(root, repo.LOCK_EXCLUSIVE)
+
+		config, err := repo.ReadConfig(root)
+		exitError(err)
+
+		policy := &forgetPolicy
+		if policy.Empty() {
+			configured := config.Retention
+			configured.Prune = configured.Prune || forgetPolicy.Prune
+			policy = &configured
+		}
+		if policy.Empty() {
+			exitError(errors.New("no retention policy given or configured"))
+		}
+
+		if forgetSave {
+			config.Retention = *policy
+			exitError(repo.WriteConfig(root, config))
+			fmt.Println("Retention policy saved")
+		}
+
+		blobStore, snapshotStore := getStores(root)
+		defer blobStore.Close()
+		defer snapshotStore.Close()
+
+		applyRetention(snapshotStore, blobStore, policy, forgetDryRun)
+	},
+}
+
+// applyRetention prints which snapshots the policy keeps and why, deletes
+// the others, then prunes blobs if the policy asks for it
+func applyRetention(snapshotStore *snapshot.Store, blobStore *blob.Store,
+	policy *repo.RetentionPolicy, dryRun bool) {
+
+	result := snapshot.ApplyRetention(policy, snapshotStore.GetAllMetadata())
+
+	w := tabwriter.NewWriter(os.Stdout, 4, 0, 4, ' ', tabwriter.TabIndent)
+	fmt.Fprintln(w, "ID\tTIME\tACTION\tREASONS")
+	for _, metadata := range result.Keep {
+		fmt.Fprintf(w, "%d\t%s\tkeep\t%s\n",
+			metadata.Id,
+			humanize.Time(time.Unix(metadata.Timestamp, 0)),
+			strings.Join(result.Reasons[metadata.Id], ", "))
+	}
+	for _, metadata := range result.Remove {
+		fmt.Fprintf(w, "%d\t%s\tdelete\t\n",
+			metadata.Id,
+			humanize.Time(time.Unix(metadata.Timestamp, 0)))
+	}
+	w.Flush()
+
+	if dryRun {
+		return
+	}
+
+	for _, metadata := range result.Remove {
+		exitError(snapshotStore.DeleteSnapshot(metadata.Id))
+	}
+	fmt.Printf("%d snapshots deleted\n", len(result.Remove))
+
+	if policy.Prune {
+		pruneBlobs(snapshotStore, blobStore, false)
+	}
+}
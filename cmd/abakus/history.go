@@ -0,0 +1,103 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/andybug/abakus/pkg/filelist"
+	"github.com/andybug/abakus/pkg/repo"
+	"github.com/andybug/abakus/pkg/snapshot"
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(historyCmd)
+}
+
+var historyCmd = &cobra.Command{
+	Use:   "history <path>",
+	Short: "Show every version of a file across snapshots",
+	Long:  ``,
+	Run: func(cmd *cobra.Command, args []string) {
+		root := getRoot()
+		lockRepo(root, repo.LOCK_SHARED)
+
+		if len(args) != 1 {
+			exitError(errors.New("history requires a path argument"))
+		}
+		relPath := relPaths(root, args)[0]
+
+		store, err := snapshot.GetStore(root, getKey(root))
+		exitError(err)
+		defer store.Close()
+
+		versions, err := store.FileHistory(relPath)
+		exitError(err)
+
+		if len(versions) == 0 {
+			exitError(errors.New(fmt.Sprintf("%s is not in any snapshot", relPath)))
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 4, 0, 4, ' ', tabwriter.TabIndent)
+		fmt.Fprintln(w, "SNAPSHOTS\tFROM\tTO\tEVENT\tHASH\tSIZE\tMODE")
+
+		for _, version := range versions {
+			ids := make([]string, 0, len(version.Ids))
+			for _, id := range version.Ids {
+				ids = append(ids, fmt.Sprintf("%d", id))
+			}
+
+			hash, size, mode := "-", "-", "-"
+			if version.Metadata != nil {
+				switch {
+				case version.Metadata.IsRegular():
+					// hard link members and interrupted files may have no hash
+					if len(version.Metadata.Hash) >= 4 {
+						hash = fmt.Sprintf("%x", version.Metadata.Hash[:4])
+					}
+				case version.Metadata.Type == filelist.TYPE_SYMLINK:
+					hash = "-> " + version.Metadata.Target
+				default:
+					hash = version.Metadata.Type
+				}
+				size = humanize.Bytes(version.Metadata.Size)
+				mode = fmt.Sprintf("%o", os.FileMode(version.Metadata.Mode).Perm())
+			}
+
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				strings.Join(ids, ","),
+				humanize.Time(time.Unix(version.First.Timestamp, 0)),
+				humanize.Time(time.Unix(version.Last.Timestamp, 0)),
+				version.Event,
+				hash,
+				size,
+				mode)
+		}
+		w.Flush()
+	},
+}
@@ -21,26 +21,76 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
 
+	"github.com/andybug/abakus/pkg/crypt"
 	"github.com/andybug/abakus/pkg/repo"
 	"github.com/spf13/cobra"
 )
 
+var initEncrypt bool
+var initCompression string
+
 func init() {
 	rootCmd.AddCommand(initCmd)
+	initCmd.Flags().BoolVar(&initEncrypt, "encrypt", false,
+		"encrypt blobs and snapshots with a key protected by a passphrase")
+	initCmd.Flags().StringVar(&initCompression, "compression", repo.COMPRESSION_DEFAULT,
+		"compression for new blobs: zstd, zlib or none")
 }
 
 var initCmd = &cobra.Command{
 	Use:   "init",
 	Short: "Initialize a new abakus repository in the current directory",
-	Long:  ``,
+	Long: `Initialize a new abakus repository in the current directory.
+
+With --encrypt a random master key is generated and stored in .abakus/keys,
+wrapped with a key derived from a passphrase. The passphrase is read from
+ABAKUS_PASSWORD, from the file named by ABAKUS_PASSWORD_FILE, or from the
+terminal.
+
+--compression sets the compression in .abakus/config.yaml, where it can be
+changed later. Files that are already compressed, such as images, videos and
+archives, are stored without compressing them again.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		cwd, _ := os.Getwd()
+
+		if !repo.IsCompression(initCompression) {
+			exitError(errors.New(fmt.Sprintf("Compression '%s' not supported", initCompression)))
+		}
+
+		var passphrase []byte
+		if initEncrypt {
+			passphrase = readPassphrase("ABAKUS_PASSWORD", "Enter new passphrase: ", true)
+		}
+
 		_, err := repo.Create(cwd)
 		exitError(err)
 
+		config, err := repo.ReadConfig(cwd)
+		exitError(err)
+		config.Compression = initCompression
+
+		if initEncrypt {
+			key, err := crypt.NewMasterKey()
+			exitError(err)
+
+			keyFile, err := crypt.Wrap(key, passphrase, crypt.DefaultKDFParams())
+			exitError(err)
+			_, err = crypt.WriteKeyFile(repo.GetKeysDir(cwd), keyFile)
+			exitError(err)
+
+			config.Encryption = repo.ENCRYPTION_XCHACHA20
+		}
+		exitError(repo.WriteConfig(cwd, config))
+
+		if initEncrypt {
+			fmt.Println("New encrypted abakus repository initialized")
+			return
+		}
+
 		fmt.Println("New abakus repository initialized")
 	},
 }
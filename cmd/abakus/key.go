@@ -0,0 +1,296 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/andybug/abakus/pkg/crypt"
+	"github.com/andybug/abakus/pkg/remote"
+	"github.com/andybug/abakus/pkg/repo"
+	"github.com/andybug/abakus/pkg/snapshot"
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+)
+
+var keyKDF crypt.KDFParams
+
+func init() {
+	rootCmd.AddCommand(keyCmd)
+	keyCmd.AddCommand(keyAddCmd)
+	keyCmd.AddCommand(keyListCmd)
+	keyCmd.AddCommand(keyRemoveCmd)
+	keyCmd.AddCommand(keyPasswdCmd)
+	keyCmd.AddCommand(keyRotateCmd)
+	keyCmd.AddCommand(keyRecoveryCmd)
+
+	for _, cmd := range []*cobra.Command{keyAddCmd, keyPasswdCmd, keyRotateCmd} {
+		flags := cmd.Flags()
+		flags.IntVar(&keyKDF.N, "scrypt-n", crypt.SCRYPT_N,
+			"scrypt cpu and memory cost, a power of 2")
+		flags.IntVar(&keyKDF.R, "scrypt-r", crypt.SCRYPT_R, "scrypt block size")
+		flags.IntVar(&keyKDF.P, "scrypt-p", crypt.SCRYPT_P, "scrypt parallelism")
+	}
+}
+
+var keyCmd = &cobra.Command{
+	Use:   "key",
+	Short: "Manage the passphrases of an encrypted repository",
+	Long: `Manage the passphrases of an encrypted repository. Each passphrase
+wraps a copy of the repository master key in .abakus/keys; any of them
+opens the repository. New passphrases are read from ABAKUS_NEW_PASSWORD,
+from the file named by ABAKUS_NEW_PASSWORD_FILE, or from the terminal.`,
+}
+
+var keyAddCmd = &cobra.Command{
+	Use:   "add",
+	Short: "Add a passphrase that opens the repository",
+	Long:  ``,
+	Run: func(cmd *cobra.Command, args []string) {
+		root := getEncryptedRoot()
+		lockRepo(root, repo.LOCK_EXCLUSIVE)
+		key, _, _ := unlock(root)
+
+		passphrase := readPassphrase("ABAKUS_NEW_PASSWORD", "Enter new passphrase: ", true)
+		id := addKeyFile(root, key, passphrase)
+
+		fmt.Printf("Key %s added\n", id)
+	},
+}
+
+var keyListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the passphrases and recovery keys of the repository",
+	Long:  ``,
+	Run: func(cmd *cobra.Command, args []string) {
+		root := getEncryptedRoot()
+		lockRepo(root, repo.LOCK_SHARED)
+
+		keyFiles, err := crypt.ReadKeyFiles(repo.GetKeysDir(root))
+		exitError(err)
+
+		var ids []string
+		for id := range keyFiles {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool {
+			return keyFiles[ids[i]].Created < keyFiles[ids[j]].Created
+		})
+
+		w := tabwriter.NewWriter(os.Stdout, 4, 0, 4, ' ', tabwriter.TabIndent)
+		fmt.Fprintln(w, "ID\tTYPE\tCREATED\tUSER\tHOST\tKDF")
+		for _, id := range ids {
+			keyFile := keyFiles[id]
+			keyType := "passphrase"
+			if keyFile.Recovery {
+				keyType = "recovery"
+			}
+
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s N=%d r=%d p=%d\n",
+				id,
+				keyType,
+				humanize.Time(time.Unix(keyFile.Created, 0)),
+				keyFile.User,
+				keyFile.Host,
+				keyFile.KDF, keyFile.N, keyFile.R, keyFile.P)
+		}
+		w.Flush()
+	},
+}
+
+var keyRemoveCmd = &cobra.Command{
+	Use:   "remove <id>",
+	Short: "Remove a passphrase or recovery key",
+	Long: `Remove a passphrase or recovery key from the repository and from
+every remote that has a copy of it. The passphrase used to run the command
+cannot be removed.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		root := getEncryptedRoot()
+		lockRepo(root, repo.LOCK_EXCLUSIVE)
+
+		if len(args) != 1 {
+			exitError(errors.New("key remove requires an id argument"))
+		}
+		id := args[0]
+
+		_, usedId, _ := unlock(root)
+		if id == usedId {
+			exitError(errors.New("Cannot remove the key that was used to unlock the repository"))
+		}
+
+		removeKeyFiles(root, []string{id})
+		fmt.Printf("Key %s removed\n", id)
+	},
+}
+
+var keyPasswdCmd = &cobra.Command{
+	Use:   "passwd",
+	Short: "Change the passphrase used to unlock the repository",
+	Long: `Change the passphrase used to unlock the repository. The key file
+for the old passphrase is replaced by one for the new passphrase, locally
+and on every remote.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		root := getEncryptedRoot()
+		lockRepo(root, repo.LOCK_EXCLUSIVE)
+		key, usedId, _ := unlock(root)
+
+		if isRecoveryKey(root, usedId) {
+			exitError(errors.New("Unlocked with a recovery key; use 'key add' to add a passphrase"))
+		}
+
+		passphrase := readPassphrase("ABAKUS_NEW_PASSWORD", "Enter new passphrase: ", true)
+		id := addKeyFile(root, key, passphrase)
+		removeKeyFiles(root, []string{usedId})
+
+		fmt.Printf("Passphrase changed, key %s replaced by %s\n", usedId, id)
+	},
+}
+
+var keyRotateCmd = &cobra.Command{
+	Use:   "rotate",
+	Short: "Replace the master key and re-encrypt the snapshot metadata",
+	Long: `Replace the master key and re-encrypt the snapshot metadata with
+it. New blobs are encrypted with the new key; existing blobs are left as
+they are and can still be read. Only the passphrase used to run the command
+is carried over. Every other passphrase and recovery key is removed and
+must be added again. Remotes are updated on the next push.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		root := getEncryptedRoot()
+		lockRepo(root, repo.LOCK_EXCLUSIVE)
+		key, usedId, passphrase := unlock(root)
+
+		if isRecoveryKey(root, usedId) {
+			exitError(errors.New("Unlocked with a recovery key; unlock with a passphrase to rotate"))
+		}
+
+		keyFiles, err := crypt.ReadKeyFiles(repo.GetKeysDir(root))
+		exitError(err)
+
+		rotated, err := key.Rotate()
+		exitError(err)
+
+		store, err := snapshot.GetStore(root, key)
+		exitError(err)
+		defer store.Close()
+
+		// the new key file is written before the metadata is re-encrypted
+		// so the repository can always be opened with the passphrase
+		id := addKeyFile(root, rotated, passphrase)
+		exitError(store.Rekey(rotated))
+
+		for oldId := range keyFiles {
+			exitError(crypt.RemoveKeyFile(repo.GetKeysDir(root), oldId))
+		}
+
+		fmt.Printf("Master key rotated, key %s replaced by %s\n", usedId, id)
+		if len(keyFiles) > 1 {
+			fmt.Printf("%d other keys were removed\n", len(keyFiles)-1)
+		}
+	},
+}
+
+var keyRecoveryCmd = &cobra.Command{
+	Use:   "recovery",
+	Short: "Create a printable recovery key",
+	Long: `Create a recovery key. It opens the repository like a passphrase
+and can be used to add a new passphrase if all of the others are lost. It
+is only shown once; print it or write it down and keep it somewhere safe.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		root := getEncryptedRoot()
+		lockRepo(root, repo.LOCK_EXCLUSIVE)
+		key, _, _ := unlock(root)
+
+		keyFile, recoveryKey, err := crypt.WrapRecovery(key)
+		exitError(err)
+
+		id, err := crypt.WriteKeyFile(repo.GetKeysDir(root), keyFile)
+		exitError(err)
+
+		fmt.Printf("Recovery key %s added:\n\n", id)
+		fmt.Printf("    %s\n\n", recoveryKey)
+		fmt.Println("Enter it at the passphrase prompt to open the repository.")
+	},
+}
+
+// getEncryptedRoot returns the root of the repository, which must be
+// encrypted
+func getEncryptedRoot() string {
+	root := getRoot()
+
+	config, err := repo.ReadConfig(root)
+	exitError(err)
+
+	if config.Encryption == repo.ENCRYPTION_NONE {
+		exitError(errors.New("Repository is not encrypted"))
+	}
+
+	return root
+}
+
+// addKeyFile wraps the master key with the passphrase using the kdf flags
+// and returns the id of the new key file
+func addKeyFile(root string, key *crypt.MasterKey, passphrase []byte) string {
+	keyFile, err := crypt.Wrap(key, passphrase, keyKDF)
+	exitError(err)
+
+	id, err := crypt.WriteKeyFile(repo.GetKeysDir(root), keyFile)
+	exitError(err)
+
+	return id
+}
+
+// isRecoveryKey returns true if the key file with the id holds a recovery
+// key
+func isRecoveryKey(root string, id string) bool {
+	keyFiles, err := crypt.ReadKeyFiles(repo.GetKeysDir(root))
+	exitError(err)
+
+	return keyFiles[id] != nil && keyFiles[id].Recovery
+}
+
+// removeKeyFiles deletes the key files locally and from every remote. A
+// remote that cannot be reached is reported but does not stop the removal.
+func removeKeyFiles(root string, ids []string) {
+	for _, id := range ids {
+		exitError(crypt.RemoveKeyFile(repo.GetKeysDir(root), id))
+	}
+
+	config, err := repo.ReadConfig(root)
+	exitError(err)
+
+	for name, remoteConfig := range config.Remotes {
+		r, err := remote.Open(remoteConfig)
+		for _, id := range ids {
+			if err == nil {
+				err = remote.DeleteKeyFile(r, id)
+			}
+		}
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "warning: could not remove keys from remote '%s': %s\n", name, err)
+		}
+	}
+}
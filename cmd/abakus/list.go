@@ -26,7 +26,8 @@ import (
 	"text/tabwriter"
 	"time"
 
-	"github.com/andybug/abakus/pkg/snapshot"
+	"github.com/andybug/abakus/pkg/filelist"
+	"github.com/andybug/abakus/pkg/repo"
 	"github.com/dustin/go-humanize"
 	"github.com/spf13/cobra"
 )
@@ -38,25 +39,53 @@ func init() {
 var listCmd = &cobra.Command{
 	Use:   "list",
 	Short: "List snapshots in the repository",
-	Long:  ``,
+	Long: `List snapshots in the repository. SIZE is the total size of the
+files in the snapshot. STORED is the space used by the blobs that the
+snapshot added to the repository, after deduplication, compression and
+encryption; blobs shared with earlier snapshots are not counted again.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		root := getRoot()
+		lockRepo(root, repo.LOCK_SHARED)
 
-		store, err := snapshot.GetStore(root)
-		exitError(err)
+		blobStore, store := getStores(root)
+		defer blobStore.Close()
 		defer store.Close()
 
 		w := tabwriter.NewWriter(os.Stdout, 4, 0, 4, ' ', tabwriter.TabIndent)
-		fmt.Fprintln(w, "ID\tTIME\tMERKLE\tFILES\tSIZE")
+		fmt.Fprintln(w, "ID\tTIME\tMERKLE\tFILES\tSIZE\tSTORED")
+
+		// blobs counted by an earlier snapshot
+		counted := make(map[string]bool)
 
 		metadataList := store.GetAllMetadata()
 		for _, metadata := range metadataList {
-			fmt.Fprintf(w, "%d\t%s\t%x\t%s\t%s\n",
+			snapshot, err := store.GetSnapshot(metadata.Id)
+			exitError(err)
+
+			var stored uint64 = 0
+			it := snapshot.Files.Files.Iterator()
+			for it.Next() {
+				fileMetadata := it.Value().(*filelist.FileMetadata)
+				for _, hash := range fileMetadata.Blobs() {
+					name := blobStore.Name(hash)
+					if counted[name] {
+						continue
+					}
+					counted[name] = true
+
+					// a missing blob is reported by validate, not here
+					size, _ := blobStore.Size(name)
+					stored += size
+				}
+			}
+
+			fmt.Fprintf(w, "%d\t%s\t%x\t%s\t%s\t%s\n",
 				metadata.Id,
 				humanize.Time(time.Unix(metadata.Timestamp, 0)),
 				metadata.MerkleRoot[:4],
 				humanize.Comma(int64(metadata.FileCount)),
-				humanize.Bytes(metadata.Size))
+				humanize.Bytes(metadata.Size),
+				humanize.Bytes(stored))
 		}
 		w.Flush()
 	},
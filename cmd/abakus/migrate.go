@@ -0,0 +1,65 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/andybug/abakus/pkg/blob"
+	"github.com/andybug/abakus/pkg/repo"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(migrateCmd)
+}
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Move the repository's blobs into the current layout",
+	Long: `Move the loose blobs and pack files of a repository created by an older
+version of abakus into the sharded layout, and record the new format in the
+config. Every file is moved by a single rename, so the repository can be used
+while it is part way through, and an interrupted migration can be run again.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		root := getRoot()
+		lockRepo(root, repo.LOCK_EXCLUSIVE)
+
+		config, err := repo.ReadConfig(root)
+		exitError(err)
+
+		// files are moved even at the current format, to finish off any
+		// left behind by an old version writing to the repository
+		blobs, packs, err := blob.Migrate(root)
+		exitError(err)
+
+		if config.Format == repo.FORMAT_CURRENT && blobs == 0 && packs == 0 {
+			fmt.Printf("Repository is already at format %d\n", repo.FORMAT_CURRENT)
+			return
+		}
+
+		config.Format = repo.FORMAT_CURRENT
+		exitError(repo.WriteConfig(root, config))
+
+		fmt.Printf("Moved %d loose blobs and %d packs; repository is now at format %d\n",
+			blobs, packs, repo.FORMAT_CURRENT)
+	},
+}
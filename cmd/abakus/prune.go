@@ -0,0 +1,99 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/andybug/abakus/pkg/blob"
+	"github.com/andybug/abakus/pkg/repo"
+	"github.com/andybug/abakus/pkg/snapshot"
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+)
+
+var pruneDryRun bool
+
+func init() {
+	rootCmd.AddCommand(pruneCmd)
+	pruneCmd.Flags().BoolVarP(&pruneDryRun, "dry-run", "n", false,
+		"report what would be removed without removing it")
+}
+
+var pruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Remove blobs that are not referenced by any snapshot",
+	Long: `Remove blobs that are not referenced by any snapshot. Blobs in pack
+files are dropped from the index; run repack to reclaim the space they
+used in the pack files.
+
+Leftovers from interrupted runs are cleaned up too: unfinished pack files,
+pack files that never made it into the index, and the record of an
+interrupted create, whose blobs are then removed.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		root := getRoot()
+		lockRepo(root, repo.LOCK_EXCLUSIVE)
+
+		blobStore, snapshotStore := getStores(root)
+		defer blobStore.Close()
+		defer snapshotStore.Close()
+
+		pruneBlobs(snapshotStore, blobStore, pruneDryRun)
+	},
+}
+
+// pruneBlobs removes the blobs not referenced by any snapshot and reports
+// how much space was reclaimed
+func pruneBlobs(snapshotStore *snapshot.Store, blobStore *blob.Store, dryRun bool) {
+	checkpoint, err := snapshotStore.GetCheckpoint()
+	exitError(err)
+	if checkpoint != nil {
+		if dryRun {
+			fmt.Println("Would discard the files stored by an interrupted create")
+		} else {
+			exitError(snapshotStore.ClearCheckpoint())
+			fmt.Println("Discarded the files stored by an interrupted create")
+		}
+	}
+
+	referenced, err := snapshotStore.ReferencedBlobs(blobStore.Name)
+	exitError(err)
+	count, bytes, err := blobStore.Sweep(referenced, dryRun)
+	exitError(err)
+
+	if dryRun {
+		fmt.Printf("Would remove %d blobs (%s)\n", count, humanize.Bytes(bytes))
+	} else {
+		fmt.Printf("Removed %d blobs (%s)\n", count, humanize.Bytes(bytes))
+	}
+
+	count, bytes, err = blobStore.CleanLeftovers(referenced, dryRun)
+	exitError(err)
+	if count == 0 {
+		return
+	}
+
+	if dryRun {
+		fmt.Printf("Would remove %d leftover pack files (%s)\n", count, humanize.Bytes(bytes))
+	} else {
+		fmt.Printf("Removed %d leftover pack files (%s)\n", count, humanize.Bytes(bytes))
+	}
+}
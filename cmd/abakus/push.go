@@ -0,0 +1,155 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/andybug/abakus/pkg/blob"
+	"github.com/andybug/abakus/pkg/crypt"
+	"github.com/andybug/abakus/pkg/remote"
+	"github.com/andybug/abakus/pkg/repo"
+	"github.com/andybug/abakus/pkg/snapshot"
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(pushCmd)
+	rootCmd.AddCommand(pullCmd)
+}
+
+var pushCmd = &cobra.Command{
+	Use:   "push <remote> [id...]",
+	Short: "Upload snapshots and their blobs to a remote",
+	Long: `Upload the given snapshots, or every snapshot the remote lacks, with
+the blobs the remote does not have yet. Each snapshot is listed in the
+remote's manifest only after its blobs and file list are uploaded.
+
+The remote is not locked. Pushes from several repositories to one remote
+at the same time may drop each other's manifest entries; push again to
+list a snapshot that is missing.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		transfer(args, "push", remote.Push)
+	},
+}
+
+var pullCmd = &cobra.Command{
+	Use:   "pull <remote> [id...]",
+	Short: "Download snapshots and their blobs from a remote",
+	Long:  ``,
+	Run: func(cmd *cobra.Command, args []string) {
+		transfer(args, "pull", remote.Pull)
+	},
+}
+
+// transferFunc is the signature of remote.Push and remote.Pull
+type transferFunc func(remote.Remote, *crypt.MasterKey, *snapshot.Store, *blob.Store, []uint64) (*remote.TransferResult, error)
+
+// transfer opens the stores and the remote named in args and runs the push
+// or pull for the ids in the rest of args
+func transfer(args []string, verb string, fn transferFunc) {
+	root := getRoot()
+	if verb == "pull" {
+		lockRepo(root, repo.LOCK_EXCLUSIVE)
+	} else {
+		lockRepo(root, repo.LOCK_SHARED)
+	}
+
+	if len(args) < 1 {
+		exitError(errors.New(fmt.Sprintf("%s requires a remote argument", verb)))
+	}
+	_, r := openRemote(root, args[0])
+
+	var ids []uint64
+	for _, arg := range args[1:] {
+		id, err := strconv.ParseUint(arg, 10, 64)
+		exitError(err)
+		ids = append(ids, id)
+	}
+
+	if verb == "pull" {
+		adoptEncryption(root, r)
+	}
+
+	key := getKey(root)
+	exitError(remote.CheckKey(r, key))
+
+	blobStore, err := blob.GetStore(root, key)
+	exitError(err)
+	defer blobStore.Close()
+
+	snapshotStore, err := snapshot.GetStore(root, key)
+	exitError(err)
+	defer snapshotStore.Close()
+
+	// share every passphrase that can open the repository
+	if key != nil && verb == "push" {
+		_, err = remote.PushKeys(r, repo.GetKeysDir(root), key)
+		exitError(err)
+	}
+
+	result, err := fn(r, key, snapshotStore, blobStore, ids)
+	for _, id := range result.Snapshots {
+		fmt.Printf("Snapshot %d: %sed\n", id, verb)
+	}
+	exitError(err)
+
+	fmt.Printf("%d snapshots, %d blobs (%s) transferred\n",
+		len(result.Snapshots), result.Blobs, humanize.Bytes(result.Bytes))
+}
+
+// adoptEncryption makes a repository with no snapshots use the encryption
+// of the remote it pulls from, by copying the remote's key files
+func adoptEncryption(root string, r remote.Remote) {
+	config, err := repo.ReadConfig(root)
+	exitError(err)
+
+	if config.Encryption != repo.ENCRYPTION_NONE {
+		return
+	}
+
+	keyFiles, err := remote.ReadKeyFiles(r)
+	exitError(err)
+	if len(keyFiles) == 0 {
+		return
+	}
+
+	store, err := snapshot.GetStore(root, nil)
+	exitError(err)
+	empty := len(store.GetAllMetadata()) == 0
+	store.Close()
+
+	// a repository with its own snapshots cannot change its encryption
+	if !empty {
+		return
+	}
+
+	_, err = remote.PullKeys(r, repo.GetKeysDir(root))
+	exitError(err)
+
+	config.Encryption = repo.ENCRYPTION_XCHACHA20
+	exitError(repo.WriteConfig(root, config))
+
+	fmt.Println("Repository encryption enabled from the remote")
+}
@@ -0,0 +1,249 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/andybug/abakus/pkg/remote"
+	"github.com/andybug/abakus/pkg/repo"
+	"github.com/andybug/abakus/pkg/snapshot"
+	"github.com/spf13/cobra"
+)
+
+var remoteAddConfig repo.RemoteConfig
+
+func init() {
+	rootCmd.AddCommand(remoteAddCmd)
+	rootCmd.AddCommand(remoteLsCmd)
+	rootCmd.AddCommand(remoteShowCmd)
+	rootCmd.AddCommand(remoteDeleteCmd)
+	flags := remoteAddCmd.Flags()
+	flags.StringVar(&remoteAddConfig.Type, "type", "",
+		"type of remote storage: dir or s3 (guessed from the location)")
+	flags.StringVar(&remoteAddConfig.Endpoint, "endpoint", "",
+		"url of an s3 compatible service (defaults to aws)")
+	flags.StringVar(&remoteAddConfig.Region, "region", "", "s3 region")
+	flags.BoolVar(&remoteAddConfig.PathStyle, "path-style", false,
+		"use path style s3 urls (endpoint/bucket/key)")
+	flags.StringVar(&remoteAddConfig.CredentialsFile, "credentials-file", "",
+		"aws style credentials file to use when keys are not in the environment")
+	flags.StringVar(&remoteAddConfig.Profile, "profile", "",
+		"profile in the credentials file")
+}
+
+var remoteAddCmd = &cobra.Command{
+	Use:   "remote-add <name> <location>",
+	Short: "Add a named remote to the repository config",
+	Long: `Add a named remote to the repository config. The location is a
+directory for dir remotes or s3://bucket/prefix for s3 remotes. s3
+credentials are read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY or
+from a credentials file; they are never stored in the repository.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		root := getRoot()
+		lockRepo(root, repo.LOCK_EXCLUSIVE)
+
+		if len(args) != 2 {
+			exitError(errors.New("remote-add requires name and location arguments"))
+		}
+		name, location := args[0], args[1]
+
+		config, err := repo.ReadConfig(root)
+		exitError(err)
+
+		if _, exists := config.Remotes[name]; exists {
+			exitError(errors.New(fmt.Sprintf("Remote '%s' already exists", name)))
+		}
+
+		remoteConfig := &remoteAddConfig
+		if remoteConfig.Type == "" {
+			remoteConfig.Type = "dir"
+			if strings.HasPrefix(location, "s3://") {
+				remoteConfig.Type = "s3"
+			}
+		}
+
+		if remoteConfig.Type == "dir" {
+			location, err = filepath.Abs(location)
+			exitError(err)
+			exitError(os.MkdirAll(location, 0755))
+		}
+		remoteConfig.Location = location
+
+		// make sure the remote is reachable and has a manifest. an
+		// existing remote is left as is so that a new repository can
+		// pull from it
+		r, err := remote.Open(remoteConfig)
+		exitError(err)
+		reader, err := r.Get(remote.MANIFEST)
+		if err == remote.ErrNotFound {
+			key := getKey(root)
+			if key != nil {
+				_, err = remote.PushKeys(r, repo.GetKeysDir(root), key)
+				exitError(err)
+			}
+
+			manifest, err := remote.ReadManifest(r, key)
+			exitError(err)
+			exitError(remote.WriteManifest(r, manifest, key))
+		} else {
+			exitError(err)
+			reader.Close()
+		}
+
+		if config.Remotes == nil {
+			config.Remotes = make(map[string]*repo.RemoteConfig)
+		}
+		config.Remotes[name] = remoteConfig
+		exitError(repo.WriteConfig(root, config))
+
+		fmt.Printf("Remote '%s' added\n", name)
+	},
+}
+
+var remoteLsCmd = &cobra.Command{
+	Use:   "remote-ls",
+	Short: "List the remotes in the repository config",
+	Long:  ``,
+	Run: func(cmd *cobra.Command, args []string) {
+		root := getRoot()
+		lockRepo(root, repo.LOCK_SHARED)
+
+		config, err := repo.ReadConfig(root)
+		exitError(err)
+
+		var names []string
+		for name := range config.Remotes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		w := tabwriter.NewWriter(os.Stdout, 4, 0, 4, ' ', tabwriter.TabIndent)
+		fmt.Fprintln(w, "NAME\tTYPE\tLOCATION")
+		for _, name := range names {
+			remoteConfig := config.Remotes[name]
+			fmt.Fprintf(w, "%s\t%s\t%s\n", name, remoteConfig.Type, remoteConfig.Location)
+		}
+		w.Flush()
+	},
+}
+
+var remoteShowCmd = &cobra.Command{
+	Use:   "remote-show <name>",
+	Short: "Show what a remote holds compared to the local repository",
+	Long:  ``,
+	Run: func(cmd *cobra.Command, args []string) {
+		root := getRoot()
+		lockRepo(root, repo.LOCK_SHARED)
+
+		if len(args) != 1 {
+			exitError(errors.New("remote-show requires a name argument"))
+		}
+
+		remoteConfig, r := openRemote(root, args[0])
+
+		key := getKey(root)
+		exitError(remote.CheckKey(r, key))
+
+		manifest, err := remote.ReadManifest(r, key)
+		exitError(err)
+
+		blobs, err := r.List(remote.BLOBS_PREFIX)
+		exitError(err)
+
+		store, err := snapshot.GetStore(root, key)
+		exitError(err)
+		defer store.Close()
+
+		var behind []uint64
+		for _, metadata := range store.GetAllMetadata() {
+			if manifest.Snapshots[metadata.Id] == nil {
+				behind = append(behind, metadata.Id)
+			}
+		}
+
+		var ahead []uint64
+		for id := range manifest.Snapshots {
+			if !store.HasSnapshot(id) {
+				ahead = append(ahead, id)
+			}
+		}
+		sort.Slice(ahead, func(i, j int) bool { return ahead[i] < ahead[j] })
+
+		fmt.Printf("Remote:      %s\n", args[0])
+		fmt.Printf("Type:        %s\n", remoteConfig.Type)
+		fmt.Printf("Location:    %s\n", remoteConfig.Location)
+		fmt.Printf("Snapshots:   %d\n", len(manifest.Snapshots))
+		fmt.Printf("Blobs:       %d\n", len(blobs))
+		fmt.Printf("Not pushed:  %d %v\n", len(behind), behind)
+		fmt.Printf("Not pulled:  %d %v\n", len(ahead), ahead)
+	},
+}
+
+var remoteDeleteCmd = &cobra.Command{
+	Use:   "remote-delete <name>",
+	Short: "Remove a remote from the repository config",
+	Long: `Remove a remote from the repository config. The data stored on
+the remote is left in place.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		root := getRoot()
+		lockRepo(root, repo.LOCK_EXCLUSIVE)
+
+		if len(args) != 1 {
+			exitError(errors.New("remote-delete requires a name argument"))
+		}
+		name := args[0]
+
+		config, err := repo.ReadConfig(root)
+		exitError(err)
+
+		if _, exists := config.Remotes[name]; !exists {
+			exitError(errors.New(fmt.Sprintf("No remote named '%s'", name)))
+		}
+
+		delete(config.Remotes, name)
+		exitError(repo.WriteConfig(root, config))
+
+		fmt.Printf("Remote '%s' deleted\n", name)
+	},
+}
+
+// openRemote looks up the named remote in the repository config and opens it
+func openRemote(root string, name string) (*repo.RemoteConfig, remote.Remote) {
+	config, err := repo.ReadConfig(root)
+	exitError(err)
+
+	remoteConfig, exists := config.Remotes[name]
+	if !exists {
+		exitError(errors.New(fmt.Sprintf("No remote named '%s'", name)))
+	}
+
+	r, err := remote.Open(remoteConfig)
+	exitError(err)
+
+	return remoteConfig, r
+}
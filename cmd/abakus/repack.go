@@ -0,0 +1,67 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/andybug/abakus/pkg/blob"
+	"github.com/andybug/abakus/pkg/repo"
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+)
+
+var repackMinUsed int
+
+func init() {
+	rootCmd.AddCommand(repackCmd)
+	repackCmd.Flags().IntVar(&repackMinUsed, "min-used", 80,
+		"rewrite packs with less than this percentage of their space in use")
+}
+
+var repackCmd = &cobra.Command{
+	Use:   "repack",
+	Short: "Consolidate sparse pack files and pack loose blobs",
+	Long: `Rewrite the pack files that have too much unused space after prune,
+merge small pack files, and move blobs stored as loose files by older
+versions of abakus into pack files.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		root := getRoot()
+		lockRepo(root, repo.LOCK_EXCLUSIVE)
+
+		if repackMinUsed < 0 || repackMinUsed > 100 {
+			exitError(errors.New("--min-used must be between 0 and 100"))
+		}
+
+		// repacking copies the stored bytes, so the key is not needed
+		blobStore, err := blob.GetStore(root, nil)
+		exitError(err)
+		defer blobStore.Close()
+
+		result, err := blobStore.Repack(float64(repackMinUsed) / 100)
+		exitError(err)
+
+		fmt.Printf("Moved %d packed and %d loose blobs into %d new packs, removed %d packs (%s reclaimed)\n",
+			result.BlobsMoved, result.LooseMoved, result.PacksWritten,
+			result.PacksRemoved, humanize.Bytes(result.Reclaimed))
+	},
+}
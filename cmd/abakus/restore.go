@@ -0,0 +1,102 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+
+	"github.com/andybug/abakus/pkg/repo"
+	"github.com/andybug/abakus/pkg/restore"
+	"github.com/spf13/cobra"
+)
+
+var restoreTarget string
+var restoreForce bool
+var restoreNumericOwner bool
+var restoreNoXattrs bool
+
+func init() {
+	rootCmd.AddCommand(restoreCmd)
+	restoreCmd.Flags().StringVarP(&restoreTarget, "target", "t", "",
+		"directory to restore into (defaults to the repository root)")
+	restoreCmd.Flags().BoolVarP(&restoreForce, "force", "f", false,
+		"overwrite working files that have been modified")
+	restoreCmd.Flags().BoolVar(&restoreNumericOwner, "numeric-owner", false,
+		"restore owners by uid and gid instead of user and group names")
+	restoreCmd.Flags().BoolVar(&restoreNoXattrs, "no-xattrs", false,
+		"do not restore extended attributes and ACLs")
+}
+
+var restoreCmd = &cobra.Command{
+	Use:   "restore <id> [paths...]",
+	Short: "Restore files from a snapshot",
+	Long:  ``,
+	Run: func(cmd *cobra.Command, args []string) {
+		root := getRoot()
+		lockRepo(root, repo.LOCK_SHARED)
+
+		if len(args) < 1 {
+			exitError(errors.New("restore requires an id argument"))
+		}
+
+		id, err := strconv.ParseUint(args[0], 10, 64)
+		exitError(err)
+
+		blobStore, snapshotStore := getStores(root)
+		defer blobStore.Close()
+		defer snapshotStore.Close()
+
+		snapshot, err := snapshotStore.GetSnapshot(id)
+		exitError(err)
+
+		opts := &restore.Options{
+			Target:       root,
+			Paths:        relPaths(root, args[1:]),
+			Force:        restoreForce,
+			NumericOwner: restoreNumericOwner,
+			NoXattrs:     restoreNoXattrs,
+		}
+
+		if restoreTarget != "" {
+			opts.Target, err = filepath.Abs(restoreTarget)
+			exitError(err)
+		}
+
+		// working files that are saved in the latest snapshot can be
+		// safely overwritten when restoring in place
+		if opts.Target == root {
+			latest, err := snapshotStore.GetLatestSnapshot()
+			exitError(err)
+			opts.Latest = latest.Files
+		}
+
+		result, err := restore.Restore(snapshot.Files, blobStore, opts)
+		exitError(err)
+
+		fmt.Printf("Restored %d files (%d unchanged)\n", result.Restored, result.Unchanged)
+		if result.Skipped > 0 {
+			fmt.Printf("Skipped %d sockets and devices that cannot be recreated\n", result.Skipped)
+		}
+	},
+}
@@ -24,17 +24,25 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
 	"text/tabwriter"
+	"time"
 
 	"github.com/andybug/abakus/pkg/filelist"
+	"github.com/andybug/abakus/pkg/repo"
 	"github.com/andybug/abakus/pkg/snapshot"
 	"github.com/dustin/go-humanize"
 	"github.com/spf13/cobra"
 )
 
+var showLong bool
+
 func init() {
 	rootCmd.AddCommand(showCmd)
+	showCmd.Flags().BoolVarP(&showLong, "long", "l", false,
+		"also show the owner, mtime, extended attributes and ACLs")
 }
 
 var showCmd = &cobra.Command{
@@ -43,8 +51,9 @@ var showCmd = &cobra.Command{
 	Long:  ``,
 	Run: func(cmd *cobra.Command, args []string) {
 		root := getRoot()
+		lockRepo(root, repo.LOCK_SHARED)
 
-		snapshotStore, err := snapshot.GetStore(root)
+		snapshotStore, err := snapshot.GetStore(root, getKey(root))
 		exitError(err)
 		defer snapshotStore.Close()
 
@@ -58,19 +67,88 @@ var showCmd = &cobra.Command{
 		snapshot, err := snapshotStore.GetSnapshot(id)
 		exitError(err)
 
+		for _, warning := range snapshot.Metadata.Warnings {
+			fmt.Fprintf(os.Stderr, "warning: %s\n", warning)
+		}
+
 		w := tabwriter.NewWriter(os.Stdout, 4, 0, 4, ' ', tabwriter.TabIndent)
-		fmt.Fprintln(w, "PATH\tHASH\tSIZE\tMODE")
+		if showLong {
+			fmt.Fprintln(w, "PATH\tHASH\tSIZE\tMODE\tOWNER\tMTIME\tXATTRS\tACL")
+		} else {
+			fmt.Fprintln(w, "PATH\tHASH\tSIZE\tMODE")
+		}
 
 		it := snapshot.Files.Files.Iterator()
 		for it.Next() {
 			metadata := it.Value().(*filelist.FileMetadata)
-			fmt.Fprintf(w, "%s\t%x\t%s\t%o\n",
-				it.Key().(string),
-				metadata.Hash,
+			hash := "-"
+			if metadata.IsRegular() {
+				hash = fmt.Sprintf("%x", metadata.Hash)
+			}
+
+			fmt.Fprintf(w, "%s\t%s\t%s\t%o",
+				describePath(it.Key().(string), metadata),
+				hash,
 				humanize.Bytes(metadata.Size),
-				metadata.Mode,
+				os.FileMode(metadata.Mode).Perm(),
 			)
+			if showLong {
+				fmt.Fprintf(w, "\t%s\t%s\t%s\t%s",
+					describeOwner(metadata),
+					metadata.MTime().Format(time.RFC3339Nano),
+					describeXattrs(metadata),
+					describeACL(metadata),
+				)
+			}
+			fmt.Fprintln(w)
 		}
 		w.Flush()
 	},
 }
+
+// describeOwner returns user:group, using the uid or gid for whichever name
+// was not known when the snapshot was taken
+func describeOwner(metadata *filelist.FileMetadata) string {
+	owner := metadata.User
+	if owner == "" {
+		owner = strconv.FormatUint(uint64(metadata.UID), 10)
+	}
+
+	group := metadata.Group
+	if group == "" {
+		group = strconv.FormatUint(uint64(metadata.GID), 10)
+	}
+
+	return owner + ":" + group
+}
+
+// describeXattrs returns the sorted names of the extended attributes
+func describeXattrs(metadata *filelist.FileMetadata) string {
+	if len(metadata.Xattrs) == 0 {
+		return "-"
+	}
+
+	names := make([]string, 0, len(metadata.Xattrs))
+	for name := range metadata.Xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return strings.Join(names, ",")
+}
+
+// describeACL returns which of the access and default ACLs are set
+func describeACL(metadata *filelist.FileMetadata) string {
+	var acls []string
+	if metadata.ACL != nil {
+		acls = append(acls, "access")
+	}
+	if metadata.DefaultACL != nil {
+		acls = append(acls, "default")
+	}
+
+	if len(acls) == 0 {
+		return "-"
+	}
+	return strings.Join(acls, ",")
+}
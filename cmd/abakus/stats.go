@@ -0,0 +1,88 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/andybug/abakus/pkg/blob"
+	"github.com/andybug/abakus/pkg/repo"
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(statsCmd)
+}
+
+var statsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "Show how well the blobs in the repository compress",
+	Long: `Show the blobs in the repository by the compression algorithm they were
+stored with. SIZE is the length of their contents, STORED the space they
+occupy after compression and encryption, and RATIO is SIZE / STORED. Blobs
+stored with "none" were judged to be compressed already.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		root := getRoot()
+		lockRepo(root, repo.LOCK_SHARED)
+
+		blobStore, err := blob.GetStore(root, getKey(root))
+		exitError(err)
+		defer blobStore.Close()
+
+		stats, err := blobStore.Stats()
+		exitError(err)
+
+		var names []string
+		for name := range stats {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		w := tabwriter.NewWriter(os.Stdout, 4, 0, 4, ' ', tabwriter.TabIndent)
+		fmt.Fprintln(w, "COMPRESSION\tBLOBS\tSIZE\tSTORED\tRATIO")
+
+		total := &blob.CompressionStats{}
+		for _, name := range names {
+			s := stats[name]
+			printStats(w, name, s)
+
+			total.Blobs += s.Blobs
+			total.Size += s.Size
+			total.Stored += s.Stored
+		}
+		printStats(w, "total", total)
+		w.Flush()
+	},
+}
+
+// printStats writes one row of the stats table
+func printStats(w *tabwriter.Writer, name string, s *blob.CompressionStats) {
+	fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%.2f\n",
+		name,
+		humanize.Comma(int64(s.Blobs)),
+		humanize.Bytes(s.Size),
+		humanize.Bytes(s.Stored),
+		s.Ratio())
+}
@@ -22,26 +22,48 @@ package main
 
 import (
 	"fmt"
+	"runtime"
 	"time"
 
 	"github.com/andybug/abakus/pkg/filelist"
+	"github.com/andybug/abakus/pkg/repo"
 	"github.com/andybug/abakus/pkg/snapshot"
 	"github.com/fatih/color"
 	"github.com/spf13/cobra"
 )
 
+var statusFollowSymlinks bool
+var statusRehash bool
+var statusSpecial string
+
 func init() {
 	rootCmd.AddCommand(statusCmd)
+	statusCmd.Flags().BoolVar(&statusFollowSymlinks, "follow-symlinks", false,
+		"compare symlinks to files as the files they point to")
+	statusCmd.Flags().StringVar(&statusSpecial, "special-files", filelist.SPECIAL_RECORD,
+		"what to do with FIFOs, sockets and devices: record or skip")
+	statusCmd.Flags().BoolVar(&statusRehash, "rehash", false,
+		"hash every file instead of trusting the stat cache")
 }
 
 var statusCmd = &cobra.Command{
 	Use:   "status",
 	Short: "Show changes to the workind directory",
-	Long:  ``,
+	Long: `Show the files that have been added, modified or deleted since the latest
+snapshot. Files whose size, times, inode and device are the same as when
+they were last hashed are not read again; --rehash reads every file.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		root := getRoot()
+		lockRepo(root, repo.LOCK_SHARED)
+
+		config, err := repo.ReadConfig(root)
+		exitError(err)
+		if config.Format < repo.FORMAT_CURRENT {
+			fmt.Printf("Repository is at format %d; run 'abakus migrate' to upgrade it\n",
+				config.Format)
+		}
 
-		store, err := snapshot.GetStore(root)
+		store, err := snapshot.GetStore(root, getKey(root))
 		exitError(err)
 		defer store.Close()
 
@@ -63,14 +85,20 @@ var statusCmd = &cobra.Command{
 		}
 
 		// get the file list for the working dir
-		workdir, err := filelist.NewFromRoot(root)
-		exitError(err)
+		workdir, cache, _ := scanWorkdir(root, statusRehash, &filelist.ScanOptions{
+			FollowSymlinks: statusFollowSymlinks,
+			Special:        statusSpecial,
+		})
+		defer cache.Close()
+		exitError(workdir.Hash(root, runtime.GOMAXPROCS(0)))
+		exitError(cache.Update(workdir))
 
 		diff := filelist.Diff(latest_fl, workdir)
 
 		// check if there are any changes
 		if len(diff.Added) == 0 &&
 			len(diff.Modified) == 0 &&
+			len(diff.Metadata) == 0 &&
 			len(diff.Deleted) == 0 {
 			fmt.Println("No changes.")
 			return
@@ -79,17 +107,34 @@ var statusCmd = &cobra.Command{
 		// output differences
 		c := color.New(color.FgGreen)
 		for _, added := range diff.Added {
-			c.Printf("added:       %s\n", added)
+			value, _ := workdir.Files.Get(added)
+			metadata := value.(*filelist.FileMetadata)
+			if metadata.Type == filelist.TYPE_DIRECTORY {
+				c.Printf("added dir:   %s\n", describePath(added, metadata))
+			} else {
+				c.Printf("added:       %s\n", describePath(added, metadata))
+			}
 		}
 
 		c = color.New(color.FgRed)
 		for _, modified := range diff.Modified {
-			c.Printf("modified:    %s\n", modified)
+			metadata, _ := workdir.Files.Get(modified)
+			c.Printf("modified:    %s\n", describePath(modified, metadata.(*filelist.FileMetadata)))
+		}
+
+		c = color.New(color.FgYellow)
+		for _, changed := range diff.Metadata {
+			c.Printf("metadata:    %s\n", changed)
 		}
 
 		c = color.New(color.FgRed)
 		for _, deleted := range diff.Deleted {
-			c.Printf("deleted:     %s\n", deleted)
+			value, _ := latest_fl.Files.Get(deleted)
+			if value.(*filelist.FileMetadata).Type == filelist.TYPE_DIRECTORY {
+				c.Printf("deleted dir: %s\n", deleted)
+			} else {
+				c.Printf("deleted:     %s\n", deleted)
+			}
 		}
 	},
 }
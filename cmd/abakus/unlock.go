@@ -0,0 +1,62 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/andybug/abakus/pkg/repo"
+	"github.com/spf13/cobra"
+)
+
+var unlockAll bool
+
+func init() {
+	rootCmd.AddCommand(unlockCmd)
+	unlockCmd.Flags().BoolVar(&unlockAll, "all", false,
+		"remove every lock, even those of commands that are still running")
+}
+
+var unlockCmd = &cobra.Command{
+	Use:   "unlock",
+	Short: "Remove stale locks from the repository",
+	Long: `Remove the locks left by commands that did not exit cleanly. A lock is
+stale if the process that took it on this host has exited, or if it has
+not been refreshed for 30 minutes. --all removes every lock; only use it
+when no other command is running.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		root := getRoot()
+
+		removed, err := repo.RemoveLocks(repo.GetLocksDir(root), unlockAll)
+		for _, info := range removed {
+			fmt.Printf("Removed %s\n", info)
+		}
+		exitError(err)
+
+		locks, err := repo.Locks(repo.GetLocksDir(root))
+		exitError(err)
+		for _, info := range locks {
+			fmt.Printf("Kept %s\n", info)
+		}
+
+		fmt.Printf("%d locks removed\n", len(removed))
+	},
+}
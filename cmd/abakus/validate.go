@@ -0,0 +1,109 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/andybug/abakus/pkg/repo"
+	"github.com/andybug/abakus/pkg/validate"
+	"github.com/dustin/go-humanize"
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+var validateReadData bool
+var validateSnapshot uint64
+var validateFix bool
+
+func init() {
+	rootCmd.AddCommand(validateCmd)
+	validateCmd.Flags().BoolVar(&validateReadData, "read-data", false,
+		"decompress and re-hash the contents of every blob")
+	validateCmd.Flags().Uint64Var(&validateSnapshot, "snapshot", 0,
+		"only validate the snapshot with this id")
+	validateCmd.Flags().BoolVar(&validateFix, "fix", false,
+		"remove pack files left behind by interrupted runs")
+}
+
+var validateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Check the integrity of snapshots and blobs",
+	Long: `Validate recomputes the merkle root of each snapshot and checks
+that every blob it references exists. With --read-data, the contents of
+each blob are decompressed and re-hashed, and chunked files are
+reassembled and re-hashed. When all snapshots are checked, blobs that no
+snapshot references are reported as orphaned, except for those stored by
+an interrupted create, which create --resume will use. Pack files left
+behind by interrupted runs are reported, or removed with --fix; prune
+removes them too.`,
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		root := getRoot()
+		if validateFix {
+			lockRepo(root, repo.LOCK_EXCLUSIVE)
+		} else {
+			lockRepo(root, repo.LOCK_SHARED)
+		}
+
+		blobStore, snapshotStore := getStores(root)
+		defer blobStore.Close()
+		defer snapshotStore.Close()
+
+		opts := &validate.Options{
+			ReadData: validateReadData,
+			Snapshot: validateSnapshot,
+			Fix:      validateFix,
+		}
+		report, err := validate.Validate(snapshotStore, blobStore, opts)
+		if err != nil {
+			return err
+		}
+
+		c := color.New(color.FgRed)
+		for _, problem := range report.Problems {
+			c.Println(problem)
+		}
+
+		if report.Resumable > 0 {
+			fmt.Printf("%d files were stored by an interrupted create; create --resume continues it\n",
+				report.Resumable)
+		}
+
+		if report.Leftovers > 0 && validateFix {
+			fmt.Printf("Removed %d pack files (%s) left by interrupted runs\n",
+				report.Leftovers, humanize.Bytes(report.LeftoverBytes))
+		} else if report.Leftovers > 0 {
+			fmt.Printf("%d pack files (%s) were left by interrupted runs; validate --fix or prune removes them\n",
+				report.Leftovers, humanize.Bytes(report.LeftoverBytes))
+		}
+
+		fmt.Printf("Checked %d snapshots and %d blobs: %d missing, %d corrupt, %d orphaned\n",
+			report.Snapshots, report.Blobs, report.Missing, report.Corrupt, report.Orphaned)
+
+		if !report.Ok() {
+			return errors.New(fmt.Sprintf("Validation found %d problems", len(report.Problems)))
+		}
+		return nil
+	},
+}
@@ -0,0 +1,203 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package blob
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/andybug/abakus/pkg/chunker"
+	"github.com/andybug/abakus/pkg/filelist"
+	"github.com/golang/crypto/blake2b"
+)
+
+// addChunked splits the contents of the file at absPath, read from stream,
+// into content-defined chunks and stores each chunk that is not already in
+// the store. The chunk list is recorded in the result. A file that turns
+// out to be a single chunk is stored whole.
+func (store *Store) addChunked(absPath string, stream io.Reader) (*readResult, error) {
+	var chunks []filelist.Chunk
+	var size uint64 = 0
+	added := false
+	compression := ""
+	hasher, _ := blake2b.New256(nil)
+	c := chunker.New(stream)
+
+	for {
+		data, err := c.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		// the whole file is stored the same way, judged by its start
+		if compression == "" {
+			head := data
+			if len(head) > PROBE_SIZE {
+				head = head[:PROBE_SIZE]
+			}
+			compression = store.compressionFor(absPath, head)
+		}
+
+		hasher.Write(data)
+		size += uint64(len(data))
+		sum := blake2b.Sum256(data)
+		chunk := filelist.Chunk{Hash: sum[:], Size: uint64(len(data))}
+		chunks = append(chunks, chunk)
+
+		stored, err := store.put(chunk.Hash, data, compression)
+		if err != nil {
+			return nil, err
+		}
+		added = added || stored
+	}
+
+	// a single chunk has the same hash as the file, so it is already
+	// stored as a whole file blob
+	if len(chunks) < 2 {
+		chunks = nil
+	}
+
+	return &readResult{
+		hash:   hasher.Sum(nil),
+		size:   size,
+		chunks: chunks,
+		added:  added,
+	}, nil
+}
+
+// knownChunks maps the hashes of the chunked files in the file list to
+// their chunks
+func knownChunks(fl *filelist.FileList) map[string][]filelist.Chunk {
+	known := make(map[string][]filelist.Chunk)
+	if fl == nil {
+		return known
+	}
+
+	it := fl.Files.Iterator()
+	for it.Next() {
+		metadata := it.Value().(*filelist.FileMetadata)
+		if len(metadata.Chunks) > 0 {
+			known[string(metadata.Hash)] = metadata.Chunks
+		}
+	}
+
+	return known
+}
+
+// hasAll returns true if every chunk is in the store
+func (store *Store) hasAll(chunks []filelist.Chunk) bool {
+	for _, chunk := range chunks {
+		if !store.Has(chunk.Hash) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Open returns a reader for the contents of a file, reassembling them from
+// the file's chunks if it was chunked. The caller must close the reader.
+func (store *Store) Open(metadata *filelist.FileMetadata) (io.ReadCloser, error) {
+	if len(metadata.Chunks) == 0 {
+		return store.Get(metadata.Hash)
+	}
+
+	for _, chunk := range metadata.Chunks {
+		if !store.Has(chunk.Hash) {
+			return nil, errors.New(fmt.Sprintf("Blob %s not found", store.Name(chunk.Hash)))
+		}
+	}
+
+	return &chunkReader{store: store, chunks: metadata.Chunks}, nil
+}
+
+// VerifyFile reads the contents of a file, reassembling them from chunks,
+// and checks that they hash to the file's hash
+func (store *Store) VerifyFile(metadata *filelist.FileMetadata) error {
+	reader, err := store.Open(metadata)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	hasher, _ := blake2b.New256(nil)
+	if _, err = io.Copy(hasher, reader); err != nil {
+		return err
+	}
+
+	if !bytes.Equal(hasher.Sum(nil), metadata.Hash) {
+		return errors.New(fmt.Sprintf("Contents do not match hash %x", metadata.Hash))
+	}
+
+	return nil
+}
+
+// chunkReader reads the chunks of a file one after another
+type chunkReader struct {
+	store   *Store
+	chunks  []filelist.Chunk
+	current io.ReadCloser
+}
+
+// Read reads from the current chunk, opening the next one when it is done
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if cr.current == nil {
+			if len(cr.chunks) == 0 {
+				return 0, io.EOF
+			}
+
+			current, err := cr.store.Get(cr.chunks[0].Hash)
+			if err != nil {
+				return 0, err
+			}
+			cr.current = current
+			cr.chunks = cr.chunks[1:]
+		}
+
+		n, err := cr.current.Read(p)
+		if err == io.EOF {
+			cr.current.Close()
+			cr.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+
+		return n, err
+	}
+}
+
+// Close closes the chunk being read
+func (cr *chunkReader) Close() error {
+	if cr.current == nil {
+		return nil
+	}
+
+	err := cr.current.Close()
+	cr.current = nil
+	return err
+}
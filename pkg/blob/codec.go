@@ -0,0 +1,230 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package blob
+
+import (
+	"bufio"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/andybug/abakus/pkg/crypt"
+	"github.com/andybug/abakus/pkg/repo"
+	"github.com/klauspost/compress/zstd"
+)
+
+// COMPRESSION_LEVEL is the zlib level used for new blobs
+const COMPRESSION_LEVEL = 6
+
+// compressionHeaders are the bytes that start the compressed contents of a
+// blob and name the algorithm used, so that blobs written with different
+// algorithms can be read from the same repository
+var compressionHeaders = map[string]byte{
+	repo.COMPRESSION_NONE: 0x00,
+	repo.COMPRESSION_ZLIB: 0x01,
+	repo.COMPRESSION_ZSTD: 0x02,
+}
+
+// zlibMagic starts every zlib stream. Blobs from before the header existed
+// are bare zlib streams, which are recognised by it.
+const zlibMagic = 0x78
+
+// zstd coders are expensive to create, so they are reused
+var zstdEncoders = sync.Pool{
+	New: func() interface{} {
+		encoder, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		return encoder
+	},
+}
+
+var zstdDecoders = sync.Pool{
+	New: func() interface{} {
+		decoder, _ := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+		return decoder
+	},
+}
+
+// codec transforms blob contents into the bytes stored on disk and back.
+// The stored bytes are what gets copied verbatim to and from remotes.
+// Contents are compressed and then, if the repository has a key, encrypted.
+type codec struct {
+	key *crypt.MasterKey
+}
+
+// encoder returns a writer that compresses what is written to it with the
+// named algorithm and encodes it into w
+func (c *codec) encoder(w io.Writer, compression string) (io.WriteCloser, error) {
+	header, ok := compressionHeaders[compression]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Compression '%s' not supported", compression))
+	}
+
+	var closers []io.Closer
+	if c.key != nil {
+		encrypter, err := c.key.NewWriter(w)
+		if err != nil {
+			return nil, err
+		}
+		w = encrypter
+		closers = append(closers, encrypter)
+	}
+
+	if _, err := w.Write([]byte{header}); err != nil {
+		return nil, err
+	}
+
+	var compressor io.WriteCloser
+	switch compression {
+	case repo.COMPRESSION_ZLIB:
+		zw, err := zlib.NewWriterLevel(w, COMPRESSION_LEVEL)
+		if err != nil {
+			return nil, err
+		}
+		compressor = zw
+	case repo.COMPRESSION_ZSTD:
+		encoder := zstdEncoders.Get().(*zstd.Encoder)
+		encoder.Reset(w)
+		compressor = &zstdWriter{encoder}
+	default:
+		return &writeCloser{w, closers}, nil
+	}
+
+	return &writeCloser{compressor, append([]io.Closer{compressor}, closers...)}, nil
+}
+
+// decoder returns a reader that decodes the stored bytes read from r
+func (c *codec) decoder(r io.Reader) (io.ReadCloser, error) {
+	decoded, _, err := c.decode(r)
+	return decoded, err
+}
+
+// decode returns a reader that decodes the stored bytes read from r, and
+// the compression algorithm that the blob was stored with
+func (c *codec) decode(r io.Reader) (io.ReadCloser, string, error) {
+	if c.key != nil {
+		decrypter, err := c.key.NewReader(r)
+		if err != nil {
+			return nil, "", err
+		}
+		r = decrypter
+	}
+
+	buffered := bufio.NewReader(r)
+	peeked, err := buffered.Peek(1)
+	if err != nil {
+		return nil, "", err
+	}
+	header := peeked[0]
+
+	if header == zlibMagic {
+		decompressor, err := zlib.NewReader(buffered)
+		return decompressor, repo.COMPRESSION_ZLIB, err
+	}
+	buffered.Discard(1)
+
+	switch header {
+	case compressionHeaders[repo.COMPRESSION_NONE]:
+		return ioutil.NopCloser(buffered), repo.COMPRESSION_NONE, nil
+	case compressionHeaders[repo.COMPRESSION_ZLIB]:
+		decompressor, err := zlib.NewReader(buffered)
+		return decompressor, repo.COMPRESSION_ZLIB, err
+	case compressionHeaders[repo.COMPRESSION_ZSTD]:
+		decoder := zstdDecoders.Get().(*zstd.Decoder)
+		if err = decoder.Reset(buffered); err != nil {
+			zstdDecoders.Put(decoder)
+			return nil, "", err
+		}
+		return &zstdReader{decoder}, repo.COMPRESSION_ZSTD, nil
+	}
+
+	return nil, "", errors.New(fmt.Sprintf("Unknown compression %#x", header))
+}
+
+// zstdWriter returns its encoder to the pool once it is closed
+type zstdWriter struct {
+	*zstd.Encoder
+}
+
+// Close finishes the zstd stream
+func (zw *zstdWriter) Close() error {
+	if zw.Encoder == nil {
+		return nil
+	}
+
+	err := zw.Encoder.Close()
+	zstdEncoders.Put(zw.Encoder)
+	zw.Encoder = nil
+	return err
+}
+
+// zstdReader returns its decoder to the pool once it is closed
+type zstdReader struct {
+	*zstd.Decoder
+}
+
+// Close releases the decoder
+func (zr *zstdReader) Close() error {
+	if zr.Decoder != nil {
+		zstdDecoders.Put(zr.Decoder)
+		zr.Decoder = nil
+	}
+
+	return nil
+}
+
+// writeCloser closes each stage of an encoder in order, so buffered data
+// is flushed from one stage into the next
+type writeCloser struct {
+	io.Writer
+	closers []io.Closer
+}
+
+// Close closes every closer in order, stopping at the first error
+func (wc *writeCloser) Close() error {
+	for _, closer := range wc.closers {
+		if err := closer.Close(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readCloser closes both the decoded stream and the underlying file
+type readCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+// Close closes every closer, returning the first error
+func (rc *readCloser) Close() error {
+	var first error = nil
+	for _, closer := range rc.closers {
+		if err := closer.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+
+	return first
+}
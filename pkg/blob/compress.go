@@ -0,0 +1,182 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package blob
+
+import (
+	"io"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"strings"
+
+	"github.com/andybug/abakus/pkg/repo"
+)
+
+// PROBE_SIZE is how much of the start of a file is examined to decide
+// whether it is worth compressing
+const PROBE_SIZE = 64 * 1024
+
+// ENTROPY_THRESHOLD is the entropy, in bits per byte, above which data is
+// taken to be compressed already
+const ENTROPY_THRESHOLD = 7.5
+
+// compressedExtensions are the extensions of file formats that are already
+// compressed, which are stored without compressing them again
+var compressedExtensions = map[string]bool{
+	".7z": true, ".apk": true, ".avi": true, ".bz2": true, ".docx": true,
+	".flac": true, ".gif": true, ".gz": true, ".heic": true, ".jar": true,
+	".jpeg": true, ".jpg": true, ".lz4": true, ".m4a": true, ".m4v": true,
+	".mkv": true, ".mov": true, ".mp3": true, ".mp4": true, ".odt": true,
+	".ogg": true, ".opus": true, ".png": true, ".pptx": true, ".rar": true,
+	".tgz": true, ".webm": true, ".webp": true, ".xlsx": true, ".xz": true,
+	".zip": true, ".zst": true,
+}
+
+// compressionFor returns the algorithm to store a file with, given its path
+// and the first PROBE_SIZE bytes of its contents. Files that look like they
+// are already compressed are stored as they are.
+func (store *Store) compressionFor(path string, head []byte) string {
+	if store.compression == repo.COMPRESSION_NONE {
+		return repo.COMPRESSION_NONE
+	}
+
+	if compressedExtensions[strings.ToLower(filepath.Ext(path))] {
+		return repo.COMPRESSION_NONE
+	}
+
+	if entropy(head) > ENTROPY_THRESHOLD {
+		return repo.COMPRESSION_NONE
+	}
+
+	return store.compression
+}
+
+// entropy returns the Shannon entropy of the data in bits per byte
+func entropy(data []byte) float64 {
+	if len(data) == 0 {
+		return 0
+	}
+
+	var counts [256]int
+	for _, b := range data {
+		counts[b] += 1
+	}
+
+	total := float64(len(data))
+	bits := 0.0
+	for _, count := range counts {
+		if count == 0 {
+			continue
+		}
+		p := float64(count) / total
+		bits -= p * math.Log2(p)
+	}
+
+	return bits
+}
+
+// CompressionStats totals the blobs stored with one compression algorithm
+// Blobs - the number of blobs
+// Size - the length of their contents
+// Stored - the bytes they occupy in the repository
+type CompressionStats struct {
+	Blobs  uint64
+	Size   uint64
+	Stored uint64
+}
+
+// Ratio returns how many times smaller the blobs are in the repository
+func (s *CompressionStats) Ratio() float64 {
+	if s.Stored == 0 {
+		return 0
+	}
+
+	return float64(s.Size) / float64(s.Stored)
+}
+
+// Stats totals the blobs in the store by the compression algorithm they
+// were stored with. Blobs whose index entry does not record it, such as
+// those from before it was recorded or pulled from a remote, are read to
+// find out.
+func (store *Store) Stats() (map[string]*CompressionStats, error) {
+	stats := make(map[string]*CompressionStats)
+
+	for _, name := range store.Names() {
+		entry, err := store.entry(name)
+		if err != nil {
+			return stats, err
+		}
+
+		compression := ""
+		var size int64 = 0
+		if entry != nil && entry.Compression != "" {
+			compression = entry.Compression
+			size = entry.Size
+		} else if compression, size, err = store.measure(name); err != nil {
+			return stats, err
+		}
+
+		stored, err := store.Size(name)
+		if err != nil {
+			return stats, err
+		}
+
+		s := stats[compression]
+		if s == nil {
+			s = &CompressionStats{}
+			stats[compression] = s
+		}
+		s.Blobs += 1
+		s.Size += uint64(size)
+		s.Stored += stored
+	}
+
+	return stats, nil
+}
+
+// entry returns the index entry of the named blob, including blobs in the
+// unfinished pack, or nil for a loose blob
+func (store *Store) entry(name string) (*indexEntry, error) {
+	if entry := store.pending(name); entry != nil {
+		return entry, nil
+	}
+
+	return store.index.get(name)
+}
+
+// measure decodes the named blob and returns the algorithm it was
+// compressed with and the length of its contents
+func (store *Store) measure(name string) (string, int64, error) {
+	raw, err := store.GetRaw(name)
+	if err != nil {
+		return "", 0, err
+	}
+	defer raw.Close()
+
+	decoded, compression, err := store.codec.decode(raw)
+	if err != nil {
+		return "", 0, err
+	}
+	defer decoded.Close()
+
+	size, err := io.Copy(ioutil.Discard, decoded)
+	return compression, size, err
+}
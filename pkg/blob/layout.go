@@ -0,0 +1,149 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package blob
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/andybug/abakus/pkg/repo"
+	"github.com/peterbourgon/diskv"
+)
+
+// SHARD_WIDTH is the number of characters of a name in each fan-out
+// directory of the sharded layout
+const SHARD_WIDTH = 2
+
+// flatDirs puts every file directly in its directory
+func flatDirs(name string) []string {
+	return []string{}
+}
+
+// blobDirs fans loose blobs out two levels deep: ab/cd/abcdef...
+func blobDirs(name string) []string {
+	if len(name) < 2*SHARD_WIDTH {
+		return []string{}
+	}
+	return []string{name[:SHARD_WIDTH], name[SHARD_WIDTH : 2*SHARD_WIDTH]}
+}
+
+// packDirs fans pack files out one level deep: ab/abcdef...
+func packDirs(id string) []string {
+	if len(id) < SHARD_WIDTH {
+		return []string{}
+	}
+	return []string{id[:SHARD_WIDTH]}
+}
+
+// layoutPath returns the path of name under base with the given fan-out
+func layoutPath(base string, dirs func(string) []string, name string) string {
+	parts := append([]string{base}, dirs(name)...)
+	return filepath.Join(append(parts, name)...)
+}
+
+// newLooseHandle returns a diskv handle for loose blobs in one layout
+func newLooseHandle(blobsDir string, dirs func(string) []string) *diskv.Diskv {
+	return diskv.New(diskv.Options{
+		BasePath:     blobsDir,
+		Transform:    dirs,
+		CacheSizeMax: 1024 * 1024,
+	})
+}
+
+// packFile is a file found under the packs directory
+type packFile struct {
+	path string
+	size int64
+}
+
+// listPacks returns every file under the packs directory, in either layout,
+// by name
+func (store *Store) listPacks() (map[string]*packFile, error) {
+	files := make(map[string]*packFile)
+	err := filepath.Walk(store.packsDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if !info.IsDir() {
+			files[info.Name()] = &packFile{path: path, size: info.Size()}
+		}
+		return nil
+	})
+
+	return files, err
+}
+
+// Migrate moves the loose blobs and pack files of a FORMAT_FLAT repository
+// into the sharded layout. Every file is moved with a single rename, so an
+// interrupted migration leaves each file in one layout or the other, where
+// the store still finds it, and running Migrate again finishes the job.
+// Unfinished pack files are left for Repack to clean up. It returns the
+// number of loose blobs and pack files moved.
+func Migrate(root string) (uint64, uint64, error) {
+	blobs, err := migrateDir(repo.GetBlobsDir(root), blobDirs, func(string) bool { return true })
+	if err != nil {
+		return blobs, 0, err
+	}
+
+	packs, err := migrateDir(repo.GetPacksDir(root), packDirs, isPackName)
+	return blobs, packs, err
+}
+
+// migrateDir moves the files directly in dir that match into the fan-out
+// directories given by dirs
+func migrateDir(dir string, dirs func(string) []string, match func(string) bool) (uint64, error) {
+	var moved uint64 = 0
+
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return moved, nil
+	} else if err != nil {
+		return moved, err
+	}
+
+	var names []string
+	for _, file := range files {
+		if file.Mode().IsRegular() && match(file.Name()) {
+			names = append(names, file.Name())
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		path := layoutPath(dir, dirs, name)
+		if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return moved, err
+		}
+
+		if err = os.Rename(filepath.Join(dir, name), path); err != nil {
+			return moved, err
+		}
+		moved += 1
+	}
+
+	return moved, nil
+}
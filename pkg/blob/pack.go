@@ -0,0 +1,290 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package blob
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+// PACK_SIZE is the size at which a pack file is closed and a new one started
+const PACK_SIZE = 16 * 1024 * 1024
+
+// INDEX_BUCKET is the bucket in the index db that maps blob names to
+// index entries
+const INDEX_BUCKET = "blobs"
+
+// packMagic starts every pack file
+var packMagic = []byte("ABKPACK\x01")
+
+// packTmpPrefix is the prefix of pack files that are still being written
+const packTmpPrefix = ".tmp-"
+
+// indexEntry locates the stored bytes of a blob inside a pack file.
+// Compression and Size, the length of the contents before they were
+// encoded, are not known for blobs copied in from elsewhere.
+type indexEntry struct {
+	Pack        string `json:"pack"`
+	Offset      int64  `json:"offset"`
+	Length      int64  `json:"length"`
+	Compression string `json:"compression,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+}
+
+// packIndex maps blob names to index entries. Entries are only added once
+// the pack they point to is complete.
+type packIndex struct {
+	db *bolt.DB
+}
+
+// openIndex opens (creating if needed) the index db
+func openIndex(path string) (*packIndex, error) {
+	db, err := bolt.Open(path, 0644, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(INDEX_BUCKET))
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &packIndex{db: db}, nil
+}
+
+// get returns the entry for the named blob or nil if it is not in a pack
+func (idx *packIndex) get(name string) (*indexEntry, error) {
+	var entry *indexEntry
+
+	err := idx.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket([]byte(INDEX_BUCKET)).Get([]byte(name))
+		if value == nil {
+			return nil
+		}
+
+		entry = new(indexEntry)
+		return json.Unmarshal(value, entry)
+	})
+
+	return entry, err
+}
+
+// put adds or replaces the entries in a single transaction
+func (idx *packIndex) put(entries map[string]*indexEntry) error {
+	return idx.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(INDEX_BUCKET))
+		for name, entry := range entries {
+			value, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+
+			if err = bucket.Put([]byte(name), value); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// remove deletes the entry for the named blob
+func (idx *packIndex) remove(name string) error {
+	return idx.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(INDEX_BUCKET)).Delete([]byte(name))
+	})
+}
+
+// forEach calls fn with every entry in the index
+func (idx *packIndex) forEach(fn func(name string, entry *indexEntry) error) error {
+	return idx.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(INDEX_BUCKET)).ForEach(func(key []byte, value []byte) error {
+			entry := new(indexEntry)
+			if err := json.Unmarshal(value, entry); err != nil {
+				return err
+			}
+
+			return fn(string(key), entry)
+		})
+	})
+}
+
+// close closes the index db
+func (idx *packIndex) close() {
+	idx.db.Close()
+}
+
+// packWriter appends the stored bytes of blobs to a new pack file. The file
+// is written under a temporary name and renamed when it is finished, so a
+// pack file that is not temporary is always complete.
+type packWriter struct {
+	id      string
+	path    string
+	tmpPath string
+	file    *os.File
+	buf     *bufio.Writer
+	offset  int64
+	entries map[string]*indexEntry
+}
+
+// newPackWriter creates a new pack file with a random id at the path that
+// pathFor gives for the id
+func newPackWriter(pathFor func(id string) string) (*packWriter, error) {
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, err
+	}
+	id := hex.EncodeToString(idBytes)
+
+	path := pathFor(id)
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	pw := &packWriter{
+		id:      id,
+		path:    path,
+		tmpPath: filepath.Join(dir, packTmpPrefix+id),
+		entries: make(map[string]*indexEntry),
+	}
+
+	file, err := os.OpenFile(pw.tmpPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	pw.file = file
+	pw.buf = bufio.NewWriter(file)
+
+	if _, err = pw.buf.Write(packMagic); err != nil {
+		pw.abort()
+		return nil, err
+	}
+	pw.offset = int64(len(packMagic))
+
+	return pw, nil
+}
+
+// write appends the bytes that fn writes as the named blob. fn may fill in
+// what it knows about the contents in the new entry.
+func (pw *packWriter) write(name string, fn func(io.Writer, *indexEntry) error) error {
+	entry := &indexEntry{Pack: pw.id, Offset: pw.offset}
+	counter := &countingWriter{w: pw.buf}
+	if err := fn(counter, entry); err != nil {
+		return err
+	}
+
+	entry.Length = counter.n
+	pw.entries[name] = entry
+	pw.offset += counter.n
+
+	return nil
+}
+
+// open returns a reader for a blob in the unfinished pack
+func (pw *packWriter) open(entry *indexEntry) (io.ReadCloser, error) {
+	if err := pw.buf.Flush(); err != nil {
+		return nil, err
+	}
+
+	return openSection(pw.tmpPath, entry)
+}
+
+// finish syncs the pack file and gives it its final name
+func (pw *packWriter) finish() error {
+	if err := pw.buf.Flush(); err != nil {
+		pw.abort()
+		return err
+	}
+	if err := pw.file.Sync(); err != nil {
+		pw.abort()
+		return err
+	}
+	if err := pw.file.Close(); err != nil {
+		os.Remove(pw.tmpPath)
+		return err
+	}
+
+	if err := os.Rename(pw.tmpPath, pw.path); err != nil {
+		return err
+	}
+
+	return syncDir(filepath.Dir(pw.path))
+}
+
+// syncDir syncs a directory, so that a file renamed into it is still there
+// after a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// abort closes and removes the unfinished pack file
+func (pw *packWriter) abort() {
+	pw.file.Close()
+	os.Remove(pw.tmpPath)
+}
+
+// openSection returns a reader for the bytes of the entry in a pack file
+func openSection(path string, entry *indexEntry) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	section := io.NewSectionReader(file, entry.Offset, entry.Length)
+	return &readCloser{bufio.NewReader(section), []io.Closer{file}}, nil
+}
+
+// isPackName returns true if the file name is that of a finished pack
+func isPackName(name string) bool {
+	return len(name) == 32 && !strings.HasPrefix(name, packTmpPrefix)
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+// Write writes to the underlying writer and adds to the count
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,243 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package blob
+
+import (
+	"os"
+	"sort"
+	"strings"
+)
+
+// REPACK_SMALL_SIZE is the size below which packs are merged together when
+// there is more than one of them
+const REPACK_SMALL_SIZE = PACK_SIZE / 4
+
+// RepackResult counts what a repack did
+type RepackResult struct {
+	PacksRemoved uint64
+	PacksWritten uint64
+	BlobsMoved   uint64
+	LooseMoved   uint64
+	Reclaimed    uint64
+}
+
+// Repack rewrites the pack files in which less than minUsed (a fraction)
+// of the bytes belong to blobs in the index, merges small packs, deletes
+// packs with no blobs left, and moves loose blobs into packs. The index is
+// updated before any old file is deleted, so an interrupted repack loses
+// nothing and can be run again.
+func (store *Store) Repack(minUsed float64) (*RepackResult, error) {
+	result := &RepackResult{}
+	if err := store.Flush(); err != nil {
+		return result, err
+	}
+
+	// the blobs and live bytes in each pack
+	blobs := make(map[string][]string)
+	live := make(map[string]int64)
+	err := store.index.forEach(func(name string, entry *indexEntry) error {
+		blobs[entry.Pack] = append(blobs[entry.Pack], name)
+		live[entry.Pack] += entry.Length
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+
+	files, err := store.listPacks()
+	if err != nil {
+		return result, err
+	}
+
+	var ids []string
+	for id := range files {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var sparse []string
+	var small []string
+	for _, id := range ids {
+		file := files[id]
+
+		if isLeftover(id, live) {
+			if err = os.Remove(file.path); err != nil {
+				return result, err
+			}
+			if isPackName(id) {
+				result.PacksRemoved += 1
+			}
+			result.Reclaimed += uint64(file.size)
+			continue
+		}
+
+		if !isPackName(id) {
+			continue
+		}
+
+		if float64(live[id]) < minUsed*float64(file.size-int64(len(packMagic))) {
+			sparse = append(sparse, id)
+		} else if file.size < REPACK_SMALL_SIZE {
+			small = append(small, id)
+		}
+	}
+
+	if len(small) > 1 {
+		sparse = append(sparse, small...)
+	}
+
+	created := store.packsCreated
+	var written uint64 = 0
+
+	for _, id := range sparse {
+		for _, name := range blobs[id] {
+			n, err := store.copyRaw(name)
+			if err != nil {
+				return result, err
+			}
+
+			result.BlobsMoved += 1
+			written += n
+		}
+	}
+
+	var loose []string
+	for name := range store.handles[0].Keys(nil) {
+		loose = append(loose, name)
+	}
+
+	for _, name := range loose {
+		// already packed by an earlier, interrupted repack
+		if entry, err := store.index.get(name); err != nil {
+			return result, err
+		} else if entry != nil {
+			continue
+		}
+
+		if _, err := store.copyRaw(name); err != nil {
+			return result, err
+		}
+	}
+
+	if err = store.Flush(); err != nil {
+		return result, err
+	}
+	result.PacksWritten = store.packsCreated - created
+
+	// the index points at the new packs, so the old copies can go
+	for _, id := range sparse {
+		if err = os.Remove(files[id].path); err != nil {
+			return result, err
+		}
+		result.PacksRemoved += 1
+		result.Reclaimed += uint64(files[id].size)
+	}
+	if result.Reclaimed > written {
+		result.Reclaimed -= written
+	} else {
+		result.Reclaimed = 0
+	}
+
+	for _, name := range loose {
+		if err = store.eraseLoose(name); err != nil {
+			return result, err
+		}
+		result.LooseMoved += 1
+	}
+
+	return result, nil
+}
+
+// copyRaw copies the stored bytes of the named blob into the current pack
+// and returns how many bytes were copied
+func (store *Store) copyRaw(name string) (uint64, error) {
+	raw, err := store.GetRaw(name)
+	if err != nil {
+		return 0, err
+	}
+	defer raw.Close()
+
+	entry, err := store.index.get(name)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = store.putRaw(name, raw, entry); err != nil {
+		return 0, err
+	}
+
+	size, err := store.Size(name)
+	return size, err
+}
+
+// CleanLeftovers removes the pack files left behind by interrupted runs:
+// packs that were never finished, and packs with no blob in the index,
+// either because the run stopped before adding them or because every blob
+// in them was pruned. If referenced is not nil, blobs that are not in it
+// count as pruned already, so a dry run after a dry run of Sweep reports
+// what a real prune would remove. If dryRun is true nothing is removed. It
+// returns the number of files and bytes that were (or would be) removed.
+func (store *Store) CleanLeftovers(referenced map[string]bool, dryRun bool) (uint64, uint64, error) {
+	var count uint64 = 0
+	var reclaimed uint64 = 0
+
+	if err := store.Flush(); err != nil {
+		return count, reclaimed, err
+	}
+
+	live := make(map[string]int64)
+	err := store.index.forEach(func(name string, entry *indexEntry) error {
+		if referenced == nil || referenced[name] {
+			live[entry.Pack] += entry.Length
+		}
+		return nil
+	})
+	if err != nil {
+		return count, reclaimed, err
+	}
+
+	files, err := store.listPacks()
+	if err != nil {
+		return count, reclaimed, err
+	}
+
+	for id, file := range files {
+		if !isLeftover(id, live) {
+			continue
+		}
+
+		if !dryRun {
+			if err = os.Remove(file.path); err != nil {
+				return count, reclaimed, err
+			}
+		}
+		count += 1
+		reclaimed += uint64(file.size)
+	}
+
+	return count, reclaimed, nil
+}
+
+// isLeftover returns true if the named file in the packs directory is left
+// over from an interrupted write, or is a pack that nothing in the index uses
+func isLeftover(name string, live map[string]int64) bool {
+	return strings.HasPrefix(name, packTmpPrefix) || (isPackName(name) && live[name] == 0)
+}
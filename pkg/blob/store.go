@@ -21,72 +21,779 @@
 package blob
 
 import (
-	"bufio"
+	"bytes"
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/andybug/abakus/pkg/chunker"
+	"github.com/andybug/abakus/pkg/crypt"
 	"github.com/andybug/abakus/pkg/filelist"
 	"github.com/andybug/abakus/pkg/repo"
+	"github.com/golang/crypto/blake2b"
 	"github.com/peterbourgon/diskv"
 )
 
-// Store wraps the diskv handle
+// Store keeps blobs in pack files, with an index of where each blob is.
+// Blobs are encoded by the store's codec before they are written, so the
+// packs only ever hold the stored bytes. Blobs from before pack files
+// existed are loose files read through the diskv handles.
+// Files are laid out as the repository format says, but both layouts are
+// read so that a repository part way through Migrate still works.
+// If key is set, blobs are encrypted and named by keyed hashes.
 type Store struct {
 	root     string
 	blobsDir string
-	handle   *diskv.Diskv
+	packsDir string
+	sharded  bool
+	// handles for loose blobs; the one for the store's layout is first
+	handles []*diskv.Diskv
+	index   *packIndex
+	// mu guards pack, which several goroutines may add blobs to
+	mu    sync.Mutex
+	pack  *packWriter
+	codec *codec
+	// compression is the algorithm for new blobs, unless a file looks
+	// like it is already compressed
+	compression string
+	// packsCreated counts the pack files started by this store
+	packsCreated uint64
+	key          *crypt.MasterKey
 }
 
-// GetStore returns a blob store object
-func GetStore(root string) (*Store, error) {
+// GetStore returns a blob store object. key is nil for an unencrypted
+// repository. The store must be closed to finish the last pack file.
+func GetStore(root string, key *crypt.MasterKey) (*Store, error) {
+	config, err := repo.ReadConfig(root)
+	if err != nil {
+		return nil, err
+	}
+
+	sharded := config.Format >= repo.FORMAT_SHARDED
 	blobsDir := repo.GetBlobsDir(root)
-	handle := diskv.New(diskv.Options{
-		BasePath:     blobsDir,
-		Transform:    func(s string) []string { return []string{} },
-		CacheSizeMax: 1024 * 1024,
-		Compression:  diskv.NewZlibCompressionLevel(6),
-	})
+	handles := []*diskv.Diskv{
+		newLooseHandle(blobsDir, blobDirs),
+		newLooseHandle(blobsDir, flatDirs),
+	}
+	if !sharded {
+		handles[0], handles[1] = handles[1], handles[0]
+	}
+
+	index, err := openIndex(repo.GetIndexDbPath(root))
+	if err != nil {
+		return nil, err
+	}
 
 	store := Store{
-		root:     root,
-		blobsDir: blobsDir,
-		handle:   handle,
+		root:        root,
+		blobsDir:    blobsDir,
+		packsDir:    repo.GetPacksDir(root),
+		sharded:     sharded,
+		handles:     handles,
+		index:       index,
+		codec:       &codec{key: key},
+		compression: config.Compression,
+		key:         key,
 	}
 
 	return &store, nil
 }
 
+// Flush finishes the current pack file and adds its blobs to the index.
+// Blobs written since the last flush are lost if the process exits before
+// this, so it must be called before a snapshot refers to them.
+func (store *Store) Flush() error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	return store.flush()
+}
+
+// flush is Flush with the lock held
+func (store *Store) flush() error {
+	if store.pack == nil {
+		return nil
+	}
+
+	pw := store.pack
+	store.pack = nil
+	if err := pw.finish(); err != nil {
+		return err
+	}
+
+	return store.index.put(pw.entries)
+}
+
+// Close flushes the current pack file and closes the index
+func (store *Store) Close() error {
+	err := store.Flush()
+	store.index.close()
+	return err
+}
+
+// CHECKPOINT_INTERVAL is how often AddFiles reports the files it has stored
+const CHECKPOINT_INTERVAL = 30 * time.Second
+
+// policies for a file that changes while AddFiles reads it
+// ON_CHANGE_RETRY - read it again, up to ON_CHANGE_RETRIES times, then warn
+// ON_CHANGE_WARN - keep what was read and report the file as unstable
+// ON_CHANGE_FAIL - stop adding files with an error
+const (
+	ON_CHANGE_RETRY = "retry"
+	ON_CHANGE_WARN  = "warn"
+	ON_CHANGE_FAIL  = "fail"
+)
+
+// ON_CHANGE_RETRIES is how many more times ON_CHANGE_RETRY reads a file
+const ON_CHANGE_RETRIES = 3
+
+// IsOnChange returns true if policy is one of the ON_CHANGE_* policies
+func IsOnChange(policy string) bool {
+	switch policy {
+	case ON_CHANGE_RETRY, ON_CHANGE_WARN, ON_CHANGE_FAIL:
+		return true
+	}
+	return false
+}
+
+// AddOptions are the settings for AddFiles
+// Jobs - how many files are read and encoded at once
+// OnChange - one of the ON_CHANGE_* policies; empty means ON_CHANGE_RETRY
+// Checkpoint - if not nil, called about every CHECKPOINT_INTERVAL, and once
+// more if adding fails, with the files stored since the last call, after
+// their blobs have been flushed to the index. A later run can reuse their
+// metadata instead of reading them again.
+type AddOptions struct {
+	Jobs       int
+	OnChange   string
+	Checkpoint func(*filelist.FileList) error
+}
+
+// AddResult is the outcome of AddFiles
+// New - the number of files that added a blob to the store
+// Existing - the number of files that were already present
+// Unstable - the files that changed while they were read, sorted by path
+type AddResult struct {
+	New      uint64
+	Existing uint64
+	Unstable []string
+}
+
 // AddFiles will check each file in the file list to ensure that it is
-// in the blob store; if not, it will be added. returns the number of
-// files added to the store and the number that were already present
-func (store *Store) AddFiles(fl *filelist.FileList) (uint64, uint64, error) {
-	var newFiles uint64 = 0
-	var existingFiles uint64 = 0
-
-	it := fl.Files.Iterator()
-	for it.Next() {
-		metadata := it.Value().(*filelist.FileMetadata)
-		hashString := hex.EncodeToString(metadata.Hash)
-		if store.handle.Has(hashString) {
-			existingFiles += 1
-			continue
+// in the blob store; if not, it will be added. Files are hashed as they are
+// stored, so each file is only read once, and the contents that were read
+// are compared with the scanned metadata (and the hash, if it was known) to
+// find files that changed in the meantime; opts.OnChange decides what to do
+// with them. Files that are at least chunker.MIN_SIZE when they are read
+// are split into chunks that are stored separately, and their metadata
+// records the chunks. previous is the file list of an earlier snapshot (or
+// nil) whose chunk lists are reused for unchanged files. Only each file's
+// own metadata is changed, so the file list comes out the same whatever
+// opts.Jobs is. Only the first file of a hard link group is read; the
+// others share its contents afterwards.
+func (store *Store) AddFiles(fl *filelist.FileList, previous *filelist.FileList, opts *AddOptions) (*AddResult, error) {
+	result := &AddResult{}
+	var mu sync.Mutex
+
+	known := knownChunks(previous)
+	cp := &checkpointer{store: store, fn: opts.Checkpoint, done: filelist.New(), last: time.Now()}
+
+	err := fl.ForEach(opts.Jobs, func(relPath string, metadata *filelist.FileMetadata) error {
+		if metadata.LinkedTo(relPath) != "" {
+			return nil
 		}
 
-		absPath := filepath.Join(store.root, it.Key().(string))
-		stream, err := os.Open(absPath)
+		added, unstable, err := store.addFile(filepath.Join(store.root, relPath), metadata, known, opts.OnChange)
 		if err != nil {
-			return newFiles, existingFiles, err
+			return err
+		}
+
+		if added {
+			atomic.AddUint64(&result.New, 1)
+		} else {
+			atomic.AddUint64(&result.Existing, 1)
+		}
+		if unstable {
+			mu.Lock()
+			result.Unstable = append(result.Unstable, relPath)
+			mu.Unlock()
+		}
+		return cp.add(relPath, metadata, false)
+	})
+
+	// keep what was done before the failure
+	if err != nil {
+		if cpErr := cp.add("", nil, true); cpErr != nil {
+			err = errors.New(fmt.Sprintf("%s; the checkpoint for --resume could not be saved either: %s", err, cpErr))
+		}
+	} else {
+		fl.ShareLinks()
+	}
+
+	sort.Strings(result.Unstable)
+	return result, err
+}
+
+// checkpointer collects the files that AddFiles has stored and passes them
+// to fn once their blobs are flushed
+type checkpointer struct {
+	store *Store
+	fn    func(*filelist.FileList) error
+	mu    sync.Mutex
+	done  *filelist.FileList
+	last  time.Time
+}
+
+// add records a stored file (if metadata is not nil) and calls fn if it is
+// time to, or if force is true
+func (cp *checkpointer) add(relPath string, metadata *filelist.FileMetadata, force bool) error {
+	if cp.fn == nil {
+		return nil
+	}
+
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	if metadata != nil {
+		cp.done.Add(relPath, metadata)
+	}
+	if cp.done.Files.Empty() || (!force && time.Since(cp.last) < CHECKPOINT_INTERVAL) {
+		return nil
+	}
+
+	// every blob of the files so far has been written, so once they are
+	// flushed the files are safe to record
+	if err := cp.store.Flush(); err != nil {
+		return err
+	}
+	if err := cp.fn(cp.done); err != nil {
+		return err
+	}
+
+	cp.done = filelist.New()
+	cp.last = time.Now()
+	return nil
+}
+
+// readResult describes the contents of a file that were read and stored
+// hash - the hash of the contents
+// size - the number of bytes read
+// chunks - the chunks of the contents, if there is more than one
+// added - true if any blob was added
+// info - the file's stat after it was read
+// changed - true if the file's stat changed while it was read
+type readResult struct {
+	hash    []byte
+	size    uint64
+	chunks  []filelist.Chunk
+	added   bool
+	info    os.FileInfo
+	changed bool
+}
+
+// addFile stores the file unless it is already in the store. It returns
+// true if any blob was added, and true if the file changed while it was
+// read and onChange let it be stored anyway.
+func (store *Store) addFile(absPath string, metadata *filelist.FileMetadata, known map[string][]filelist.Chunk, onChange string) (bool, bool, error) {
+	// only regular files have contents to store
+	if !metadata.IsRegular() {
+		return false, false, nil
+	}
+
+	if metadata.Hash != nil {
+		if chunks := known[string(metadata.Hash)]; chunks != nil && store.hasAll(chunks) {
+			metadata.Chunks = chunks
+			return false, false, nil
+		}
+
+		if store.Has(metadata.Hash) {
+			return false, false, nil
 		}
+	}
 
-		reader := bufio.NewReader(stream)
-		err = store.handle.WriteStream(hashString, reader, true)
+	var result *readResult
+	var err error
+	added := false
+	unstable := false
+	for attempt := 0; ; attempt++ {
+		result, err = store.addContents(absPath)
 		if err != nil {
-			return newFiles, existingFiles, err
+			return added, false, err
+		}
+		added = added || result.added
+
+		if !result.differsFrom(metadata) {
+			break
+		}
+
+		if onChange == ON_CHANGE_FAIL {
+			return added, false, errors.New(fmt.Sprintf("%s changed while it was being added", absPath))
+		}
+		if onChange == ON_CHANGE_WARN || attempt == ON_CHANGE_RETRIES {
+			unstable = true
+			break
+		}
+
+		// the next read has to agree with this one
+		metadata.Hash = nil
+		metadata.Size = result.size
+		metadata.SetMTime(result.info.ModTime())
+	}
+
+	// the metadata describes what was stored, which is what a changed
+	// file looked like when it was last read
+	metadata.Hash = result.hash
+	metadata.Size = result.size
+	metadata.SetMTime(result.info.ModTime())
+	metadata.Chunks = result.chunks
+
+	return added, unstable, nil
+}
+
+// addContents reads the file and stores it whole if it is smaller than
+// chunker.MIN_SIZE, or in chunks if not. The choice is made from what is
+// read rather than the scanned size, so a file that grew since the scan is
+// never read into memory whole.
+func (store *Store) addContents(absPath string) (*readResult, error) {
+	file, err := os.Open(absPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	before, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(file, chunker.MIN_SIZE))
+	if err != nil {
+		return nil, err
+	}
+
+	var result *readResult
+	if len(data) < chunker.MIN_SIZE {
+		result, err = store.addWhole(absPath, data)
+	} else {
+		result, err = store.addChunked(absPath, io.MultiReader(bytes.NewReader(data), file))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	after, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	result.info = after
+	result.changed = changedWhileRead(before, after, result.size)
+	return result, nil
+}
+
+// addWhole stores the contents of a file smaller than chunker.MIN_SIZE as
+// a single blob named by its hash
+func (store *Store) addWhole(absPath string, data []byte) (*readResult, error) {
+	head := data
+	if len(head) > PROBE_SIZE {
+		head = head[:PROBE_SIZE]
+	}
+
+	sum := blake2b.Sum256(data)
+	added, err := store.put(sum[:], data, store.compressionFor(absPath, head))
+	if err != nil {
+		return nil, err
+	}
+
+	return &readResult{
+		hash:  sum[:],
+		size:  uint64(len(data)),
+		added: added,
+	}, nil
+}
+
+// changedWhileRead returns true if the stat of a file from before it was
+// read does not match the stat from after, or the number of bytes read
+func changedWhileRead(before os.FileInfo, after os.FileInfo, size uint64) bool {
+	return before.Size() != after.Size() ||
+		!before.ModTime().Equal(after.ModTime()) ||
+		uint64(after.Size()) != size
+}
+
+// differsFrom returns true if the file changed while it was read, or what
+// was read does not match the metadata from the scan: its size, its
+// modification time and, if the scan knew it, its hash
+func (result *readResult) differsFrom(metadata *filelist.FileMetadata) bool {
+	return result.changed ||
+		result.size != metadata.Size ||
+		!result.info.ModTime().Equal(metadata.MTime()) ||
+		(metadata.Hash != nil && !bytes.Equal(result.hash, metadata.Hash))
+}
+
+// Name returns the key that the blob with the given hash is stored under.
+// In an encrypted repository this is a keyed hash so that storage does not
+// reveal the content hashes.
+func (store *Store) Name(hash []byte) string {
+	if store.key != nil {
+		return store.key.Name(hash)
+	}
+
+	return hex.EncodeToString(hash)
+}
+
+// Has returns true if the blob with the given hash is in the store
+func (store *Store) Has(hash []byte) bool {
+	return store.hasName(store.Name(hash))
+}
+
+// hasName returns true if the named blob is in the store
+func (store *Store) hasName(name string) bool {
+	if store.pending(name) != nil {
+		return true
+	}
+
+	if entry, err := store.index.get(name); err == nil && entry != nil {
+		return true
+	}
+
+	return store.looseHandle(name) != nil
+}
+
+// pending returns the entry of the named blob if it is in the unfinished
+// pack, or nil
+func (store *Store) pending(name string) *indexEntry {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if store.pack == nil {
+		return nil
+	}
+	return store.pack.entries[name]
+}
+
+// looseHandle returns the handle for the layout that holds the named loose
+// blob, or nil if there is no such loose blob
+func (store *Store) looseHandle(name string) *diskv.Diskv {
+	for _, handle := range store.handles {
+		if handle.Has(name) {
+			return handle
 		}
-		newFiles += 1
-		stream.Close()
 	}
 
-	return newFiles, existingFiles, nil
+	return nil
+}
+
+// Get returns a reader for the (decompressed) contents of the blob with
+// the given hash. The caller must close the reader.
+func (store *Store) Get(hash []byte) (io.ReadCloser, error) {
+	raw, err := store.GetRaw(store.Name(hash))
+	if err != nil {
+		return nil, err
+	}
+
+	decoded, err := store.codec.decoder(raw)
+	if err != nil {
+		raw.Close()
+		return nil, err
+	}
+
+	return &readCloser{decoded, []io.Closer{decoded, raw}}, nil
+}
+
+// GetRaw returns a reader for the stored (encoded) bytes of the named blob
+func (store *Store) GetRaw(name string) (io.ReadCloser, error) {
+	store.mu.Lock()
+	if store.pack != nil {
+		if entry := store.pack.entries[name]; entry != nil {
+			defer store.mu.Unlock()
+			return store.pack.open(entry)
+		}
+	}
+	store.mu.Unlock()
+
+	entry, err := store.index.get(name)
+	if err != nil {
+		return nil, err
+	}
+	if entry != nil {
+		return openSection(store.packPath(entry.Pack), entry)
+	}
+
+	handle := store.looseHandle(name)
+	if handle == nil {
+		return nil, errors.New(fmt.Sprintf("Blob %s not found", name))
+	}
+
+	return handle.ReadStream(name, true)
+}
+
+// PutRaw stores already encoded bytes, such as those from GetRaw, as the
+// named blob
+func (store *Store) PutRaw(name string, r io.Reader) error {
+	return store.putRaw(name, r, nil)
+}
+
+// putRaw stores already encoded bytes as the named blob, keeping what the
+// index entry from (if any) knew about the contents
+func (store *Store) putRaw(name string, r io.Reader, from *indexEntry) error {
+	return store.writePacked(name, func(w io.Writer, entry *indexEntry) error {
+		if from != nil {
+			entry.Compression = from.Compression
+			entry.Size = from.Size
+		}
+
+		_, err := io.Copy(w, r)
+		return err
+	})
+}
+
+// put stores data as the blob with the given hash unless it is already in
+// the store, and returns true if it was added
+func (store *Store) put(hash []byte, data []byte, compression string) (bool, error) {
+	name := store.Name(hash)
+	if store.hasName(name) {
+		return false, nil
+	}
+
+	return store.write(name, bytes.NewReader(data), compression)
+}
+
+// write encodes the contents of the reader with the named compression
+// algorithm and stores them as the named blob, unless another goroutine got
+// there first. It returns true if the blob was added. The contents are
+// encoded before the store is locked, so that goroutines can encode at the
+// same time.
+func (store *Store) write(name string, r io.Reader, compression string) (bool, error) {
+	var encoded bytes.Buffer
+	encoder, err := store.codec.encoder(&encoded, compression)
+	if err != nil {
+		return false, err
+	}
+
+	size, err := io.Copy(encoder, r)
+	if err != nil {
+		return false, err
+	}
+	if err = encoder.Close(); err != nil {
+		return false, err
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if store.pack != nil && store.pack.entries[name] != nil {
+		return false, nil
+	}
+	if entry, err := store.index.get(name); err != nil || entry != nil {
+		return false, err
+	}
+
+	err = store.writePackedLocked(name, func(w io.Writer, entry *indexEntry) error {
+		entry.Compression = compression
+		entry.Size = size
+		_, err := encoded.WriteTo(w)
+		return err
+	})
+
+	return err == nil, err
+}
+
+// writePacked appends a blob to the current pack file, starting a new one
+// if needed, and flushes the pack once it is full. If the write fails the
+// whole unfinished pack is discarded.
+func (store *Store) writePacked(name string, fn func(io.Writer, *indexEntry) error) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	return store.writePackedLocked(name, fn)
+}
+
+// writePackedLocked is writePacked with the lock held
+func (store *Store) writePackedLocked(name string, fn func(io.Writer, *indexEntry) error) error {
+	if store.pack == nil {
+		pw, err := newPackWriter(func(id string) string {
+			return store.packPathIn(id, store.sharded)
+		})
+		if err != nil {
+			return err
+		}
+		store.pack = pw
+		store.packsCreated += 1
+	}
+
+	if err := store.pack.write(name, fn); err != nil {
+		store.pack.abort()
+		store.pack = nil
+		return err
+	}
+
+	if store.pack.offset >= PACK_SIZE {
+		return store.flush()
+	}
+
+	return nil
+}
+
+// packPath returns the path of the pack file with the given id, in the
+// store's layout unless it is only found in the other one
+func (store *Store) packPath(id string) string {
+	path := store.packPathIn(id, store.sharded)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		other := store.packPathIn(id, !store.sharded)
+		if _, err = os.Stat(other); err == nil {
+			return other
+		}
+	}
+
+	return path
+}
+
+// packPathIn returns the path of the pack file in the given layout
+func (store *Store) packPathIn(id string, sharded bool) string {
+	if sharded {
+		return layoutPath(store.packsDir, packDirs, id)
+	}
+	return layoutPath(store.packsDir, flatDirs, id)
+}
+
+// Names returns the names of every blob in the store
+func (store *Store) Names() []string {
+	var names []string
+	store.mu.Lock()
+	if store.pack != nil {
+		for name := range store.pack.entries {
+			names = append(names, name)
+		}
+	}
+	store.mu.Unlock()
+
+	store.index.forEach(func(name string, entry *indexEntry) error {
+		names = append(names, name)
+		return nil
+	})
+
+	// the walk finds loose blobs in either layout
+	for name := range store.handles[0].Keys(nil) {
+		names = append(names, name)
+	}
+
+	return names
+}
+
+// Size returns the number of bytes the named blob occupies on disk
+func (store *Store) Size(name string) (uint64, error) {
+	if entry := store.pending(name); entry != nil {
+		return uint64(entry.Length), nil
+	}
+
+	entry, err := store.index.get(name)
+	if err != nil {
+		return 0, err
+	}
+	if entry != nil {
+		return uint64(entry.Length), nil
+	}
+
+	handle := store.looseHandle(name)
+	if handle == nil {
+		return 0, errors.New(fmt.Sprintf("Blob %s not found", name))
+	}
+
+	info, err := os.Stat(layoutPath(store.blobsDir, handle.Transform, name))
+	if err != nil {
+		return 0, err
+	}
+
+	return uint64(info.Size()), nil
+}
+
+// Remove deletes the named blob from the store. A blob in a pack file is
+// removed from the index; its space is reclaimed by Repack.
+func (store *Store) Remove(name string) error {
+	store.mu.Lock()
+	if store.pack != nil && store.pack.entries[name] != nil {
+		delete(store.pack.entries, name)
+		store.mu.Unlock()
+		return nil
+	}
+	store.mu.Unlock()
+
+	entry, err := store.index.get(name)
+	if err != nil {
+		return err
+	}
+	if entry != nil {
+		return store.index.remove(name)
+	}
+
+	return store.eraseLoose(name)
+}
+
+// eraseLoose removes the named loose blob from whichever layout holds it
+func (store *Store) eraseLoose(name string) error {
+	handle := store.looseHandle(name)
+	if handle == nil {
+		return errors.New(fmt.Sprintf("Blob %s not found", name))
+	}
+
+	return handle.Erase(name)
+}
+
+// Sweep removes every blob whose name is not in the referenced set. If
+// dryRun is true nothing is removed. It returns the number of blobs and
+// bytes that were (or would be) reclaimed.
+func (store *Store) Sweep(referenced map[string]bool, dryRun bool) (uint64, uint64, error) {
+	var count uint64 = 0
+	var reclaimed uint64 = 0
+
+	for _, name := range store.Names() {
+		if referenced[name] {
+			continue
+		}
+
+		size, err := store.Size(name)
+		if err != nil {
+			return count, reclaimed, err
+		}
+
+		if !dryRun {
+			if err = store.Remove(name); err != nil {
+				return count, reclaimed, err
+			}
+		}
+
+		count += 1
+		reclaimed += size
+	}
+
+	return count, reclaimed, nil
+}
+
+// Verify reads the blob with the given hash, decompressing it, and checks
+// that its contents still hash to the same value
+func (store *Store) Verify(hash []byte) error {
+	reader, err := store.Get(hash)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	hasher, _ := blake2b.New256(nil)
+	if _, err = io.Copy(hasher, reader); err != nil {
+		return err
+	}
+
+	if !bytes.Equal(hasher.Sum(nil), hash) {
+		return errors.New(fmt.Sprintf("Blob %s does not match its hash", store.Name(hash)))
+	}
+
+	return nil
 }
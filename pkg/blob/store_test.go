@@ -0,0 +1,468 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package blob
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/andybug/abakus/pkg/filelist"
+	"github.com/andybug/abakus/pkg/repo"
+	"github.com/golang/crypto/blake2b"
+	"github.com/stretchr/testify/assert"
+)
+
+// putBlob writes contents to the store and returns its hash
+func putBlob(t *testing.T, store *Store, contents string) []byte {
+	hash := blake2b.Sum256([]byte(contents))
+	_, err := store.write(store.Name(hash[:]), bytes.NewReader([]byte(contents)), store.compression)
+	assert.Nil(t, err)
+	return hash[:]
+}
+
+// getBlob reads the contents of the blob with the hash
+func getBlob(t *testing.T, store *Store, hash []byte) string {
+	reader, err := store.Get(hash)
+	assert.Nil(t, err)
+	defer reader.Close()
+
+	contents, err := ioutil.ReadAll(reader)
+	assert.Nil(t, err)
+	return string(contents)
+}
+
+// putLoose writes contents as a loose blob in the flat layout, as versions
+// from before pack files did, and returns its hash
+func putLoose(t *testing.T, store *Store, root string, contents string) []byte {
+	hash := blake2b.Sum256([]byte(contents))
+	var encoded bytes.Buffer
+	encoder := zlib.NewWriter(&encoded)
+	encoder.Write([]byte(contents))
+	encoder.Close()
+
+	path := filepath.Join(repo.GetBlobsDir(root), store.Name(hash[:]))
+	assert.Nil(t, ioutil.WriteFile(path, encoded.Bytes(), 0644))
+	return hash[:]
+}
+
+func packFiles(t *testing.T, root string) []string {
+	var names []string
+	filepath.Walk(repo.GetPacksDir(root), func(path string, info os.FileInfo, err error) error {
+		assert.Nil(t, err)
+		if !info.IsDir() {
+			names = append(names, path)
+		}
+		return nil
+	})
+	return names
+}
+
+func TestPackStore(t *testing.T) {
+	root, _ := ioutil.TempDir("", "TestPackStore")
+	defer os.RemoveAll(root)
+	repo.Create(root)
+
+	store, err := GetStore(root, nil)
+	assert.Nil(t, err)
+
+	a := putBlob(t, store, "a")
+	b := putBlob(t, store, "b")
+
+	// blobs in the unfinished pack can be read
+	assert.True(t, store.Has(a))
+	assert.Equal(t, "a", getBlob(t, store, a))
+
+	assert.Nil(t, store.Close())
+	assert.Len(t, packFiles(t, root), 1)
+
+	store, err = GetStore(root, nil)
+	assert.Nil(t, err)
+	defer store.Close()
+
+	assert.Equal(t, "a", getBlob(t, store, a))
+	assert.Equal(t, "b", getBlob(t, store, b))
+	assert.Nil(t, store.Verify(b))
+	assert.Len(t, store.Names(), 2)
+
+	assert.Nil(t, store.Remove(store.Name(a)))
+	assert.False(t, store.Has(a))
+}
+
+func TestSweep(t *testing.T) {
+	root, _ := ioutil.TempDir("", "TestSweep")
+	defer os.RemoveAll(root)
+	repo.Create(root)
+
+	store, err := GetStore(root, nil)
+	assert.Nil(t, err)
+	defer store.Close()
+
+	// unreferenced blobs in each place a blob can be
+	kept := putBlob(t, store, "kept")
+	indexed := putBlob(t, store, "indexed")
+	assert.Nil(t, store.Flush())
+	pending := putBlob(t, store, "pending")
+	loose := putLoose(t, store, root, "loose")
+
+	var size uint64 = 0
+	for _, hash := range [][]byte{indexed, pending, loose} {
+		blobSize, err := store.Size(store.Name(hash))
+		assert.Nil(t, err)
+		size += blobSize
+	}
+
+	referenced := map[string]bool{store.Name(kept): true}
+
+	count, reclaimed, err := store.Sweep(referenced, true)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3), count)
+	assert.Equal(t, size, reclaimed)
+	assert.Len(t, store.Names(), 4)
+
+	// the packs that only held unreferenced blobs are left over afterwards
+	packs, packBytes, err := store.CleanLeftovers(referenced, true)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), packs)
+
+	// the real run removes what the dry run reported
+	count, reclaimed, err = store.Sweep(referenced, false)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3), count)
+	assert.Equal(t, size, reclaimed)
+	assert.Equal(t, []string{store.Name(kept)}, store.Names())
+	assert.False(t, store.Has(indexed))
+	assert.False(t, store.Has(pending))
+	assert.False(t, store.Has(loose))
+	assert.Equal(t, "kept", getBlob(t, store, kept))
+
+	count, reclaimed, err = store.CleanLeftovers(referenced, false)
+	assert.Nil(t, err)
+	assert.Equal(t, packs, count)
+	assert.Equal(t, packBytes, reclaimed)
+	assert.Equal(t, "kept", getBlob(t, store, kept))
+
+	count, reclaimed, err = store.Sweep(referenced, false)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), count)
+	assert.Equal(t, uint64(0), reclaimed)
+}
+
+func TestRepack(t *testing.T) {
+	root, _ := ioutil.TempDir("", "TestRepack")
+	defer os.RemoveAll(root)
+	repo.Create(root)
+
+	store, err := GetStore(root, nil)
+	assert.Nil(t, err)
+	defer store.Close()
+
+	loose := putLoose(t, store, root, "loose")
+
+	a := putBlob(t, store, "a")
+	assert.Nil(t, store.Flush())
+	b := putBlob(t, store, "b")
+	assert.Nil(t, store.Flush())
+	unused := putBlob(t, store, "unused")
+	assert.Nil(t, store.Flush())
+	assert.Len(t, packFiles(t, root), 3)
+
+	assert.Nil(t, store.Remove(store.Name(unused)))
+
+	result, err := store.Repack(0.8)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3), result.PacksRemoved)
+	assert.Equal(t, uint64(1), result.PacksWritten)
+	assert.Equal(t, uint64(2), result.BlobsMoved)
+	assert.Equal(t, uint64(1), result.LooseMoved)
+
+	assert.Len(t, packFiles(t, root), 1)
+	assert.Equal(t, "a", getBlob(t, store, a))
+	assert.Equal(t, "b", getBlob(t, store, b))
+	assert.Equal(t, "loose", getBlob(t, store, loose))
+	assert.Len(t, store.Names(), 3)
+}
+
+func TestMigrate(t *testing.T) {
+	root, _ := ioutil.TempDir("", "TestMigrate")
+	defer os.RemoveAll(root)
+	repo.Create(root)
+
+	config, _ := repo.ReadConfig(root)
+	config.Format = repo.FORMAT_FLAT
+	repo.WriteConfig(root, config)
+
+	store, err := GetStore(root, nil)
+	assert.Nil(t, err)
+	a := putBlob(t, store, "a")
+	loose := putLoose(t, store, root, "loose")
+	assert.Nil(t, store.Close())
+
+	packs := packFiles(t, root)
+	assert.Len(t, packs, 1)
+	assert.Equal(t, repo.GetPacksDir(root), filepath.Dir(packs[0]))
+
+	blobs, moved, err := Migrate(root)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), blobs)
+	assert.Equal(t, uint64(1), moved)
+
+	// readable before the format is changed
+	store, err = GetStore(root, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "a", getBlob(t, store, a))
+	assert.Nil(t, store.Close())
+
+	config.Format = repo.FORMAT_SHARDED
+	repo.WriteConfig(root, config)
+
+	store, err = GetStore(root, nil)
+	assert.Nil(t, err)
+	defer store.Close()
+	assert.Equal(t, "a", getBlob(t, store, a))
+	assert.Equal(t, "loose", getBlob(t, store, loose))
+	name := store.Name(loose)
+	_, err = os.Stat(filepath.Join(repo.GetBlobsDir(root), name[:2], name[2:4], name))
+	assert.Nil(t, err)
+
+	id := filepath.Base(packs[0])
+	assert.Equal(t, []string{filepath.Join(repo.GetPacksDir(root), id[:2], id)}, packFiles(t, root))
+
+	// running it again does nothing
+	blobs, moved, err = Migrate(root)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), blobs+moved)
+}
+
+func TestCompression(t *testing.T) {
+	root, _ := ioutil.TempDir("", "TestCompression")
+	defer os.RemoveAll(root)
+	repo.Create(root)
+
+	store, err := GetStore(root, nil)
+	assert.Nil(t, err)
+	defer store.Close()
+
+	text := strings.Repeat("abakus ", 1000)
+	var hashes [][]byte
+	for _, compression := range []string{repo.COMPRESSION_ZLIB, repo.COMPRESSION_ZSTD, repo.COMPRESSION_NONE} {
+		contents := compression + text
+		hash := blake2b.Sum256([]byte(contents))
+		_, err = store.write(store.Name(hash[:]), strings.NewReader(contents), compression)
+		assert.Nil(t, err)
+		assert.Equal(t, contents, getBlob(t, store, hash[:]))
+		hashes = append(hashes, hash[:])
+	}
+	loose := putLoose(t, store, root, text)
+	assert.Equal(t, text, getBlob(t, store, loose))
+
+	stats, err := store.Stats()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), stats[repo.COMPRESSION_ZLIB].Blobs)
+	assert.Equal(t, uint64(1), stats[repo.COMPRESSION_ZSTD].Blobs)
+	assert.True(t, stats[repo.COMPRESSION_ZSTD].Ratio() > 10)
+	assert.True(t, stats[repo.COMPRESSION_NONE].Ratio() < 1)
+
+	// already compressed data is stored as it is
+	random := make([]byte, PROBE_SIZE)
+	rand.Read(random)
+	assert.Equal(t, repo.COMPRESSION_NONE, store.compressionFor("data.bin", random))
+	assert.Equal(t, repo.COMPRESSION_NONE, store.compressionFor("photo.JPG", []byte(text)))
+	assert.Equal(t, repo.COMPRESSION_ZSTD, store.compressionFor("notes.txt", []byte(text)))
+}
+
+func TestAddFilesJobs(t *testing.T) {
+	var names []int
+	for _, jobs := range []int{1, 8} {
+		root, _ := ioutil.TempDir("", "TestAddFilesJobs")
+		defer os.RemoveAll(root)
+		repo.Create(root)
+
+		// the same contents in many files, some large enough to chunk
+		for i := 0; i < 40; i++ {
+			contents := bytes.Repeat([]byte{byte(i % 10)}, 1000*(i%10))
+			if i%10 == 9 {
+				contents = make([]byte, 2*1024*1024)
+				rand.New(rand.NewSource(int64(i % 10))).Read(contents)
+			}
+			ioutil.WriteFile(filepath.Join(root, fmt.Sprintf("file%02d", i)), contents, 0644)
+		}
+
+		expected, err := filelist.NewFromRoot(root)
+		assert.Nil(t, err)
+
+		fl, err := filelist.Scan(root, nil)
+		assert.Nil(t, err)
+
+		store, err := GetStore(root, nil)
+		assert.Nil(t, err)
+		result, err := store.AddFiles(fl, nil, &AddOptions{Jobs: jobs})
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(40), result.New+result.Existing)
+		assert.Nil(t, store.Close())
+
+		assert.Equal(t, expected.MerkleRoot(), fl.MerkleRoot())
+
+		store, err = GetStore(root, nil)
+		assert.Nil(t, err)
+		it := fl.Files.Iterator()
+		for it.Next() {
+			assert.Nil(t, store.VerifyFile(it.Value().(*filelist.FileMetadata)))
+		}
+		names = append(names, len(store.Names()))
+		store.Close()
+	}
+
+	// duplicate contents are only stored once, however many jobs
+	assert.Equal(t, names[0], names[1])
+	assert.True(t, names[0] > 9)
+}
+
+func TestAddFilesCheckpoint(t *testing.T) {
+	root, _ := ioutil.TempDir("", "TestAddFilesCheckpoint")
+	defer os.RemoveAll(root)
+	repo.Create(root)
+
+	for _, name := range []string{"a", "b", "c"} {
+		ioutil.WriteFile(filepath.Join(root, name), []byte(name), 0644)
+	}
+
+	fl, err := filelist.Scan(root, nil)
+	assert.Nil(t, err)
+	os.Remove(filepath.Join(root, "b"))
+
+	store, err := GetStore(root, nil)
+	assert.Nil(t, err)
+	defer store.Close()
+
+	// the files stored before the failure are reported, once their blobs
+	// are in the index
+	var done []string
+	_, err = store.AddFiles(fl, nil, &AddOptions{Jobs: 1, Checkpoint: func(stored *filelist.FileList) error {
+		for _, path := range stored.Files.Keys() {
+			done = append(done, path.(string))
+		}
+		assert.Nil(t, store.pack)
+		return nil
+	}})
+	assert.NotNil(t, err)
+	assert.Equal(t, []string{"a"}, done)
+
+	metadata, _ := fl.Files.Get("a")
+	entry, err := store.index.get(store.Name(metadata.(*filelist.FileMetadata).Hash))
+	assert.Nil(t, err)
+	assert.NotNil(t, entry)
+
+	// a checkpoint that cannot be saved is reported with the failure
+	fl, err = filelist.Scan(root, nil)
+	assert.Nil(t, err)
+	fl.Add("b", &filelist.FileMetadata{Size: 1})
+	_, err = store.AddFiles(fl, nil, &AddOptions{Jobs: 1, Checkpoint: func(stored *filelist.FileList) error {
+		return errors.New("checkpoint failed")
+	}})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "b")
+	assert.Contains(t, err.Error(), "checkpoint failed")
+}
+
+func TestAddFilesOnChange(t *testing.T) {
+	for _, policy := range []string{ON_CHANGE_RETRY, ON_CHANGE_WARN, ON_CHANGE_FAIL} {
+		root, _ := ioutil.TempDir("", "TestAddFilesOnChange")
+		defer os.RemoveAll(root)
+		repo.Create(root)
+
+		ioutil.WriteFile(filepath.Join(root, "a"), []byte("before"), 0644)
+		ioutil.WriteFile(filepath.Join(root, "b"), []byte("stable"), 0644)
+
+		fl, err := filelist.NewFromRoot(root)
+		assert.Nil(t, err)
+
+		// changed after it was scanned and hashed
+		ioutil.WriteFile(filepath.Join(root, "a"), []byte("after the scan"), 0644)
+
+		store, err := GetStore(root, nil)
+		assert.Nil(t, err)
+		result, err := store.AddFiles(fl, nil, &AddOptions{Jobs: 1, OnChange: policy})
+		store.Close()
+
+		if policy == ON_CHANGE_FAIL {
+			assert.NotNil(t, err)
+			continue
+		}
+		assert.Nil(t, err)
+
+		// a second read agrees with the first, so retry settles
+		if policy == ON_CHANGE_WARN {
+			assert.Equal(t, []string{"a"}, result.Unstable)
+		} else {
+			assert.Empty(t, result.Unstable)
+		}
+
+		// the metadata describes what was stored
+		metadata, _ := fl.Files.Get("a")
+		sum := blake2b.Sum256([]byte("after the scan"))
+		assert.Equal(t, sum[:], metadata.(*filelist.FileMetadata).Hash)
+		assert.Equal(t, uint64(14), metadata.(*filelist.FileMetadata).Size)
+	}
+}
+
+func TestAddFilesResized(t *testing.T) {
+	root, _ := ioutil.TempDir("", "TestAddFilesResized")
+	defer os.RemoveAll(root)
+	repo.Create(root)
+
+	large := make([]byte, 2*1024*1024)
+	rand.New(rand.NewSource(1)).Read(large)
+	ioutil.WriteFile(filepath.Join(root, "grown"), []byte("small"), 0644)
+	ioutil.WriteFile(filepath.Join(root, "shrunk"), large, 0644)
+
+	fl, err := filelist.Scan(root, nil)
+	assert.Nil(t, err)
+
+	// how a file is stored follows what is read, not the scanned size
+	ioutil.WriteFile(filepath.Join(root, "grown"), large, 0644)
+	ioutil.WriteFile(filepath.Join(root, "shrunk"), []byte("small"), 0644)
+
+	store, err := GetStore(root, nil)
+	assert.Nil(t, err)
+	defer store.Close()
+	_, err = store.AddFiles(fl, nil, &AddOptions{Jobs: 1, OnChange: ON_CHANGE_RETRY})
+	assert.Nil(t, err)
+
+	value, _ := fl.Files.Get("grown")
+	grown := value.(*filelist.FileMetadata)
+	assert.Equal(t, uint64(len(large)), grown.Size)
+	assert.True(t, len(grown.Chunks) > 1)
+	assert.Nil(t, store.VerifyFile(grown))
+
+	value, _ = fl.Files.Get("shrunk")
+	shrunk := value.(*filelist.FileMetadata)
+	assert.Equal(t, uint64(5), shrunk.Size)
+	assert.Empty(t, shrunk.Chunks)
+	assert.Equal(t, "small", getBlob(t, store, shrunk.Hash))
+}
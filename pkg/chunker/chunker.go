@@ -0,0 +1,151 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package chunker
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/golang/crypto/blake2b"
+)
+
+// chunk size bounds. Files smaller than MIN_SIZE are never split.
+const (
+	MIN_SIZE = 512 * 1024
+	AVG_SIZE = 1024 * 1024
+	MAX_SIZE = 8 * 1024 * 1024
+)
+
+// the masks test the high bits of the gear hash, which depend on the last
+// 64 bytes. Before the average size a cut point needs more zero bits, after
+// it fewer, which keeps chunk sizes close to the average (normalized
+// chunking from FastCDC).
+const (
+	maskSmall uint64 = (1<<22 - 1) << (64 - 22)
+	maskLarge uint64 = (1<<18 - 1) << (64 - 18)
+)
+
+// gear maps each byte to a random value for the rolling hash. It is derived
+// from a fixed seed because changing it would change every cut point and
+// stop new chunks from matching stored ones.
+var gear [256]uint64
+
+func init() {
+	for i := range gear {
+		sum := blake2b.Sum256([]byte{'a', 'b', 'a', 'k', 'u', 's', byte(i)})
+		gear[i] = binary.LittleEndian.Uint64(sum[:8])
+	}
+}
+
+// Chunker splits a stream into content-defined chunks with FastCDC. The
+// same content produces the same chunks wherever it appears in a stream,
+// so data that is shared between versions of a file is only stored once.
+type Chunker struct {
+	r     io.Reader
+	buf   []byte
+	start int
+	end   int
+	eof   bool
+}
+
+// New returns a chunker that reads from r
+func New(r io.Reader) *Chunker {
+	return &Chunker{
+		r:   r,
+		buf: make([]byte, 2*MAX_SIZE),
+	}
+}
+
+// Next returns the next chunk, or io.EOF after the last one. The returned
+// slice is only valid until the next call.
+func (c *Chunker) Next() ([]byte, error) {
+	if err := c.fill(); err != nil {
+		return nil, err
+	}
+
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+
+	n := cut(c.buf[c.start:c.end])
+	chunk := c.buf[c.start : c.start+n]
+	c.start += n
+
+	return chunk, nil
+}
+
+// fill reads until at least MAX_SIZE bytes are buffered or the stream ends
+func (c *Chunker) fill() error {
+	if c.eof || c.end-c.start >= MAX_SIZE {
+		return nil
+	}
+
+	// move the unread bytes to the front of the buffer
+	copy(c.buf, c.buf[c.start:c.end])
+	c.end -= c.start
+	c.start = 0
+
+	for c.end < MAX_SIZE {
+		n, err := c.r.Read(c.buf[c.end:])
+		c.end += n
+		if err == io.EOF {
+			c.eof = true
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// cut returns the length of the chunk at the start of data
+func cut(data []byte) int {
+	n := len(data)
+	if n <= MIN_SIZE {
+		return n
+	}
+	if n > MAX_SIZE {
+		n = MAX_SIZE
+	}
+
+	normal := AVG_SIZE
+	if n < normal {
+		normal = n
+	}
+
+	var fp uint64 = 0
+	i := MIN_SIZE
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&maskSmall == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&maskLarge == 0 {
+			return i + 1
+		}
+	}
+
+	return n
+}
@@ -0,0 +1,97 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package chunker
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/golang/crypto/blake2b"
+	"github.com/stretchr/testify/assert"
+)
+
+// split returns the chunks of data
+func split(t *testing.T, data []byte) [][]byte {
+	var chunks [][]byte
+	c := New(bytes.NewReader(data))
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		chunks = append(chunks, append([]byte{}, chunk...))
+	}
+
+	return chunks
+}
+
+func randomData(seed int64, size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func TestChunkSizes(t *testing.T) {
+	data := randomData(1, 32*1024*1024)
+	chunks := split(t, data)
+
+	assert.True(t, len(chunks) > 8)
+	assert.Equal(t, data, bytes.Join(chunks, nil))
+	for i, chunk := range chunks {
+		assert.True(t, len(chunk) <= MAX_SIZE)
+		if i != len(chunks)-1 {
+			assert.True(t, len(chunk) >= MIN_SIZE)
+		}
+	}
+}
+
+func TestSmall(t *testing.T) {
+	assert.Len(t, split(t, nil), 0)
+
+	data := randomData(2, MIN_SIZE)
+	chunks := split(t, data)
+	assert.Len(t, chunks, 1)
+	assert.Equal(t, data, chunks[0])
+}
+
+func TestInsertion(t *testing.T) {
+	data := randomData(3, 16*1024*1024)
+	edited := append(append(append([]byte{}, data[:5000000]...), []byte("inserted")...), data[5000000:]...)
+
+	seen := make(map[[32]byte]bool)
+	for _, chunk := range split(t, data) {
+		seen[blake2b.Sum256(chunk)] = true
+	}
+
+	changed := 0
+	editedChunks := split(t, edited)
+	for _, chunk := range editedChunks {
+		if !seen[blake2b.Sum256(chunk)] {
+			changed += 1
+		}
+	}
+
+	// only the chunk with the insertion (and possibly its neighbour) differs
+	assert.True(t, changed <= 2, "%d of %d chunks changed", changed, len(editedChunks))
+}
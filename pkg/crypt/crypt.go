@@ -0,0 +1,372 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package crypt
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+
+	"github.com/golang/crypto/blake2b"
+	"github.com/golang/crypto/chacha20poly1305"
+)
+
+// KEY_SIZE is the size in bytes of the encryption and mac keys
+const KEY_SIZE = 32
+
+// STREAM_CHUNK_SIZE is the amount of plaintext sealed in each chunk of an
+// encrypted stream
+const STREAM_CHUNK_SIZE = 64 * 1024
+
+// streamMagic starts every encrypted stream so it can be told apart from
+// plaintext
+var streamMagic = []byte("ABK\x01")
+
+// streamPrefixSize is the size of the random part of each chunk's nonce.
+// the rest is an 8 byte chunk counter and a final chunk flag
+const streamPrefixSize = chacha20poly1305.NonceSizeX - 9
+
+// ErrCorrupt is returned when ciphertext fails authentication
+var ErrCorrupt = errors.New("Encrypted data is corrupt or was not sealed with this key")
+
+// MasterKey holds the keys that protect an encrypted repository
+// Encrypt - XChaCha20-Poly1305 key for new blobs and metadata
+// MAC - HMAC-SHA256 key used to derive blob names from content hashes
+// Retired - encryption keys replaced by Rotate, newest first. They are
+// only used to open data sealed before the rotation.
+type MasterKey struct {
+	Encrypt []byte   `json:"encrypt"`
+	MAC     []byte   `json:"mac"`
+	Retired [][]byte `json:"retired,omitempty"`
+}
+
+// NewMasterKey generates a random master key
+func NewMasterKey() (*MasterKey, error) {
+	key := &MasterKey{
+		Encrypt: make([]byte, KEY_SIZE),
+		MAC:     make([]byte, KEY_SIZE),
+	}
+
+	if _, err := rand.Read(key.Encrypt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(key.MAC); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// Rotate returns a new master key with a fresh encryption key. The mac key
+// is kept so blob names do not change, and the current encryption key is
+// retired so existing blobs can still be read.
+func (key *MasterKey) Rotate() (*MasterKey, error) {
+	rotated := &MasterKey{
+		Encrypt: make([]byte, KEY_SIZE),
+		MAC:     key.MAC,
+		Retired: append([][]byte{key.Encrypt}, key.Retired...),
+	}
+
+	if _, err := rand.Read(rotated.Encrypt); err != nil {
+		return nil, err
+	}
+
+	return rotated, nil
+}
+
+// Id returns a short fingerprint that identifies the master key without
+// revealing it. It changes when the key is rotated.
+func (key *MasterKey) Id() string {
+	return keyId(key.Encrypt)
+}
+
+// IsRetired returns true if id belongs to a master key that was rotated
+// into this one
+func (key *MasterKey) IsRetired(id string) bool {
+	for _, retired := range key.Retired {
+		if keyId(retired) == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// keyId returns the fingerprint of an encryption key
+func keyId(encrypt []byte) string {
+	hasher, _ := blake2b.New256(encrypt)
+	hasher.Write([]byte("abakus master key id"))
+	return hex.EncodeToString(hasher.Sum(nil)[:8])
+}
+
+// aeads returns a cipher for the current encryption key followed by one
+// for each retired key
+func (key *MasterKey) aeads() ([]cipher.AEAD, error) {
+	var aeads []cipher.AEAD
+	for _, k := range append([][]byte{key.Encrypt}, key.Retired...) {
+		aead, err := chacha20poly1305.NewX(k)
+		if err != nil {
+			return nil, err
+		}
+		aeads = append(aeads, aead)
+	}
+
+	return aeads, nil
+}
+
+// Name returns the keyed hash (HMAC) of data as a hex string. It is used to
+// name blobs so that storage does not reveal their content hashes.
+func (key *MasterKey) Name(data []byte) string {
+	mac := hmac.New(sha256.New, key.MAC)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Seal encrypts and authenticates a small message, such as a metadata
+// record. The random nonce is prepended to the ciphertext.
+func (key *MasterKey) Seal(plaintext []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(key.Encrypt)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// Open decrypts a message created by Seal with the current or a retired
+// encryption key
+func (key *MasterKey) Open(ciphertext []byte) ([]byte, error) {
+	aeads, err := key.aeads()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) < chacha20poly1305.NonceSizeX+chacha20poly1305.Overhead {
+		return nil, ErrCorrupt
+	}
+
+	nonce := ciphertext[:chacha20poly1305.NonceSizeX]
+	for _, aead := range aeads {
+		plaintext, err := aead.Open(nil, nonce, ciphertext[len(nonce):], nil)
+		if err == nil {
+			return plaintext, nil
+		}
+	}
+
+	return nil, ErrCorrupt
+}
+
+// NewWriter returns a writer that encrypts everything written to it into w
+// as a sequence of authenticated chunks. The last chunk is marked so that a
+// truncated stream is detected. Close must be called to write it.
+func (key *MasterKey) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	aead, err := chacha20poly1305.NewX(key.Encrypt)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := make([]byte, streamPrefixSize)
+	if _, err = rand.Read(prefix); err != nil {
+		return nil, err
+	}
+
+	header := append(append([]byte{}, streamMagic...), prefix...)
+	if _, err = w.Write(header); err != nil {
+		return nil, err
+	}
+
+	sw := &streamWriter{
+		aead:   aead,
+		w:      w,
+		prefix: prefix,
+		buf:    make([]byte, 0, STREAM_CHUNK_SIZE),
+	}
+
+	return sw, nil
+}
+
+// NewReader returns a reader that decrypts a stream created by NewWriter
+// with the current or a retired encryption key
+func (key *MasterKey) NewReader(r io.Reader) (io.Reader, error) {
+	aeads, err := key.aeads()
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, len(streamMagic)+streamPrefixSize)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return nil, ErrCorrupt
+	}
+	if !bytes.Equal(header[:len(streamMagic)], streamMagic) {
+		return nil, ErrCorrupt
+	}
+
+	sr := &streamReader{
+		aeads:  aeads,
+		r:      bufio.NewReaderSize(r, STREAM_CHUNK_SIZE+chacha20poly1305.Overhead),
+		prefix: header[len(streamMagic):],
+	}
+
+	return sr, nil
+}
+
+// streamNonce builds the nonce for a chunk from the stream's random prefix,
+// the chunk counter, and whether it is the final chunk
+func streamNonce(prefix []byte, counter uint64, final bool) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint64(nonce[streamPrefixSize:], counter)
+	if final {
+		nonce[len(nonce)-1] = 1
+	}
+
+	return nonce
+}
+
+// streamWriter buffers plaintext and seals it a chunk at a time
+type streamWriter struct {
+	aead    cipher.AEAD
+	w       io.Writer
+	prefix  []byte
+	counter uint64
+	buf     []byte
+	closed  bool
+}
+
+// Write buffers p, sealing full chunks once it is known they are not last
+func (sw *streamWriter) Write(p []byte) (int, error) {
+	if sw.closed {
+		return 0, errors.New("write to closed stream")
+	}
+
+	written := 0
+	for len(p) > 0 {
+		if len(sw.buf) == STREAM_CHUNK_SIZE {
+			if err := sw.flush(false); err != nil {
+				return written, err
+			}
+		}
+
+		n := copy(sw.buf[len(sw.buf):STREAM_CHUNK_SIZE], p)
+		sw.buf = sw.buf[:len(sw.buf)+n]
+		p = p[n:]
+		written += n
+	}
+
+	return written, nil
+}
+
+// Close seals the remaining plaintext as the final chunk. It does not close
+// the underlying writer.
+func (sw *streamWriter) Close() error {
+	if sw.closed {
+		return nil
+	}
+	sw.closed = true
+
+	return sw.flush(true)
+}
+
+// flush seals and writes the buffered chunk
+func (sw *streamWriter) flush(final bool) error {
+	nonce := streamNonce(sw.prefix, sw.counter, final)
+	ciphertext := sw.aead.Seal(nil, nonce, sw.buf, nil)
+	sw.counter += 1
+	sw.buf = sw.buf[:0]
+
+	_, err := sw.w.Write(ciphertext)
+	return err
+}
+
+// streamReader opens a chunk at a time and returns the plaintext. The key
+// that opens the first chunk is used for the rest of the stream.
+type streamReader struct {
+	aeads   []cipher.AEAD
+	r       *bufio.Reader
+	prefix  []byte
+	counter uint64
+	plain   []byte
+	done    bool
+}
+
+// Read returns decrypted plaintext, reading the next chunk when needed
+func (sr *streamReader) Read(p []byte) (int, error) {
+	for len(sr.plain) == 0 {
+		if sr.done {
+			return 0, io.EOF
+		}
+		if err := sr.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, sr.plain)
+	sr.plain = sr.plain[n:]
+	return n, nil
+}
+
+// readChunk reads and opens the next chunk. A chunk is the final one if it
+// is short or nothing follows it.
+func (sr *streamReader) readChunk() error {
+	ciphertext := make([]byte, STREAM_CHUNK_SIZE+chacha20poly1305.Overhead)
+	n, err := io.ReadFull(sr.r, ciphertext)
+	if err == io.EOF {
+		// the final chunk is always written, so the stream was truncated
+		return ErrCorrupt
+	}
+
+	final := err == io.ErrUnexpectedEOF
+	if err == nil {
+		if _, peekErr := sr.r.Peek(1); peekErr == io.EOF {
+			final = true
+		}
+	} else if !final {
+		return err
+	}
+
+	nonce := streamNonce(sr.prefix, sr.counter, final)
+	for _, aead := range sr.aeads {
+		plain, err := aead.Open(nil, nonce, ciphertext[:n], nil)
+		if err != nil {
+			continue
+		}
+
+		sr.aeads = []cipher.AEAD{aead}
+		sr.counter += 1
+		sr.plain = plain
+		sr.done = final
+		return nil
+	}
+
+	return ErrCorrupt
+}
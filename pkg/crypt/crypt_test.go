@@ -0,0 +1,189 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package crypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// seal encrypts data as a stream with the key
+func seal(t *testing.T, key *MasterKey, data []byte) []byte {
+	var buf bytes.Buffer
+	writer, err := key.NewWriter(&buf)
+	assert.Nil(t, err)
+	_, err = writer.Write(data)
+	assert.Nil(t, err)
+	assert.Nil(t, writer.Close())
+
+	return buf.Bytes()
+}
+
+// open decrypts a stream with the key
+func open(key *MasterKey, data []byte) ([]byte, error) {
+	reader, err := key.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadAll(reader)
+}
+
+func TestStream(t *testing.T) {
+	key, err := NewMasterKey()
+	assert.Nil(t, err)
+
+	sizes := []int{0, 1, STREAM_CHUNK_SIZE - 1, STREAM_CHUNK_SIZE,
+		STREAM_CHUNK_SIZE + 1, 3*STREAM_CHUNK_SIZE + 17}
+	for _, size := range sizes {
+		data := make([]byte, size)
+		rand.Read(data)
+
+		sealed := seal(t, key, data)
+		opened, err := open(key, sealed)
+		assert.Nil(t, err, "size %d", size)
+		assert.True(t, bytes.Equal(data, opened), "size %d", size)
+	}
+}
+
+func TestStreamTampered(t *testing.T) {
+	key, _ := NewMasterKey()
+	other, _ := NewMasterKey()
+
+	data := make([]byte, 2*STREAM_CHUNK_SIZE+100)
+	rand.Read(data)
+	sealed := seal(t, key, data)
+
+	// flipped bit
+	flipped := append([]byte{}, sealed...)
+	flipped[len(flipped)/2] ^= 1
+	_, err := open(key, flipped)
+	assert.Equal(t, ErrCorrupt, err)
+
+	// last chunk dropped
+	chunk := STREAM_CHUNK_SIZE + 16
+	header := len(streamMagic) + streamPrefixSize
+	_, err = open(key, sealed[:header+2*chunk])
+	assert.Equal(t, ErrCorrupt, err)
+
+	// wrong key
+	_, err = open(other, sealed)
+	assert.Equal(t, ErrCorrupt, err)
+}
+
+func TestSeal(t *testing.T) {
+	key, _ := NewMasterKey()
+
+	sealed, err := key.Seal([]byte("metadata"))
+	assert.Nil(t, err)
+	assert.False(t, bytes.Contains(sealed, []byte("metadata")))
+
+	opened, err := key.Open(sealed)
+	assert.Nil(t, err)
+	assert.Equal(t, "metadata", string(opened))
+
+	sealed[len(sealed)-1] ^= 1
+	_, err = key.Open(sealed)
+	assert.Equal(t, ErrCorrupt, err)
+}
+
+func TestName(t *testing.T) {
+	key, _ := NewMasterKey()
+	other, _ := NewMasterKey()
+
+	hash := []byte("hash")
+	assert.Equal(t, key.Name(hash), key.Name(hash))
+	assert.NotEqual(t, key.Name(hash), other.Name(hash))
+	assert.Len(t, key.Name(hash), 64)
+}
+
+func TestKeyFile(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "TestKeyFile")
+	defer os.RemoveAll(dir)
+
+	master, _ := NewMasterKey()
+	keyFile, err := Wrap(master, []byte("correct horse"), DefaultKDFParams())
+	assert.Nil(t, err)
+	id, err := WriteKeyFile(dir, keyFile)
+	assert.Nil(t, err)
+
+	keyFiles, err := ReadKeyFiles(dir)
+	assert.Nil(t, err)
+	assert.Len(t, keyFiles, 1)
+	assert.Equal(t, master.Id(), keyFiles[id].Master)
+
+	unlocked, unlockedId, err := Unlock(dir, []byte("correct horse"))
+	assert.Nil(t, err)
+	assert.Equal(t, id, unlockedId)
+	assert.Equal(t, master, unlocked)
+
+	_, _, err = Unlock(dir, []byte("battery staple"))
+	assert.Equal(t, ErrWrongPassphrase, err)
+}
+
+func TestRecoveryKey(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "TestRecoveryKey")
+	defer os.RemoveAll(dir)
+
+	master, _ := NewMasterKey()
+	keyFile, recoveryKey, err := WrapRecovery(master)
+	assert.Nil(t, err)
+	assert.True(t, keyFile.Recovery)
+	_, err = WriteKeyFile(dir, keyFile)
+	assert.Nil(t, err)
+
+	// separators and case do not matter
+	loose := strings.ToLower(strings.Replace(recoveryKey, "-", " ", -1))
+	unlocked, _, err := Unlock(dir, []byte(loose))
+	assert.Nil(t, err)
+	assert.Equal(t, master, unlocked)
+}
+
+func TestRotate(t *testing.T) {
+	key, _ := NewMasterKey()
+	sealed, _ := key.Seal([]byte("old"))
+	stream := seal(t, key, []byte("old stream"))
+
+	rotated, err := key.Rotate()
+	assert.Nil(t, err)
+	assert.NotEqual(t, key.Id(), rotated.Id())
+	assert.True(t, rotated.IsRetired(key.Id()))
+	assert.Equal(t, key.Name([]byte("hash")), rotated.Name([]byte("hash")))
+
+	// data sealed before the rotation can still be opened
+	opened, err := rotated.Open(sealed)
+	assert.Nil(t, err)
+	assert.Equal(t, "old", string(opened))
+	opened, err = open(rotated, stream)
+	assert.Nil(t, err)
+	assert.Equal(t, "old stream", string(opened))
+
+	// but the old key cannot open new data
+	sealed, _ = rotated.Seal([]byte("new"))
+	_, err = key.Open(sealed)
+	assert.Equal(t, ErrCorrupt, err)
+}
@@ -0,0 +1,329 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package crypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/crypto/chacha20poly1305"
+	"github.com/golang/crypto/scrypt"
+)
+
+// KEY_FILE_VERSION is the version of the key file format
+const KEY_FILE_VERSION uint32 = 1
+
+// default scrypt parameters for new key files
+const (
+	SCRYPT_N = 1 << 15
+	SCRYPT_R = 8
+	SCRYPT_P = 1
+)
+
+// RECOVERY_KEY_SIZE is the number of random bytes in a recovery key
+const RECOVERY_KEY_SIZE = 20
+
+// recoveryEncoding is used to print recovery keys. base32 has no 0, 1 or 8
+// so a written down key is hard to misread.
+var recoveryEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// KDFParams are the scrypt cost parameters used to derive a wrapping key
+type KDFParams struct {
+	N int
+	R int
+	P int
+}
+
+// DefaultKDFParams returns the scrypt parameters used unless others are
+// given
+func DefaultKDFParams() KDFParams {
+	return KDFParams{N: SCRYPT_N, R: SCRYPT_R, P: SCRYPT_P}
+}
+
+// ErrWrongPassphrase is returned when no key file can be opened with the
+// given passphrase
+var ErrWrongPassphrase = errors.New("Wrong passphrase")
+
+// KeyFile is a copy of the master key wrapped (encrypted) with a key derived
+// from a passphrase. A repository can have several key files that all
+// unlock the same master key.
+// Master - id of the master key it wraps
+// Created, Host, User - when and by whom the key file was created
+// Recovery - the passphrase is a generated recovery key
+// KDF, N, R, P, Salt - how the wrapping key is derived from the passphrase
+// Data - the sealed master key
+type KeyFile struct {
+	Version  uint32 `json:"version"`
+	Master   string `json:"master"`
+	Created  int64  `json:"created"`
+	Host     string `json:"host"`
+	User     string `json:"user"`
+	Recovery bool   `json:"recovery,omitempty"`
+	KDF      string `json:"kdf"`
+	N        int    `json:"n"`
+	R        int    `json:"r"`
+	P        int    `json:"p"`
+	Salt     []byte `json:"salt"`
+	Data     []byte `json:"data"`
+}
+
+// WriteKeyFile saves the key file in the keys directory and returns its id
+// (file name)
+func WriteKeyFile(dir string, keyFile *KeyFile) (string, error) {
+	idBytes := make([]byte, 8)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(idBytes)
+
+	data, err := json.MarshalIndent(keyFile, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	return id, ioutil.WriteFile(filepath.Join(dir, id+".json"), data, 0600)
+}
+
+// RemoveKeyFile deletes the key file with the given id
+func RemoveKeyFile(dir string, id string) error {
+	err := os.Remove(filepath.Join(dir, id+".json"))
+	if os.IsNotExist(err) {
+		return errors.New(fmt.Sprintf("No key with id %s", id))
+	}
+
+	return err
+}
+
+// Wrap seals the master key with a key derived from the passphrase
+func Wrap(master *MasterKey, passphrase []byte, params KDFParams) (*KeyFile, error) {
+	keyFile := &KeyFile{
+		Version: KEY_FILE_VERSION,
+		Master:  master.Id(),
+		Created: time.Now().Unix(),
+		KDF:     "scrypt",
+		N:       params.N,
+		R:       params.R,
+		P:       params.P,
+		Salt:    make([]byte, 32),
+	}
+
+	keyFile.Host, _ = os.Hostname()
+	if u, err := user.Current(); err == nil {
+		keyFile.User = u.Username
+	}
+
+	if _, err := rand.Read(keyFile.Salt); err != nil {
+		return nil, err
+	}
+
+	wrapping, err := keyFile.wrappingKey(passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := json.Marshal(master)
+	if err != nil {
+		return nil, err
+	}
+
+	keyFile.Data, err = wrapping.Seal(plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	return keyFile, nil
+}
+
+// WrapRecovery generates a recovery key and seals the master key with it.
+// It returns the key file and the recovery key formatted for printing.
+func WrapRecovery(master *MasterKey) (*KeyFile, string, error) {
+	secret := make([]byte, RECOVERY_KEY_SIZE)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", err
+	}
+
+	encoded := recoveryEncoding.EncodeToString(secret)
+	var groups []string
+	for i := 0; i < len(encoded); i += 4 {
+		groups = append(groups, encoded[i:i+4])
+	}
+	recoveryKey := strings.Join(groups, "-")
+
+	keyFile, err := Wrap(master, normalizeRecovery([]byte(recoveryKey)), DefaultKDFParams())
+	if err != nil {
+		return nil, "", err
+	}
+	keyFile.Recovery = true
+
+	return keyFile, recoveryKey, nil
+}
+
+// normalizeRecovery removes the separators and case from a recovery key
+// so it can be typed back in loosely
+func normalizeRecovery(recoveryKey []byte) []byte {
+	var normalized []byte
+	for _, c := range bytes.ToUpper(recoveryKey) {
+		if c != '-' && c != ' ' && c != '\t' {
+			normalized = append(normalized, c)
+		}
+	}
+
+	return normalized
+}
+
+// Unwrap opens the key file with the passphrase and returns the master key
+func (keyFile *KeyFile) Unwrap(passphrase []byte) (*MasterKey, error) {
+	if keyFile.Recovery {
+		passphrase = normalizeRecovery(passphrase)
+	}
+
+	wrapping, err := keyFile.wrappingKey(passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := wrapping.Open(keyFile.Data)
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+
+	master := new(MasterKey)
+	if err = json.Unmarshal(plaintext, master); err != nil {
+		return nil, err
+	}
+
+	return master, nil
+}
+
+// wrappingKey derives the key that seals the master key from the passphrase
+func (keyFile *KeyFile) wrappingKey(passphrase []byte) (*MasterKey, error) {
+	if keyFile.KDF != "scrypt" {
+		return nil, errors.New(fmt.Sprintf("Unknown key derivation function '%s'", keyFile.KDF))
+	}
+
+	derived, err := scrypt.Key(passphrase, keyFile.Salt,
+		keyFile.N, keyFile.R, keyFile.P, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MasterKey{Encrypt: derived}, nil
+}
+
+// ReadKeyFiles returns every key file in the keys directory by id
+func ReadKeyFiles(dir string) (map[string]*KeyFile, error) {
+	keyFiles := make(map[string]*KeyFile)
+
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return keyFiles, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		keyFile, err := ParseKeyFile(data)
+		if err != nil {
+			return nil, err
+		}
+
+		keyFiles[strings.TrimSuffix(entry.Name(), ".json")] = keyFile
+	}
+
+	return keyFiles, nil
+}
+
+// ParseKeyFile decodes the json contents of a key file
+func ParseKeyFile(data []byte) (*KeyFile, error) {
+	keyFile := new(KeyFile)
+	if err := json.Unmarshal(data, keyFile); err != nil {
+		return nil, err
+	}
+
+	if keyFile.Version != KEY_FILE_VERSION {
+		errMsg := fmt.Sprintf("Key file version %d not supported", keyFile.Version)
+		return nil, errors.New(errMsg)
+	}
+
+	return keyFile, nil
+}
+
+// Unlock tries the passphrase (or a recovery key) against each key file in
+// the keys directory and returns the master key and the id of the key file
+// that opened
+func Unlock(dir string, passphrase []byte) (*MasterKey, string, error) {
+	keyFiles, err := ReadKeyFiles(dir)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if len(keyFiles) == 0 {
+		return nil, "", errors.New("No key files found")
+	}
+
+	// try the newest key files first so that a key file left over from an
+	// interrupted rotation is not preferred
+	var ids []string
+	for id := range keyFiles {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return keyFiles[ids[i]].Created > keyFiles[ids[j]].Created
+	})
+
+	for _, id := range ids {
+		master, err := keyFiles[id].Unwrap(passphrase)
+		if err == ErrWrongPassphrase {
+			continue
+		} else if err != nil {
+			return nil, "", err
+		}
+
+		return master, id, nil
+	}
+
+	return nil, "", ErrWrongPassphrase
+}
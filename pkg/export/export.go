@@ -0,0 +1,251 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package export
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/andybug/abakus/pkg/blob"
+	"github.com/andybug/abakus/pkg/filelist"
+)
+
+// FORMAT_TAR, FORMAT_TGZ, and FORMAT_ZIP are the supported archive formats
+const (
+	FORMAT_TAR = "tar"
+	FORMAT_TGZ = "tgz"
+	FORMAT_ZIP = "zip"
+)
+
+// Writer adds files to an archive as they are streamed from the blob store.
+// contents is nil for entries that have none, such as symlinks. The
+// relPath of a directory ends with a slash, as both formats name them. The
+// Link of a hard link always names an entry that was added before it.
+type Writer interface {
+	Add(relPath string, metadata *filelist.FileMetadata, contents io.Reader) error
+	Close() error
+}
+
+// FormatFromPath guesses the archive format from the output file name,
+// defaulting to tar
+func FormatFromPath(path string) string {
+	switch {
+	case strings.HasSuffix(path, ".tar.gz"), strings.HasSuffix(path, ".tgz"):
+		return FORMAT_TGZ
+	case strings.HasSuffix(path, ".zip"):
+		return FORMAT_ZIP
+	default:
+		return FORMAT_TAR
+	}
+}
+
+// NewWriter returns a Writer that writes an archive of the given format to w.
+// Closing the Writer does not close w.
+func NewWriter(format string, w io.Writer) (Writer, error) {
+	switch format {
+	case FORMAT_TAR:
+		return &tarWriter{tw: tar.NewWriter(w)}, nil
+	case FORMAT_TGZ:
+		gz := gzip.NewWriter(w)
+		return &tarWriter{tw: tar.NewWriter(gz), gz: gz}, nil
+	case FORMAT_ZIP:
+		return &zipWriter{zw: zip.NewWriter(w)}, nil
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown archive format '%s'", format))
+	}
+}
+
+// Export streams every file in the file list from the blob store into the
+// archive, and adds directories, symlinks, FIFOs and devices as entries of
+// their own. Hard links whose first file is not exported are written as
+// files. It returns the number of files written, not counting directories.
+func Export(fl *filelist.FileList, blobs *blob.Store, w Writer) (uint64, error) {
+	var count uint64 = 0
+
+	it := fl.Files.Iterator()
+	for it.Next() {
+		relPath := it.Key().(string)
+		metadata := it.Value().(*filelist.FileMetadata)
+
+		if metadata.Type == filelist.TYPE_DIRECTORY {
+			if err := w.Add(relPath+"/", metadata, nil); err != nil {
+				return count, err
+			}
+			continue
+		} else if !metadata.IsRegular() {
+			if err := w.Add(relPath, metadata, nil); err != nil {
+				return count, err
+			}
+			count += 1
+			continue
+		}
+
+		if link := metadata.LinkedTo(relPath); link != "" {
+			if _, found := fl.Files.Get(link); !found {
+				unlinked := *metadata
+				unlinked.Link = ""
+				metadata = &unlinked
+			}
+		}
+
+		reader, err := blobs.Open(metadata)
+		if err != nil {
+			return count, err
+		}
+
+		err = w.Add(relPath, metadata, reader)
+		reader.Close()
+		if err != nil {
+			return count, err
+		}
+
+		count += 1
+	}
+
+	return count, nil
+}
+
+// modTime returns the file's modification time, or now for snapshots that
+// were taken before mtimes were stored
+func modTime(metadata *filelist.FileMetadata) time.Time {
+	if metadata.ModTime == 0 {
+		return time.Now()
+	}
+
+	return metadata.MTime()
+}
+
+// tarWriter writes tar archives, optionally gzip compressed
+type tarWriter struct {
+	tw *tar.Writer
+	gz *gzip.Writer
+}
+
+// tarTypes maps the types of entries without contents to tar types. Tar has
+// no type for sockets, so they are left out.
+var tarTypes = map[string]byte{
+	filelist.TYPE_DIRECTORY:    tar.TypeDir,
+	filelist.TYPE_SYMLINK:      tar.TypeSymlink,
+	filelist.TYPE_FIFO:         tar.TypeFifo,
+	filelist.TYPE_CHAR_DEVICE:  tar.TypeChar,
+	filelist.TYPE_BLOCK_DEVICE: tar.TypeBlock,
+}
+
+// Add writes a tar header built from the metadata followed by the contents.
+// A hard link to an earlier entry is written as a link, without contents.
+func (t *tarWriter) Add(relPath string, metadata *filelist.FileMetadata, contents io.Reader) error {
+	if metadata.Type == filelist.TYPE_SOCKET {
+		return nil
+	}
+
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     relPath,
+		Size:     int64(metadata.Size),
+		Mode:     int64(os.FileMode(metadata.Mode).Perm()),
+		ModTime:  modTime(metadata),
+		Uid:      int(metadata.UID),
+		Gid:      int(metadata.GID),
+		Uname:    metadata.User,
+		Gname:    metadata.Group,
+	}
+	if !metadata.IsRegular() {
+		header.Typeflag = tarTypes[metadata.Type]
+		header.Linkname = metadata.Target
+		header.Devmajor = int64(metadata.Major)
+		header.Devminor = int64(metadata.Minor)
+		header.Size = 0
+	} else if link := metadata.LinkedTo(relPath); link != "" {
+		header.Typeflag = tar.TypeLink
+		header.Linkname = link
+		header.Size = 0
+	}
+
+	if err := t.tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if contents == nil || header.Typeflag == tar.TypeLink {
+		return nil
+	}
+
+	_, err := io.Copy(t.tw, contents)
+	return err
+}
+
+// Close finishes the tar archive and the gzip stream
+func (t *tarWriter) Close() error {
+	if err := t.tw.Close(); err != nil {
+		return err
+	}
+
+	if t.gz != nil {
+		return t.gz.Close()
+	}
+
+	return nil
+}
+
+// zipWriter writes zip archives
+type zipWriter struct {
+	zw *zip.Writer
+}
+
+// Add writes a deflated zip entry built from the metadata. A symlink is an
+// entry with the symlink mode whose contents are the target, as Info-ZIP
+// writes them. FIFOs, sockets and devices only keep their mode, since zip
+// has nowhere to put device numbers.
+func (z *zipWriter) Add(relPath string, metadata *filelist.FileMetadata, contents io.Reader) error {
+	header := &zip.FileHeader{
+		Name:   relPath,
+		Method: zip.Deflate,
+	}
+	header.Modified = modTime(metadata)
+	header.SetMode(os.FileMode(metadata.Mode).Perm())
+	if metadata.Type == filelist.TYPE_SYMLINK {
+		header.SetMode(os.ModeSymlink | os.FileMode(metadata.Mode).Perm())
+		contents = strings.NewReader(metadata.Target)
+	} else if !metadata.IsRegular() {
+		header.SetMode(os.FileMode(metadata.Mode))
+	}
+
+	w, err := z.zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	if contents == nil {
+		return nil
+	}
+
+	_, err = io.Copy(w, contents)
+	return err
+}
+
+// Close writes the zip central directory
+func (z *zipWriter) Close() error {
+	return z.zw.Close()
+}
@@ -0,0 +1,186 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package export
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/andybug/abakus/pkg/blob"
+	"github.com/andybug/abakus/pkg/filelist"
+	"github.com/andybug/abakus/pkg/repo"
+	"github.com/stretchr/testify/assert"
+)
+
+// testSnapshot stores a few files in a new repository and returns their
+// file list, with a hard link group, a symlink, a FIFO and a socket added
+func testSnapshot(t *testing.T, root string) (*filelist.FileList, *blob.Store) {
+	repo.Create(root)
+	os.Mkdir(filepath.Join(root, "dir"), 0755)
+	ioutil.WriteFile(filepath.Join(root, "a"), []byte("first"), 0644)
+	ioutil.WriteFile(filepath.Join(root, "dir", "b"), []byte("second"), 0600)
+
+	fl, err := filelist.Scan(root, nil)
+	assert.Nil(t, err)
+	blobs, err := blob.GetStore(root, nil)
+	assert.Nil(t, err)
+	_, err = blobs.AddFiles(fl, nil, &blob.AddOptions{Jobs: 1, OnChange: blob.ON_CHANGE_FAIL})
+	assert.Nil(t, err)
+	assert.Nil(t, blobs.Flush())
+
+	value, _ := fl.Files.Get("a")
+	first := value.(*filelist.FileMetadata)
+	first.Link = "a"
+	second := *first
+	fl.Add("c", &second)
+
+	fl.Add("link", &filelist.FileMetadata{Type: filelist.TYPE_SYMLINK, Target: "a", Mode: uint32(os.ModeSymlink | 0777)})
+	fl.Add("fifo", &filelist.FileMetadata{Type: filelist.TYPE_FIFO, Mode: uint32(os.ModeNamedPipe | 0600)})
+	fl.Add("socket", &filelist.FileMetadata{Type: filelist.TYPE_SOCKET, Mode: uint32(os.ModeSocket | 0755)})
+
+	return fl, blobs
+}
+
+// readTar returns the headers and contents of the entries in a tar archive
+func readTar(t *testing.T, r io.Reader) (map[string]*tar.Header, map[string]string) {
+	headers := make(map[string]*tar.Header)
+	contents := make(map[string]string)
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+
+		data, _ := ioutil.ReadAll(tr)
+		headers[header.Name] = header
+		contents[header.Name] = string(data)
+	}
+
+	return headers, contents
+}
+
+func TestExportTar(t *testing.T) {
+	root, _ := ioutil.TempDir("", "TestExportTar")
+	defer os.RemoveAll(root)
+	fl, blobs := testSnapshot(t, root)
+	defer blobs.Close()
+
+	for _, format := range []string{FORMAT_TAR, FORMAT_TGZ} {
+		var archive bytes.Buffer
+		w, err := NewWriter(format, &archive)
+		assert.Nil(t, err)
+		_, err = Export(fl, blobs, w)
+		assert.Nil(t, err)
+		assert.Nil(t, w.Close())
+
+		var r io.Reader = &archive
+		if format == FORMAT_TGZ {
+			r, err = gzip.NewReader(&archive)
+			assert.Nil(t, err)
+		}
+		headers, contents := readTar(t, r)
+
+		// tar has no type for sockets
+		assert.Equal(t, 6, len(headers))
+		assert.Nil(t, headers["socket"])
+
+		assert.Equal(t, byte(tar.TypeDir), headers["dir/"].Typeflag)
+		assert.Equal(t, "first", contents["a"])
+		assert.Equal(t, "second", contents["dir/b"])
+		assert.Equal(t, int64(0600), headers["dir/b"].Mode)
+
+		assert.Equal(t, byte(tar.TypeLink), headers["c"].Typeflag)
+		assert.Equal(t, "a", headers["c"].Linkname)
+		assert.Equal(t, "", contents["c"])
+
+		assert.Equal(t, byte(tar.TypeSymlink), headers["link"].Typeflag)
+		assert.Equal(t, "a", headers["link"].Linkname)
+		assert.Equal(t, byte(tar.TypeFifo), headers["fifo"].Typeflag)
+	}
+
+	// a hard link whose first file is left out is written as a file
+	var archive bytes.Buffer
+	w, _ := NewWriter(FORMAT_TAR, &archive)
+	count, err := Export(fl.Select([]string{"c"}), blobs, w)
+	assert.Nil(t, err)
+	assert.Nil(t, w.Close())
+	assert.Equal(t, uint64(1), count)
+
+	headers, contents := readTar(t, &archive)
+	assert.Equal(t, byte(tar.TypeReg), headers["c"].Typeflag)
+	assert.Equal(t, "first", contents["c"])
+
+	value, _ := fl.Files.Get("c")
+	assert.Equal(t, "a", value.(*filelist.FileMetadata).Link)
+}
+
+func TestExportZip(t *testing.T) {
+	root, _ := ioutil.TempDir("", "TestExportZip")
+	defer os.RemoveAll(root)
+	fl, blobs := testSnapshot(t, root)
+	defer blobs.Close()
+
+	var archive bytes.Buffer
+	w, err := NewWriter(FORMAT_ZIP, &archive)
+	assert.Nil(t, err)
+	_, err = Export(fl, blobs, w)
+	assert.Nil(t, err)
+	assert.Nil(t, w.Close())
+
+	zr, err := zip.NewReader(bytes.NewReader(archive.Bytes()), int64(archive.Len()))
+	assert.Nil(t, err)
+
+	files := make(map[string]*zip.File)
+	contents := make(map[string]string)
+	for _, file := range zr.File {
+		reader, err := file.Open()
+		assert.Nil(t, err)
+		data, _ := ioutil.ReadAll(reader)
+		reader.Close()
+
+		files[file.Name] = file
+		contents[file.Name] = string(data)
+	}
+	assert.Equal(t, 7, len(files))
+
+	assert.True(t, files["dir/"].Mode().IsDir())
+	assert.Equal(t, "first", contents["a"])
+	assert.Equal(t, "second", contents["dir/b"])
+	assert.Equal(t, os.FileMode(0600), files["dir/b"].Mode().Perm())
+
+	// zip has no hard links, so each one is a copy
+	assert.Equal(t, "first", contents["c"])
+
+	assert.NotZero(t, files["link"].Mode()&os.ModeSymlink)
+	assert.Equal(t, "a", contents["link"])
+	assert.NotZero(t, files["fifo"].Mode()&os.ModeNamedPipe)
+	assert.NotZero(t, files["socket"].Mode()&os.ModeSocket)
+}
@@ -20,24 +20,24 @@
 
 package filelist
 
-import (
-	"bytes"
-)
-
 // FileListDiff contains the paths of files that differ
-// between two file lists
+// between two file lists. Modified files have different contents;
+// Metadata files have the same contents but a different mode, owner,
+// modification time, extended attributes or ACLs.
 type FileListDiff struct {
 	Added    []string
 	Modified []string
+	Metadata []string
 	Deleted  []string
 }
 
 // Diff returns a FileListDiff structure that contains the paths
-// of files that were added, modified, or deleted between the old
-// file list and the new
+// of files that were added, modified, changed only in their metadata,
+// or deleted between the old file list and the new
 func Diff(old *FileList, new *FileList) *FileListDiff {
 	var added []string
 	var modified []string
+	var metadata []string
 	var deleted []string
 
 	it := old.Files.Iterator()
@@ -61,16 +61,17 @@ func Diff(old *FileList, new *FileList) *FileListDiff {
 		oldMetadata := oldMetadataInterface.(*FileMetadata)
 		newMetadata := it.Value().(*FileMetadata)
 
-		if bytes.Compare(oldMetadata.Hash, newMetadata.Hash) != 0 {
-			modified = append(modified, relPath)
-		} else if oldMetadata.Mode != newMetadata.Mode {
+		if !oldMetadata.SameContents(newMetadata) {
 			modified = append(modified, relPath)
+		} else if !oldMetadata.SameMetadata(newMetadata) {
+			metadata = append(metadata, relPath)
 		}
 	}
 
 	diff := FileListDiff{
 		Added:    added,
 		Modified: modified,
+		Metadata: metadata,
 		Deleted:  deleted,
 	}
 
@@ -75,7 +75,7 @@ func readRules(dir string) (*excludeRules, error) {
 	}
 
 	if f.Version != 1 {
-		errMsg := fmt.Sprintf("Ignore file version %u not supported: %s",
+		errMsg := fmt.Sprintf("Ignore file version %d not supported: %s",
 			f.Version, ignoreFilePath)
 		return nil, errors.New(errMsg)
 	}
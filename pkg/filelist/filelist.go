@@ -21,11 +21,17 @@
 package filelist
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/andybug/abakus/pkg/repo"
 	"github.com/emirpasic/gods/maps/treemap"
@@ -38,16 +44,200 @@ type FileList struct {
 	Files *treemap.Map
 }
 
+// types of entry in a FileList
+// TYPE_FILE - a regular file, whose contents are stored as blobs
+// TYPE_DIRECTORY - a directory, so that empty ones and the metadata of all
+// of them are kept. its contents are entries of their own
+// TYPE_SYMLINK - a symbolic link; nothing is stored but its target
+// TYPE_FIFO, TYPE_SOCKET - named pipes and unix sockets, which have no
+// contents to store
+// TYPE_CHAR_DEVICE, TYPE_BLOCK_DEVICE - device nodes, recorded with their
+// major and minor numbers
+const (
+	TYPE_FILE         = ""
+	TYPE_DIRECTORY    = "dir"
+	TYPE_SYMLINK      = "symlink"
+	TYPE_FIFO         = "fifo"
+	TYPE_SOCKET       = "socket"
+	TYPE_CHAR_DEVICE  = "chardev"
+	TYPE_BLOCK_DEVICE = "blockdev"
+)
+
+// what Scan does with FIFOs, sockets and devices
+// SPECIAL_RECORD - list them as entries without contents
+// SPECIAL_SKIP - leave them out
+const (
+	SPECIAL_RECORD = "record"
+	SPECIAL_SKIP   = "skip"
+)
+
+// IsSpecialPolicy returns true if policy is one of the SPECIAL_* policies
+func IsSpecialPolicy(policy string) bool {
+	return policy == SPECIAL_RECORD || policy == SPECIAL_SKIP
+}
+
 // FileMetadata describes a file in a FileList
-// Hash - binary digest (blake2b)
+// Type - one of the TYPE_* constants
+// Hash - binary digest (blake2b). nil for entries without contents
 // Size - size in bytes
 // Mode - octal unix mode
 // ModTime - unix time (seconds since epoch)
+// ModTimeNsec - nanoseconds after ModTime
+// ATime, CTime - access and status change times (ns since epoch)
+// UID, GID - numeric owner, and User, Group - their names when the file
+// was scanned, if known
+// Xattrs - extended attributes, other than ACLs
+// ACL, DefaultACL - POSIX access and default ACLs, in the kernel's xattr
+// encoding
+// Chunks - the chunks the contents are stored as, in order. Empty if the
+// contents are stored as a single blob named by Hash
+// Target - the path a symlink points to
+// Major, Minor - the device numbers of a device node
+// Link - for a regular file with hard links elsewhere in the list, the path
+// of the first entry of the group. Every entry in a link group has the same
+// Link, including the first
 type FileMetadata struct {
-	Hash    []byte `json:"hash"`
-	Size    uint64 `json:"size"`
-	Mode    uint32 `json:"mode"`
-	ModTime uint64 `json:"-"`
+	Type        string            `json:"type,omitempty"`
+	Hash        []byte            `json:"hash"`
+	Size        uint64            `json:"size"`
+	Mode        uint32            `json:"mode"`
+	ModTime     uint64            `json:"mtime"`
+	ModTimeNsec uint32            `json:"mtime_nsec,omitempty"`
+	ATime       int64             `json:"atime,omitempty"`
+	CTime       int64             `json:"ctime,omitempty"`
+	UID         uint32            `json:"uid,omitempty"`
+	GID         uint32            `json:"gid,omitempty"`
+	User        string            `json:"user,omitempty"`
+	Group       string            `json:"group,omitempty"`
+	Xattrs      map[string][]byte `json:"xattrs,omitempty"`
+	ACL         []byte            `json:"acl,omitempty"`
+	DefaultACL  []byte            `json:"default_acl,omitempty"`
+	Chunks      []Chunk           `json:"chunks,omitempty"`
+	Target      string            `json:"target,omitempty"`
+	Major       uint32            `json:"major,omitempty"`
+	Minor       uint32            `json:"minor,omitempty"`
+	Link        string            `json:"link,omitempty"`
+}
+
+// ScanOptions controls which files Scan lists and how
+// FollowSymlinks - list a symlink to a regular file as the file it points
+// to, instead of as a symlink
+// Special - one of the SPECIAL_* policies; empty means SPECIAL_RECORD
+// Skipped - if not nil, called with the relative path of each file that
+// SPECIAL_SKIP leaves out
+type ScanOptions struct {
+	FollowSymlinks bool
+	Special        string
+	Skipped        func(relPath string)
+}
+
+// Chunk is a piece of a file's contents that is stored as its own blob
+// Hash - binary digest (blake2b) of the chunk
+// Size - size in bytes
+type Chunk struct {
+	Hash []byte `json:"hash"`
+	Size uint64 `json:"size"`
+}
+
+// IsRegular returns true if the entry is a regular file with contents
+func (metadata *FileMetadata) IsRegular() bool {
+	return metadata.Type == TYPE_FILE
+}
+
+// SameContents returns true if both entries are of the same type and have
+// the same contents, point to the same target or are the same device
+func (metadata *FileMetadata) SameContents(other *FileMetadata) bool {
+	return metadata.Type == other.Type &&
+		bytes.Equal(metadata.Hash, other.Hash) &&
+		metadata.Target == other.Target &&
+		metadata.Major == other.Major &&
+		metadata.Minor == other.Minor
+}
+
+// SameMetadata returns true if both entries have the same mode, owner,
+// modification time, extended attributes, ACLs and hard link. Access and
+// change times are left out, since reading or changing the file moves them
+// anyway.
+func (metadata *FileMetadata) SameMetadata(other *FileMetadata) bool {
+	if metadata.Mode != other.Mode ||
+		metadata.UID != other.UID || metadata.GID != other.GID ||
+		!metadata.MTime().Equal(other.MTime()) ||
+		!bytes.Equal(metadata.ACL, other.ACL) ||
+		!bytes.Equal(metadata.DefaultACL, other.DefaultACL) ||
+		metadata.Link != other.Link ||
+		len(metadata.Xattrs) != len(other.Xattrs) {
+		return false
+	}
+
+	for name, value := range metadata.Xattrs {
+		otherValue, ok := other.Xattrs[name]
+		if !ok || !bytes.Equal(value, otherValue) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// MTime returns the modification time
+func (metadata *FileMetadata) MTime() time.Time {
+	return time.Unix(int64(metadata.ModTime), int64(metadata.ModTimeNsec))
+}
+
+// SetMTime sets the modification time
+func (metadata *FileMetadata) SetMTime(mtime time.Time) {
+	metadata.ModTime = uint64(mtime.Unix())
+	metadata.ModTimeNsec = uint32(mtime.Nanosecond())
+}
+
+// IsDevice returns true if the entry is a character or block device
+func (metadata *FileMetadata) IsDevice() bool {
+	return metadata.Type == TYPE_CHAR_DEVICE || metadata.Type == TYPE_BLOCK_DEVICE
+}
+
+// SpecialMetadata returns the metadata of a FIFO, socket or device from its
+// Lstat info, or nil if it is some other kind of file
+func SpecialMetadata(info os.FileInfo) *FileMetadata {
+	metadata := &FileMetadata{
+		Mode:    uint32(info.Mode()),
+		ModTime: uint64(info.ModTime().Unix()),
+	}
+
+	mode := info.Mode()
+	switch {
+	case mode&os.ModeNamedPipe != 0:
+		metadata.Type = TYPE_FIFO
+	case mode&os.ModeSocket != 0:
+		metadata.Type = TYPE_SOCKET
+	case mode&os.ModeCharDevice != 0:
+		metadata.Type = TYPE_CHAR_DEVICE
+		metadata.Major, metadata.Minor = deviceOf(info)
+	case mode&os.ModeDevice != 0:
+		metadata.Type = TYPE_BLOCK_DEVICE
+		metadata.Major, metadata.Minor = deviceOf(info)
+	default:
+		return nil
+	}
+
+	return metadata
+}
+
+// Blobs returns the hashes of the blobs that hold the file's contents
+func (metadata *FileMetadata) Blobs() [][]byte {
+	if !metadata.IsRegular() {
+		return nil
+	}
+
+	if len(metadata.Chunks) == 0 {
+		return [][]byte{metadata.Hash}
+	}
+
+	hashes := make([][]byte, len(metadata.Chunks))
+	for i, chunk := range metadata.Chunks {
+		hashes[i] = chunk.Hash
+	}
+
+	return hashes
 }
 
 // New creates an empty FileList
@@ -60,10 +250,28 @@ func New() *FileList {
 // NewFromRoot creates a FileList that includes all of the non-explicitly ignored
 // files under the root of the repository
 func NewFromRoot(root string) (*FileList, error) {
+	fl, err := Scan(root, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = fl.Hash(root, runtime.GOMAXPROCS(0)); err != nil {
+		return nil, err
+	}
+
+	return fl, nil
+}
+
+// Scan creates a FileList like NewFromRoot, but without reading the files,
+// so the metadata has no hashes. opts may be nil for the defaults.
+func Scan(root string, opts *ScanOptions) (*FileList, error) {
 	root, err := filepath.Abs(root)
 	if err != nil {
 		return nil, err
 	}
+	if opts == nil {
+		opts = &ScanOptions{}
+	}
 
 	// create an exclusion rule for the home dir
 	ignoreHome := newExcludeRules(root)
@@ -72,22 +280,161 @@ func NewFromRoot(root string) (*FileList, error) {
 	esr.push(ignoreHome)
 
 	fl := New()
-	fl.addTree(root, root, esr)
+	links := make(map[inode][]string)
+	if err = fl.addTree(root, root, esr, opts, links); err != nil {
+		return nil, err
+	}
+	fl.linkGroups(links)
 
 	return fl, nil
 }
 
+// Hash hashes the regular files in the list that have no hash yet, with up
+// to jobs files read at once. A hard link group is only read once.
+func (fl *FileList) Hash(root string, jobs int) error {
+	err := fl.ForEach(jobs, func(relPath string, metadata *FileMetadata) error {
+		if metadata.Hash != nil || !metadata.IsRegular() || metadata.LinkedTo(relPath) != "" {
+			return nil
+		}
+
+		hash, err := HashFile(filepath.Join(root, relPath))
+		if err != nil {
+			return err
+		}
+
+		metadata.Hash = hash
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	fl.ShareLinks()
+	return nil
+}
+
+// ForEach calls fn for every file in the list from a pool of jobs
+// goroutines. fn may change the metadata it is given, but not the list.
+// It returns the first error from fn, after which no more files are started.
+func (fl *FileList) ForEach(jobs int, fn func(relPath string, metadata *FileMetadata) error) error {
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	type file struct {
+		relPath  string
+		metadata *FileMetadata
+	}
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var first error
+	failed := make(chan struct{})
+	files := make(chan file)
+
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range files {
+				// the feeder may still hand out a file after a failure
+				select {
+				case <-failed:
+					continue
+				default:
+				}
+
+				if err := fn(f.relPath, f.metadata); err != nil {
+					once.Do(func() {
+						first = err
+						close(failed)
+					})
+				}
+			}
+		}()
+	}
+
+	it := fl.Files.Iterator()
+feed:
+	for it.Next() {
+		select {
+		case files <- file{it.Key().(string), it.Value().(*FileMetadata)}:
+		case <-failed:
+			break feed
+		}
+	}
+	close(files)
+	wg.Wait()
+
+	return first
+}
+
 // Add adds file at relative path to the file list with the given metadata
 // the filelist maps path -> metadata
 func (fl *FileList) Add(relPath string, metadata *FileMetadata) {
 	fl.Files.Put(relPath, metadata)
 }
 
+// Select returns a new FileList with only the entries that are at one of the
+// relative paths or inside one of them. An empty list selects every entry.
+func (fl *FileList) Select(paths []string) *FileList {
+	if len(paths) == 0 {
+		return fl
+	}
+
+	selected := New()
+	it := fl.Files.Iterator()
+	for it.Next() {
+		relPath := it.Key().(string)
+		for _, path := range paths {
+			path = filepath.Clean(path)
+			if path == "." || path == relPath ||
+				strings.HasPrefix(relPath, path+string(filepath.Separator)) {
+				selected.Add(relPath, it.Value().(*FileMetadata))
+				break
+			}
+		}
+	}
+
+	return selected
+}
+
+// CheckPaths returns an error if any path in the list could lead outside of
+// the directory it is restored into: one that is absolute, not clean,
+// contains a ".." element or is inside an entry that is not a directory.
+// File lists from elsewhere, such as pulled snapshots, must pass it.
+func (fl *FileList) CheckPaths() error {
+	it := fl.Files.Iterator()
+	for it.Next() {
+		relPath := it.Key().(string)
+		if relPath == "" || filepath.IsAbs(relPath) || filepath.Clean(relPath) != relPath {
+			return errors.New(fmt.Sprintf("Invalid path %q in file list", relPath))
+		}
+
+		for _, element := range strings.Split(relPath, string(filepath.Separator)) {
+			if element == ".." {
+				return errors.New(fmt.Sprintf("Invalid path %q in file list", relPath))
+			}
+		}
+
+		for dir := filepath.Dir(relPath); dir != "."; dir = filepath.Dir(dir) {
+			value, found := fl.Files.Get(dir)
+			if found && value.(*FileMetadata).Type != TYPE_DIRECTORY {
+				errMsg := fmt.Sprintf("Invalid path %q in file list: %s is not a directory", relPath, dir)
+				return errors.New(errMsg)
+			}
+		}
+	}
+
+	return nil
+}
+
 // addTree adds all of the files under that point to the FileList
 // root and dir must be absolute paths, and dir must be under root
 // addTree will use the stack to keep track of what exclusions apply
-// to different directories as it walks the file system
-func (fl *FileList) addTree(root string, dir string, stack *excludeRulesStack) error {
+// to different directories as it walks the file system, and adds the
+// relative paths of regular files with more than one link to links
+func (fl *FileList) addTree(root string, dir string, stack *excludeRulesStack, opts *ScanOptions, links map[inode][]string) error {
 	rules, err := readRules(dir)
 	if err != nil {
 		return err
@@ -110,25 +457,58 @@ func (fl *FileList) addTree(root string, dir string, stack *excludeRulesStack) e
 			continue
 		}
 
-		if file.IsDir() {
-			err = fl.addTree(root, absFilePath, stack)
+		var metadata *FileMetadata
+		followed := false
+
+		// symlinks are never followed into directories, so the walk
+		// cannot loop
+		if file.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(absFilePath)
 			if err != nil {
 				return err
 			}
-		} else {
-			hash, err := hashFile(absFilePath)
-			if err != nil {
-				return err
+
+			info, err := os.Stat(absFilePath)
+			if !opts.FollowSymlinks || err != nil || !info.Mode().IsRegular() {
+				metadata = &FileMetadata{Type: TYPE_SYMLINK, Target: target}
+			} else {
+				file = info
+				followed = true
 			}
+		}
+
+		if metadata == nil {
+			if special := SpecialMetadata(file); special != nil {
+				// special files are never opened, since that can block
+				if opts.Special == SPECIAL_SKIP {
+					if opts.Skipped != nil {
+						opts.Skipped(relFilePath)
+					}
+					continue
+				}
+				metadata = special
+			} else if file.IsDir() {
+				metadata = &FileMetadata{Type: TYPE_DIRECTORY}
+			} else {
+				metadata = &FileMetadata{Size: uint64(file.Size())}
 
-			metadata := FileMetadata{
-				Hash:    hash,
-				Size:    uint64(file.Size()),
-				Mode:    uint32(file.Mode()),
-				ModTime: uint64(file.ModTime().Unix()),
+				// a followed symlink is a copy of its target, not a link
+				if linkCount(file) > 1 && !followed {
+					id := inodeOf(file)
+					links[id] = append(links[id], relFilePath)
+				}
 			}
+		}
 
-			fl.Add(relFilePath, &metadata)
+		if err = statMetadata(absFilePath, file, metadata); err != nil {
+			return err
+		}
+		fl.Add(relFilePath, metadata)
+
+		if metadata.Type == TYPE_DIRECTORY {
+			if err = fl.addTree(root, absFilePath, stack, opts, links); err != nil {
+				return err
+			}
 		}
 	}
 
@@ -137,10 +517,12 @@ func (fl *FileList) addTree(root string, dir string, stack *excludeRulesStack) e
 
 // MerkleRoot calculates the blake2b root hash of a tree
 // built from the filelist (like bitcoin). The MerkleRoot
-// function hashes each file path/content hash and adds them
-// to an array. This array represents the leaves in the
-// merkle tree. The array is passed to the merkleTree function
-// to calculate the merkle hash of the subtree.
+// function hashes each file path/content hash (or path/type/target
+// and device numbers for other entries, and the first path of a
+// hard link group) and adds them to an array.
+// This array represents the leaves in the merkle tree. The array is
+// passed to the merkleTree function to calculate the merkle hash of
+// the subtree.
 func (fl *FileList) MerkleRoot() []byte {
 	hasher, _ := blake2b.New256(nil)
 	var hashes [][]byte
@@ -152,6 +534,17 @@ func (fl *FileList) MerkleRoot() []byte {
 
 		hasher.Write([]byte(path))
 		hasher.Write(metadata.Hash)
+		if !metadata.IsRegular() {
+			// paths never contain a NUL, so this cannot be mistaken
+			// for the leaf of another path
+			hasher.Write([]byte("\x00" + metadata.Type + "\x00" + metadata.Target))
+		}
+		if metadata.IsDevice() {
+			hasher.Write([]byte(fmt.Sprintf("\x00%d:%d", metadata.Major, metadata.Minor)))
+		}
+		if metadata.Link != "" {
+			hasher.Write([]byte("\x00link\x00" + metadata.Link))
+		}
 		sum := hasher.Sum(nil)
 		hasher.Reset()
 
@@ -163,6 +556,11 @@ func (fl *FileList) MerkleRoot() []byte {
 
 // merkleTree recursively calculates the merkle hash of a subtree
 func merkleTree(hashes [][]byte) []byte {
+	// an empty file list has the hash of nothing as its root
+	if len(hashes) == 0 {
+		sum := blake2b.Sum256(nil)
+		return sum[:]
+	}
 	if len(hashes) == 1 {
 		return hashes[0]
 	}
@@ -183,8 +581,8 @@ func merkleTree(hashes [][]byte) []byte {
 	return merkleTree(newHashes)
 }
 
-// hashFile returns the blake2b hash of a file on disk
-func hashFile(path string) ([]byte, error) {
+// HashFile returns the blake2b hash of a file on disk
+func HashFile(path string) ([]byte, error) {
 	f, err := os.Open(path)
 	if err != nil {
 		return nil, err
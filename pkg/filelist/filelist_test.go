@@ -0,0 +1,117 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package filelist
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScanSymlinks(t *testing.T) {
+	root, _ := ioutil.TempDir("", "TestScanSymlinks")
+	defer os.RemoveAll(root)
+
+	os.Mkdir(filepath.Join(root, "dir"), 0755)
+	ioutil.WriteFile(filepath.Join(root, "dir", "file"), []byte("contents"), 0644)
+	os.Symlink("dir/file", filepath.Join(root, "link"))
+	os.Symlink("missing", filepath.Join(root, "dangling"))
+	os.Symlink("dir", filepath.Join(root, "dirlink"))
+
+	// a dangling symlink does not stop the walk, and no link is read
+	fl, err := NewFromRoot(root)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, fl.Files.Size())
+
+	for path, target := range map[string]string{"link": "dir/file", "dangling": "missing", "dirlink": "dir"} {
+		value, _ := fl.Files.Get(path)
+		metadata := value.(*FileMetadata)
+		assert.Equal(t, TYPE_SYMLINK, metadata.Type)
+		assert.Equal(t, target, metadata.Target)
+		assert.Nil(t, metadata.Hash)
+		assert.Nil(t, metadata.Blobs())
+	}
+
+	// the target is part of the merkle root
+	before := fl.MerkleRoot()
+	os.Remove(filepath.Join(root, "link"))
+	os.Symlink("dir/other", filepath.Join(root, "link"))
+	fl, err = NewFromRoot(root)
+	assert.Nil(t, err)
+	assert.NotEqual(t, before, fl.MerkleRoot())
+
+	// only a link to a regular file is followed
+	os.Remove(filepath.Join(root, "link"))
+	os.Symlink("dir/file", filepath.Join(root, "link"))
+	fl, err = Scan(root, &ScanOptions{FollowSymlinks: true})
+	assert.Nil(t, err)
+	assert.Nil(t, fl.Hash(root, 1))
+
+	value, _ := fl.Files.Get("link")
+	assert.True(t, value.(*FileMetadata).IsRegular())
+	assert.Equal(t, uint64(8), value.(*FileMetadata).Size)
+	file, _ := fl.Files.Get("dir/file")
+	assert.Equal(t, file.(*FileMetadata).Hash, value.(*FileMetadata).Hash)
+
+	value, _ = fl.Files.Get("dirlink")
+	assert.Equal(t, TYPE_SYMLINK, value.(*FileMetadata).Type)
+}
+
+func TestScanDirectories(t *testing.T) {
+	root, _ := ioutil.TempDir("", "TestScanDirectories")
+	defer os.RemoveAll(root)
+
+	os.MkdirAll(filepath.Join(root, "dir", "empty"), 0700)
+	ioutil.WriteFile(filepath.Join(root, "dir", "file"), []byte("contents"), 0644)
+
+	fl, err := NewFromRoot(root)
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{"dir", "dir/empty", "dir/file"}, fl.Files.Keys())
+
+	value, _ := fl.Files.Get("dir/empty")
+	empty := value.(*FileMetadata)
+	assert.Equal(t, TYPE_DIRECTORY, empty.Type)
+	assert.Equal(t, os.FileMode(0700), os.FileMode(empty.Mode).Perm())
+	assert.Nil(t, empty.Hash)
+	assert.Nil(t, empty.Blobs())
+
+	// an empty directory is part of the merkle root
+	before := fl.MerkleRoot()
+	os.Remove(filepath.Join(root, "dir", "empty"))
+	fl, err = NewFromRoot(root)
+	assert.Nil(t, err)
+	assert.NotEqual(t, before, fl.MerkleRoot())
+
+	// a directory's metadata changes with its contents
+	old := fl
+	ioutil.WriteFile(filepath.Join(root, "dir", "other"), []byte("contents"), 0644)
+	os.Chtimes(filepath.Join(root, "dir"), time.Unix(1, 0), time.Unix(1, 0))
+	fl, err = NewFromRoot(root)
+	assert.Nil(t, err)
+
+	diff := Diff(old, fl)
+	assert.Equal(t, []string{"dir/other"}, diff.Added)
+	assert.Equal(t, []string{"dir"}, diff.Metadata)
+}
@@ -0,0 +1,90 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package filelist
+
+import (
+	"os"
+	"sort"
+)
+
+// inode identifies a file by its device and inode numbers
+type inode struct {
+	device uint64
+	inode  uint64
+}
+
+// inodeOf returns the device and inode numbers of the file
+func inodeOf(info os.FileInfo) inode {
+	stat := statOf(info)
+	return inode{device: stat.Device, inode: stat.Inode}
+}
+
+// linkGroups sets the Link of every path in each group of hard links found
+// by addTree to the first of them, as the list sorts them. A file with
+// other links outside of the scanned tree is left alone.
+func (fl *FileList) linkGroups(links map[inode][]string) {
+	for _, paths := range links {
+		if len(paths) < 2 {
+			continue
+		}
+
+		sort.Strings(paths)
+		for _, relPath := range paths {
+			value, _ := fl.Files.Get(relPath)
+			value.(*FileMetadata).Link = paths[0]
+		}
+	}
+}
+
+// LinkedTo returns the path of the earlier entry that the entry at relPath
+// is a hard link to, or "" if there is none
+func (metadata *FileMetadata) LinkedTo(relPath string) string {
+	if metadata.Link == relPath {
+		return ""
+	}
+
+	return metadata.Link
+}
+
+// ShareLinks copies the contents of the first entry of each hard link
+// group to the others, which are never read themselves
+func (fl *FileList) ShareLinks() {
+	it := fl.Files.Iterator()
+	for it.Next() {
+		metadata := it.Value().(*FileMetadata)
+		link := metadata.LinkedTo(it.Key().(string))
+		if link == "" {
+			continue
+		}
+
+		value, found := fl.Files.Get(link)
+		if !found {
+			continue
+		}
+
+		first := value.(*FileMetadata)
+		metadata.Hash = first.Hash
+		metadata.Size = first.Size
+		metadata.ModTime = first.ModTime
+		metadata.ModTimeNsec = first.ModTimeNsec
+		metadata.Chunks = first.Chunks
+	}
+}
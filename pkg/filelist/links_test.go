@@ -0,0 +1,78 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+//go:build linux
+// +build linux
+
+package filelist
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScanHardLinks(t *testing.T) {
+	root, _ := ioutil.TempDir("", "TestScanHardLinks")
+	defer os.RemoveAll(root)
+
+	os.Mkdir(filepath.Join(root, "dir"), 0755)
+	ioutil.WriteFile(filepath.Join(root, "dir", "file"), []byte("contents"), 0644)
+	os.Link(filepath.Join(root, "dir", "file"), filepath.Join(root, "a"))
+	os.Link(filepath.Join(root, "dir", "file"), filepath.Join(root, "z"))
+	ioutil.WriteFile(filepath.Join(root, "other"), []byte("contents"), 0644)
+
+	// the group is named by the first path in the list, not the walk
+	fl, err := NewFromRoot(root)
+	assert.Nil(t, err)
+	for _, relPath := range []string{"a", "dir/file", "z"} {
+		value, _ := fl.Files.Get(relPath)
+		metadata := value.(*FileMetadata)
+		assert.Equal(t, "a", metadata.Link)
+		assert.NotNil(t, metadata.Hash)
+	}
+
+	value, _ := fl.Files.Get("a")
+	assert.Equal(t, "", value.(*FileMetadata).LinkedTo("a"))
+	value, _ = fl.Files.Get("z")
+	assert.Equal(t, "a", value.(*FileMetadata).LinkedTo("z"))
+
+	// a copy with the same contents is not a link
+	value, _ = fl.Files.Get("other")
+	assert.Equal(t, "", value.(*FileMetadata).Link)
+
+	// only the first file of a group is read
+	fl, err = Scan(root, nil)
+	assert.Nil(t, err)
+	os.Remove(filepath.Join(root, "z"))
+	assert.Nil(t, fl.Hash(root, 1))
+	value, _ = fl.Files.Get("z")
+	assert.NotNil(t, value.(*FileMetadata).Hash)
+
+	// breaking a link changes the merkle root
+	before := fl.MerkleRoot()
+	ioutil.WriteFile(filepath.Join(root, "z"), []byte("contents"), 0644)
+	fl, err = NewFromRoot(root)
+	assert.Nil(t, err)
+	assert.NotEqual(t, before, fl.MerkleRoot())
+}
@@ -0,0 +1,90 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package filelist
+
+import (
+	"os"
+	"os/user"
+	"strconv"
+	"sync"
+)
+
+// the extended attributes that hold POSIX ACLs on linux
+const (
+	XATTR_ACL_ACCESS  = "system.posix_acl_access"
+	XATTR_ACL_DEFAULT = "system.posix_acl_default"
+)
+
+// names caches the user and group names of the ids seen by statMetadata
+var names = struct {
+	sync.Mutex
+	users  map[uint32]string
+	groups map[uint32]string
+}{users: make(map[uint32]string), groups: make(map[uint32]string)}
+
+// statMetadata fills in the mode, times, owner, extended attributes and
+// ACLs of a file from its info. Symlinks have no extended attributes of
+// their own.
+func statMetadata(absPath string, info os.FileInfo, metadata *FileMetadata) error {
+	metadata.Mode = uint32(info.Mode())
+	metadata.SetMTime(info.ModTime())
+	ownerAndTimes(info, metadata)
+	metadata.User = userName(metadata.UID)
+	metadata.Group = groupName(metadata.GID)
+
+	if metadata.Type == TYPE_SYMLINK {
+		return nil
+	}
+	return readXattrs(absPath, metadata)
+}
+
+// userName returns the name of the user with the uid, or "" if there is none
+func userName(uid uint32) string {
+	names.Lock()
+	defer names.Unlock()
+
+	name, ok := names.users[uid]
+	if !ok {
+		if u, err := user.LookupId(strconv.FormatUint(uint64(uid), 10)); err == nil {
+			name = u.Username
+		}
+		names.users[uid] = name
+	}
+
+	return name
+}
+
+// groupName returns the name of the group with the gid, or "" if there is
+// none
+func groupName(gid uint32) string {
+	names.Lock()
+	defer names.Unlock()
+
+	name, ok := names.groups[gid]
+	if !ok {
+		if g, err := user.LookupGroupId(strconv.FormatUint(uint64(gid), 10)); err == nil {
+			name = g.Name
+		}
+		names.groups[gid] = name
+	}
+
+	return name
+}
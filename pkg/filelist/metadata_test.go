@@ -0,0 +1,79 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+//go:build linux
+// +build linux
+
+package filelist
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScanMetadata(t *testing.T) {
+	root, _ := ioutil.TempDir("", "TestScanMetadata")
+	defer os.RemoveAll(root)
+
+	path := filepath.Join(root, "file")
+	ioutil.WriteFile(path, []byte("contents"), 0640)
+	mtime := time.Unix(1500000000, 123456789)
+	os.Chtimes(path, mtime, mtime)
+
+	fl, err := NewFromRoot(root)
+	assert.Nil(t, err)
+
+	value, _ := fl.Files.Get("file")
+	metadata := value.(*FileMetadata)
+	assert.Equal(t, uint32(os.Getuid()), metadata.UID)
+	assert.Equal(t, uint32(os.Getgid()), metadata.GID)
+	assert.True(t, mtime.Equal(metadata.MTime()))
+	assert.Equal(t, mtime.UnixNano(), metadata.ATime)
+	assert.NotZero(t, metadata.CTime)
+
+	// a chmod only changes the metadata
+	os.Chmod(path, 0600)
+	changed, err := NewFromRoot(root)
+	assert.Nil(t, err)
+	assert.Nil(t, changed.Hash(root, 1))
+	assert.Nil(t, fl.Hash(root, 1))
+
+	diff := Diff(fl, changed)
+	assert.Empty(t, diff.Modified)
+	assert.Equal(t, []string{"file"}, diff.Metadata)
+
+	// tmpfs only has user xattrs on recent kernels
+	err = syscall.Setxattr(path, "user.abakus", []byte("value"), 0)
+	if err == syscall.ENOTSUP {
+		t.Skip("no user xattrs on", root)
+	}
+	assert.Nil(t, err)
+
+	fl, err = NewFromRoot(root)
+	assert.Nil(t, err)
+	value, _ = fl.Files.Get("file")
+	assert.Equal(t, map[string][]byte{"user.abakus": []byte("value")}, value.(*FileMetadata).Xattrs)
+}
@@ -0,0 +1,126 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+//go:build linux
+// +build linux
+
+package filelist
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScanSpecial(t *testing.T) {
+	root, _ := ioutil.TempDir("", "TestScanSpecial")
+	defer os.RemoveAll(root)
+
+	ioutil.WriteFile(filepath.Join(root, "file"), []byte("contents"), 0644)
+	assert.Nil(t, syscall.Mkfifo(filepath.Join(root, "fifo"), 0600))
+	listener, err := net.Listen("unix", filepath.Join(root, "socket"))
+	assert.Nil(t, err)
+	defer listener.Close()
+
+	// nothing opens the fifo, which would block with no writer
+	fl, err := NewFromRoot(root)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, fl.Files.Size())
+
+	value, _ := fl.Files.Get("fifo")
+	fifo := value.(*FileMetadata)
+	assert.Equal(t, TYPE_FIFO, fifo.Type)
+	assert.Equal(t, os.FileMode(0600), os.FileMode(fifo.Mode).Perm())
+	assert.Nil(t, fifo.Hash)
+	assert.Nil(t, fifo.Blobs())
+
+	value, _ = fl.Files.Get("socket")
+	assert.Equal(t, TYPE_SOCKET, value.(*FileMetadata).Type)
+
+	// a fifo and a socket at the same path are different entries
+	other := *fifo
+	other.Type = TYPE_SOCKET
+	assert.False(t, fifo.SameContents(&other))
+
+	var skipped []string
+	fl, err = Scan(root, &ScanOptions{
+		Special: SPECIAL_SKIP,
+		Skipped: func(relPath string) { skipped = append(skipped, relPath) },
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{"file"}, fl.Files.Keys())
+	assert.Equal(t, []string{"fifo", "socket"}, skipped)
+}
+
+func TestDeviceOf(t *testing.T) {
+	info, err := os.Lstat("/dev/null")
+	if err != nil {
+		t.Skip("no /dev/null")
+	}
+
+	metadata := SpecialMetadata(info)
+	assert.Equal(t, TYPE_CHAR_DEVICE, metadata.Type)
+	assert.Equal(t, uint32(1), metadata.Major)
+	assert.Equal(t, uint32(3), metadata.Minor)
+}
+
+func TestGetXattrValue(t *testing.T) {
+	// an attribute that appears after an empty size query is not sliced
+	// past the empty buffer
+	calls := 0
+	value, err := getXattrValue("path", func(path string, dest []byte) (int, error) {
+		calls += 1
+		if calls == 1 {
+			return 0, nil
+		}
+		return 5, nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{}, value)
+	assert.Equal(t, 1, calls)
+
+	// a value that grew between the calls is read again
+	sizes := []int{2, 3}
+	value, err = getXattrValue("path", func(path string, dest []byte) (int, error) {
+		if dest == nil {
+			size := sizes[0]
+			sizes = sizes[1:]
+			return size, nil
+		}
+		if len(dest) < 3 {
+			return 0, syscall.ERANGE
+		}
+		return copy(dest, "abc"), nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("abc"), value)
+
+	// errors other than an unsupported filesystem are not ignored
+	_, err = getXattrValue("path", func(path string, dest []byte) (int, error) {
+		return 0, syscall.EACCES
+	})
+	assert.Equal(t, syscall.EACCES, err)
+	assert.NotNil(t, readXattrs(filepath.Join(os.TempDir(), "TestGetXattrValue-missing"), &FileMetadata{}))
+}
@@ -0,0 +1,81 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+//go:build linux
+// +build linux
+
+package filelist
+
+import (
+	"os"
+	"syscall"
+)
+
+// statOf returns the parts of the file's stat that the stat cache compares
+func statOf(info os.FileInfo) fileStat {
+	stat := fileStat{
+		Size:  info.Size(),
+		MTime: info.ModTime().UnixNano(),
+	}
+
+	if sys, ok := info.Sys().(*syscall.Stat_t); ok {
+		stat.CTime = sys.Ctim.Nano()
+		stat.Inode = uint64(sys.Ino)
+		stat.Device = uint64(sys.Dev)
+	}
+
+	return stat
+}
+
+// ownerAndTimes fills in the owner and the access and change times
+func ownerAndTimes(info os.FileInfo, metadata *FileMetadata) {
+	sys, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+
+	metadata.UID = sys.Uid
+	metadata.GID = sys.Gid
+	metadata.ATime = sys.Atim.Nano()
+	metadata.CTime = sys.Ctim.Nano()
+}
+
+// linkCount returns the number of hard links to the file
+func linkCount(info os.FileInfo) uint64 {
+	sys, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 1
+	}
+
+	return uint64(sys.Nlink)
+}
+
+// deviceOf returns the major and minor numbers of a device node
+func deviceOf(info os.FileInfo) (uint32, uint32) {
+	sys, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0
+	}
+
+	rdev := uint64(sys.Rdev)
+	major := uint32((rdev>>8)&0xfff) | uint32((rdev>>32)&^0xfff)
+	minor := uint32(rdev&0xff) | uint32((rdev>>12)&^0xff)
+	return major, minor
+}
@@ -0,0 +1,54 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+//go:build !linux
+// +build !linux
+
+package filelist
+
+import (
+	"os"
+)
+
+// statOf returns the parts of the file's stat that the stat cache compares.
+// Only the size and mtime are portable.
+func statOf(info os.FileInfo) fileStat {
+	return fileStat{
+		Size:  info.Size(),
+		MTime: info.ModTime().UnixNano(),
+	}
+}
+
+// ownerAndTimes fills in the owner and the access and change times, which
+// are not known on this platform
+func ownerAndTimes(info os.FileInfo, metadata *FileMetadata) {
+}
+
+// linkCount returns the number of hard links to the file, which is not known
+// on this platform, so no hard links are found
+func linkCount(info os.FileInfo) uint64 {
+	return 1
+}
+
+// deviceOf returns the major and minor numbers of a device node, which are
+// not known on this platform
+func deviceOf(info os.FileInfo) (uint32, uint32) {
+	return 0, 0
+}
@@ -0,0 +1,206 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package filelist
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// STAT_CACHE_BUCKET is the bucket in the stat cache db that maps relative
+// paths to cache entries
+const STAT_CACHE_BUCKET = "files"
+
+// RACY_WINDOW is how long before a file was statted it must have last been
+// modified for its cached hash to be trusted. A file changed within the
+// same timestamp tick as it was statted could change again without its
+// mtime moving, as with git's racy index entries.
+const RACY_WINDOW = 2 * time.Second
+
+// fileStat is what the stat cache compares to decide that a file has not
+// changed since it was hashed. Inode, Device and CTime are zero where the
+// platform does not provide them.
+type fileStat struct {
+	Size   int64  `json:"size"`
+	MTime  int64  `json:"mtime"`
+	CTime  int64  `json:"ctime"`
+	Inode  uint64 `json:"inode"`
+	Device uint64 `json:"dev"`
+}
+
+// statCacheEntry is the stat of a file when it was last hashed
+// Checked - when the file was statted (ns since epoch)
+type statCacheEntry struct {
+	Stat    fileStat `json:"stat"`
+	Hash    []byte   `json:"hash"`
+	Checked int64    `json:"checked"`
+}
+
+// StatCache remembers the hash of each file in the working directory along
+// with its stat, so that files that have not changed need not be read again
+type StatCache struct {
+	db      *bolt.DB
+	checked int64
+	stats   map[string]fileStat
+}
+
+// OpenStatCache opens (creating if needed) the stat cache db at path
+func OpenStatCache(path string) (*StatCache, error) {
+	db, err := bolt.Open(path, 0644, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StatCache{db: db, stats: make(map[string]fileStat)}, nil
+}
+
+// Close closes the stat cache db
+func (cache *StatCache) Close() {
+	cache.db.Close()
+}
+
+// Fill stats every regular file in the list (following symlinks that were
+// listed as the files they point to) and gives those that match their
+// cache entry the cached hash. If rehash is true no hashes are filled, but
+// the stats are still taken for Update. It returns the number of files
+// filled.
+func (cache *StatCache) Fill(root string, fl *FileList, rehash bool) (uint64, error) {
+	var filled uint64 = 0
+	cache.checked = time.Now().UnixNano()
+
+	err := cache.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(STAT_CACHE_BUCKET))
+
+		it := fl.Files.Iterator()
+		for it.Next() {
+			relPath := it.Key().(string)
+			metadata := it.Value().(*FileMetadata)
+			if !metadata.IsRegular() {
+				continue
+			}
+
+			// a file removed since the scan fails when it is hashed
+			info, err := os.Stat(filepath.Join(root, relPath))
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return err
+			}
+			stat := statOf(info)
+			cache.stats[relPath] = stat
+
+			if rehash || bucket == nil {
+				continue
+			}
+
+			value := bucket.Get([]byte(relPath))
+			if value == nil {
+				continue
+			}
+
+			entry := new(statCacheEntry)
+			if err = json.Unmarshal(value, entry); err != nil {
+				return err
+			}
+
+			if entry.Stat == stat && !entry.racy() {
+				metadata.Hash = entry.Hash
+				filled += 1
+			}
+		}
+
+		return nil
+	})
+
+	return filled, err
+}
+
+// racy returns true if the file was modified so close to when it was
+// statted that a later change might not have moved its mtime
+func (entry *statCacheEntry) racy() bool {
+	return entry.Stat.MTime > entry.Checked-int64(RACY_WINDOW)
+}
+
+// Update replaces the cache with the hashes of the files in the list, paired
+// with the stats Fill took before they were hashed. Files without a hash
+// or that Fill did not stat are left out.
+func (cache *StatCache) Update(fl *FileList) error {
+	return cache.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(STAT_CACHE_BUCKET)) != nil {
+			if err := tx.DeleteBucket([]byte(STAT_CACHE_BUCKET)); err != nil {
+				return err
+			}
+		}
+
+		bucket, err := tx.CreateBucket([]byte(STAT_CACHE_BUCKET))
+		if err != nil {
+			return err
+		}
+
+		return cache.put(bucket, fl)
+	})
+}
+
+// Add adds the hashes of the files in the list to the cache, like Update
+// but keeping the entries of other files
+func (cache *StatCache) Add(fl *FileList) error {
+	return cache.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(STAT_CACHE_BUCKET))
+		if err != nil {
+			return err
+		}
+
+		return cache.put(bucket, fl)
+	})
+}
+
+// put writes an entry for each file in the list that has a hash and a stat
+func (cache *StatCache) put(bucket *bolt.Bucket, fl *FileList) error {
+	it := fl.Files.Iterator()
+	for it.Next() {
+		relPath := it.Key().(string)
+		metadata := it.Value().(*FileMetadata)
+
+		stat, ok := cache.stats[relPath]
+		if !ok || metadata.Hash == nil {
+			continue
+		}
+
+		value, err := json.Marshal(&statCacheEntry{
+			Stat:    stat,
+			Hash:    metadata.Hash,
+			Checked: cache.checked,
+		})
+		if err != nil {
+			return err
+		}
+
+		if err = bucket.Put([]byte(relPath), value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
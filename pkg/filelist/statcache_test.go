@@ -0,0 +1,90 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package filelist
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// cachedScan scans root and fills hashes from the cache, then hashes the
+// rest and updates the cache. It returns the list and the number filled.
+func cachedScan(t *testing.T, root string, dbPath string, rehash bool) (*FileList, uint64) {
+	fl, err := Scan(root, nil)
+	assert.Nil(t, err)
+
+	cache, err := OpenStatCache(dbPath)
+	assert.Nil(t, err)
+	defer cache.Close()
+
+	filled, err := cache.Fill(root, fl, rehash)
+	assert.Nil(t, err)
+	assert.Nil(t, fl.Hash(root, 2))
+	assert.Nil(t, cache.Update(fl))
+
+	return fl, filled
+}
+
+func TestStatCache(t *testing.T) {
+	root, _ := ioutil.TempDir("", "TestStatCache")
+	defer os.RemoveAll(root)
+	dbDir, _ := ioutil.TempDir("", "TestStatCacheDb")
+	defer os.RemoveAll(dbDir)
+	dbPath := filepath.Join(dbDir, "statcache.db")
+
+	old := time.Now().Add(-time.Hour)
+	for _, name := range []string{"a", "b", "c"} {
+		path := filepath.Join(root, name)
+		ioutil.WriteFile(path, []byte(name), 0644)
+		os.Chtimes(path, old, old)
+	}
+
+	_, filled := cachedScan(t, root, dbPath, false)
+	assert.Equal(t, uint64(0), filled)
+
+	fl, filled := cachedScan(t, root, dbPath, false)
+	assert.Equal(t, uint64(3), filled)
+	expected, _ := NewFromRoot(root)
+	assert.Equal(t, expected.MerkleRoot(), fl.MerkleRoot())
+
+	// a changed file is hashed again, even with the same size and mtime
+	path := filepath.Join(root, "b")
+	ioutil.WriteFile(path, []byte("B"), 0644)
+	os.Chtimes(path, old, old)
+	fl, filled = cachedScan(t, root, dbPath, false)
+	assert.Equal(t, uint64(2), filled)
+	expected, _ = NewFromRoot(root)
+	assert.Equal(t, expected.MerkleRoot(), fl.MerkleRoot())
+
+	// a file modified just before it was statted is not trusted
+	ioutil.WriteFile(filepath.Join(root, "c"), []byte("C"), 0644)
+	cachedScan(t, root, dbPath, false)
+	_, filled = cachedScan(t, root, dbPath, false)
+	assert.Equal(t, uint64(2), filled)
+
+	_, filled = cachedScan(t, root, dbPath, true)
+	assert.Equal(t, uint64(0), filled)
+}
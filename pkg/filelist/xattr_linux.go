@@ -0,0 +1,94 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+//go:build linux
+// +build linux
+
+package filelist
+
+import (
+	"strings"
+	"syscall"
+)
+
+// readXattrs fills in the extended attributes and ACLs of the file at path.
+// A filesystem without extended attributes has none to read.
+func readXattrs(path string, metadata *FileMetadata) error {
+	list, err := getXattrValue(path, syscall.Listxattr)
+	if err == syscall.ENOTSUP {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if len(list) == 0 {
+		return nil
+	}
+
+	for _, name := range strings.Split(strings.TrimRight(string(list), "\x00"), "\x00") {
+		value, err := getXattrValue(path, func(path string, dest []byte) (int, error) {
+			return syscall.Getxattr(path, name, dest)
+		})
+		if err == syscall.ENODATA {
+			// removed since the list was read
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		switch name {
+		case XATTR_ACL_ACCESS:
+			metadata.ACL = value
+		case XATTR_ACL_DEFAULT:
+			metadata.DefaultACL = value
+		default:
+			if metadata.Xattrs == nil {
+				metadata.Xattrs = make(map[string][]byte)
+			}
+			metadata.Xattrs[name] = value
+		}
+	}
+
+	return nil
+}
+
+// getXattrValue calls get (Listxattr or Getxattr) once to find the size of
+// the value and again to read it, starting over if it grew in between. An
+// empty value is not read again, since an empty buffer only asks the size.
+func getXattrValue(path string, get func(string, []byte) (int, error)) ([]byte, error) {
+	for {
+		size, err := get(path, nil)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return []byte{}, nil
+		}
+
+		value := make([]byte, size)
+		size, err = get(path, value)
+		if err == syscall.ERANGE {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		return value[:size], nil
+	}
+}
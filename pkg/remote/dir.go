@@ -0,0 +1,124 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package remote
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// dirRemote stores objects as files under a local (or mounted) directory
+type dirRemote struct {
+	root string
+}
+
+// newDirRemote returns a dirRemote rooted at the given directory
+func newDirRemote(root string) *dirRemote {
+	return &dirRemote{root: root}
+}
+
+// List walks the directory that contains the prefix and returns the names
+// of the files that begin with it
+func (d *dirRemote) List(prefix string) ([]string, error) {
+	var names []string
+	dir := filepath.Join(d.root, filepath.FromSlash(path.Dir(prefix+"_")))
+
+	err := filepath.Walk(dir, func(absPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".tmp-") {
+			return nil
+		}
+
+		relPath, _ := filepath.Rel(d.root, absPath)
+		name := filepath.ToSlash(relPath)
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+
+		return nil
+	})
+
+	return names, err
+}
+
+// Put writes the object to a temporary file and renames it into place so
+// that a partially written object is never visible
+func (d *dirRemote) Put(name string, r io.Reader) error {
+	absPath := d.path(name)
+	dir := filepath.Dir(absPath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), absPath)
+}
+
+// Get opens the file for the object
+func (d *dirRemote) Get(name string) (io.ReadCloser, error) {
+	f, err := os.Open(d.path(name))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+
+	return f, err
+}
+
+// Delete removes the file for the object
+func (d *dirRemote) Delete(name string) error {
+	err := os.Remove(d.path(name))
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+
+	return err
+}
+
+// path returns the absolute path of the file for the object
+func (d *dirRemote) path(name string) string {
+	return filepath.Join(d.root, filepath.FromSlash(name))
+}
@@ -0,0 +1,198 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package remote
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/andybug/abakus/pkg/crypt"
+)
+
+// ReadKeyFiles returns the key files stored on the remote by id
+func ReadKeyFiles(r Remote) (map[string]*crypt.KeyFile, error) {
+	names, err := r.List(KEYS_PREFIX)
+	if err != nil {
+		return nil, err
+	}
+
+	keyFiles := make(map[string]*crypt.KeyFile)
+	for _, name := range names {
+		data, err := readObject(r, name)
+		if err != nil {
+			return nil, err
+		}
+
+		keyFile, err := crypt.ParseKeyFile(data)
+		if err != nil {
+			return nil, err
+		}
+
+		id := strings.TrimSuffix(strings.TrimPrefix(name, KEYS_PREFIX), ".json")
+		keyFiles[id] = keyFile
+	}
+
+	return keyFiles, nil
+}
+
+// CheckKey returns an error if the remote is not protected by the same
+// master key as the repository. key is nil for an unencrypted repository.
+func CheckKey(r Remote, key *crypt.MasterKey) error {
+	keyFiles, err := ReadKeyFiles(r)
+	if err != nil {
+		return err
+	}
+
+	if key == nil {
+		if len(keyFiles) > 0 {
+			return errors.New("Remote is encrypted but the repository is not")
+		}
+		return nil
+	}
+
+	for _, keyFile := range keyFiles {
+		if keyFile.Master != key.Id() && !key.IsRetired(keyFile.Master) {
+			return errors.New("Remote is encrypted with a different master key")
+		}
+	}
+
+	if len(keyFiles) == 0 {
+		_, err := r.Get(MANIFEST)
+		if err == nil {
+			return errors.New("Remote is not encrypted but the repository is")
+		} else if err != ErrNotFound {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// PushKeys uploads the key files in dir that are not on the remote and
+// returns how many were uploaded. Key files on the remote for a master key
+// that has since been rotated are deleted.
+func PushKeys(r Remote, dir string, key *crypt.MasterKey) (int, error) {
+	remoteKeys, err := ReadKeyFiles(r)
+	if err != nil {
+		return 0, err
+	}
+
+	existing := make(map[string]bool)
+	for id, keyFile := range remoteKeys {
+		if key.IsRetired(keyFile.Master) {
+			if err = DeleteKeyFile(r, id); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		existing[KEYS_PREFIX+id+".json"] = true
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, entry := range entries {
+		name := KEYS_PREFIX + entry.Name()
+		if !strings.HasSuffix(entry.Name(), ".json") || existing[name] {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return count, err
+		}
+
+		if err = r.Put(name, bytes.NewReader(data)); err != nil {
+			return count, err
+		}
+		count += 1
+	}
+
+	return count, nil
+}
+
+// PullKeys downloads the key files on the remote that are not in dir and
+// returns how many were downloaded
+func PullKeys(r Remote, dir string) (int, error) {
+	names, err := r.List(KEYS_PREFIX)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, name := range names {
+		path := filepath.Join(dir, strings.TrimPrefix(name, KEYS_PREFIX))
+		if _, err := os.Stat(path); err == nil {
+			continue
+		}
+
+		data, err := readObject(r, name)
+		if err != nil {
+			return count, err
+		}
+
+		if _, err = crypt.ParseKeyFile(data); err != nil {
+			return count, err
+		}
+
+		if err = ioutil.WriteFile(path, data, 0600); err != nil {
+			return count, err
+		}
+		count += 1
+	}
+
+	return count, nil
+}
+
+// DeleteKeyFile removes the key file with the given id from the remote if
+// it is there
+func DeleteKeyFile(r Remote, id string) error {
+	err := r.Delete(KEYS_PREFIX + id + ".json")
+	if err == ErrNotFound {
+		return nil
+	}
+
+	return err
+}
+
+// readObject returns the contents of the named object
+func readObject(r Remote, name string) ([]byte, error) {
+	reader, err := r.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return ioutil.ReadAll(reader)
+}
@@ -0,0 +1,159 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package remote
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/andybug/abakus/pkg/crypt"
+	"github.com/andybug/abakus/pkg/repo"
+	"github.com/andybug/abakus/pkg/snapshot"
+)
+
+// MANIFEST is the name of the object that lists the snapshots on a remote
+const MANIFEST = "manifest.json"
+
+// MANIFEST_VERSION is the version of the manifest format
+const MANIFEST_VERSION uint32 = 1
+
+// BLOBS_PREFIX, SNAPSHOTS_PREFIX and KEYS_PREFIX are the prefixes of the
+// object names for blobs, snapshot file lists and wrapped master keys
+const (
+	BLOBS_PREFIX     = "blobs/"
+	SNAPSHOTS_PREFIX = "snapshots/"
+	KEYS_PREFIX      = "keys/"
+)
+
+// ErrNotFound is returned by Get when an object does not exist
+var ErrNotFound = errors.New("object not found")
+
+// Remote is the interface that remote storage mechanisms must implement.
+// Objects are addressed by slash separated names such as blobs/<name>.
+type Remote interface {
+	// List returns the names of all objects that begin with prefix
+	List(prefix string) ([]string, error)
+	// Put stores the contents of the reader as the named object,
+	// replacing it if it exists
+	Put(name string, r io.Reader) error
+	// Get returns a reader for the named object or ErrNotFound
+	Get(name string) (io.ReadCloser, error)
+	// Delete removes the named object
+	Delete(name string) error
+}
+
+// Manifest lists the snapshots that have been completely pushed to a remote
+type Manifest struct {
+	Version   uint32                                `json:"version"`
+	Snapshots map[uint64]*snapshot.SnapshotMetadata `json:"snapshots"`
+}
+
+// Open returns the Remote described by the config
+func Open(config *repo.RemoteConfig) (Remote, error) {
+	switch config.Type {
+	case "dir":
+		return newDirRemote(config.Location), nil
+	case "s3":
+		return newS3Remote(config)
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown remote type '%s'", config.Type))
+	}
+}
+
+// ReadManifest reads the manifest from the remote. A remote without a
+// manifest has no snapshots. key is nil for an unencrypted repository.
+func ReadManifest(r Remote, key *crypt.MasterKey) (*Manifest, error) {
+	manifest := &Manifest{
+		Version:   MANIFEST_VERSION,
+		Snapshots: make(map[uint64]*snapshot.SnapshotMetadata),
+	}
+
+	reader, err := r.Get(MANIFEST)
+	if err == ErrNotFound {
+		return manifest, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	bytes, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	bytes, err = open(key, bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(bytes, manifest); err != nil {
+		return nil, err
+	}
+
+	if manifest.Version != MANIFEST_VERSION {
+		errMsg := fmt.Sprintf("Manifest version %d not supported", manifest.Version)
+		return nil, errors.New(errMsg)
+	}
+
+	// the id is not part of the serialized metadata
+	for id, metadata := range manifest.Snapshots {
+		metadata.Id = id
+	}
+
+	return manifest, nil
+}
+
+// WriteManifest replaces the manifest on the remote
+func WriteManifest(r Remote, manifest *Manifest, key *crypt.MasterKey) error {
+	bytes, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	bytes, err = seal(key, bytes)
+	if err != nil {
+		return err
+	}
+
+	return r.Put(MANIFEST, strings.NewReader(string(bytes)))
+}
+
+// seal encrypts an object's contents if there is a key
+func seal(key *crypt.MasterKey, data []byte) ([]byte, error) {
+	if key == nil {
+		return data, nil
+	}
+
+	return key.Seal(data)
+}
+
+// open decrypts an object's contents sealed by seal
+func open(key *crypt.MasterKey, data []byte) ([]byte, error) {
+	if key == nil {
+		return data, nil
+	}
+
+	return key.Open(data)
+}
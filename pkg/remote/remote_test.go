@@ -0,0 +1,80 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package remote
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/andybug/abakus/pkg/snapshot"
+	"github.com/stretchr/testify/assert"
+)
+
+// testRemote checks the behavior every Remote implementation must have
+func testRemote(t *testing.T, r Remote) {
+	_, err := r.Get("blobs/missing")
+	assert.Equal(t, ErrNotFound, err)
+
+	assert.Nil(t, r.Put("blobs/aa", strings.NewReader("first")))
+	assert.Nil(t, r.Put("blobs/bb", strings.NewReader("second")))
+	assert.Nil(t, r.Put("snapshots/1.json", strings.NewReader("{}")))
+
+	// replacing an object overwrites it
+	assert.Nil(t, r.Put("blobs/aa", strings.NewReader("replaced")))
+	reader, err := r.Get("blobs/aa")
+	assert.Nil(t, err)
+	contents, _ := ioutil.ReadAll(reader)
+	reader.Close()
+	assert.Equal(t, "replaced", string(contents))
+
+	names, err := r.List(BLOBS_PREFIX)
+	assert.Nil(t, err)
+	sort.Strings(names)
+	assert.Equal(t, []string{"blobs/aa", "blobs/bb"}, names)
+
+	assert.Nil(t, r.Delete("blobs/aa"))
+	names, err = r.List(BLOBS_PREFIX)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"blobs/bb"}, names)
+
+	// manifests round trip with the ids restored
+	manifest, err := ReadManifest(r, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(manifest.Snapshots))
+
+	manifest.Snapshots[3] = &snapshot.SnapshotMetadata{Id: 3, Timestamp: 1234}
+	assert.Nil(t, WriteManifest(r, manifest, nil))
+
+	manifest, err = ReadManifest(r, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3), manifest.Snapshots[3].Id)
+	assert.Equal(t, int64(1234), manifest.Snapshots[3].Timestamp)
+}
+
+func TestDirRemote(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "TestDirRemote")
+	defer os.RemoveAll(dir)
+
+	testRemote(t, newDirRemote(dir))
+}
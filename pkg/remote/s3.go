@@ -0,0 +1,596 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package remote
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/andybug/abakus/pkg/repo"
+)
+
+// S3_PART_SIZE is the size of each part of a multipart upload. Objects
+// smaller than this are uploaded with a single request.
+const S3_PART_SIZE = 16 * 1024 * 1024
+
+// S3_MAX_ATTEMPTS is how many times a request is tried before giving up
+const S3_MAX_ATTEMPTS = 5
+
+// S3_BACKOFF is the delay before the first retry; it doubles each attempt
+const S3_BACKOFF = 200 * time.Millisecond
+
+// s3Credentials are the keys used to sign requests
+type s3Credentials struct {
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+// s3Remote stores objects in an s3 compatible bucket under a prefix
+type s3Remote struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	prefix    string
+	pathStyle bool
+	creds     *s3Credentials
+	client    *http.Client
+	partSize  int
+	backoff   time.Duration
+}
+
+// newS3Remote parses an s3://bucket/prefix location and loads the
+// credentials for the remote
+func newS3Remote(config *repo.RemoteConfig) (*s3Remote, error) {
+	location, err := url.Parse(config.Location)
+	if err != nil {
+		return nil, err
+	}
+	if location.Scheme != "s3" || location.Host == "" {
+		errMsg := fmt.Sprintf("Invalid s3 location '%s', expected s3://bucket/prefix", config.Location)
+		return nil, errors.New(errMsg)
+	}
+
+	prefix := strings.Trim(location.Path, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	region := config.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	endpointString := config.Endpoint
+	if endpointString == "" {
+		endpointString = fmt.Sprintf("https://s3.%s.amazonaws.com", region)
+	}
+	endpoint, err := url.Parse(endpointString)
+	if err != nil {
+		return nil, err
+	}
+
+	creds, err := loadCredentials(config)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &s3Remote{
+		endpoint:  endpoint,
+		region:    region,
+		bucket:    location.Host,
+		prefix:    prefix,
+		pathStyle: config.PathStyle,
+		creds:     creds,
+		client:    &http.Client{},
+		partSize:  S3_PART_SIZE,
+		backoff:   S3_BACKOFF,
+	}
+
+	return s, nil
+}
+
+// loadCredentials reads the keys from the environment, or failing that from
+// an aws style credentials file
+func loadCredentials(config *repo.RemoteConfig) (*s3Credentials, error) {
+	creds := &s3Credentials{
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if creds.accessKey != "" && creds.secretKey != "" {
+		return creds, nil
+	}
+
+	path := config.CredentialsFile
+	if path == "" {
+		home, _ := os.UserHomeDir()
+		path = filepath.Join(home, ".aws", "credentials")
+	}
+
+	profile := config.Profile
+	if profile == "" {
+		profile = os.Getenv("AWS_PROFILE")
+	}
+	if profile == "" {
+		profile = "default"
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("No s3 credentials in the environment or %s", path))
+	}
+	defer file.Close()
+
+	// a minimal ini parser: [profile] sections of key = value lines
+	section := ""
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if section != profile || len(parts) != 2 {
+			continue
+		}
+
+		value := strings.TrimSpace(parts[1])
+		switch strings.TrimSpace(parts[0]) {
+		case "aws_access_key_id":
+			creds.accessKey = value
+		case "aws_secret_access_key":
+			creds.secretKey = value
+		case "aws_session_token":
+			creds.sessionToken = value
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if creds.accessKey == "" || creds.secretKey == "" {
+		return nil, errors.New(fmt.Sprintf("No s3 credentials for profile '%s' in %s", profile, path))
+	}
+
+	return creds, nil
+}
+
+// s3ListResult is the response to a ListObjectsV2 request
+type s3ListResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// s3InitiateResult is the response to starting a multipart upload
+type s3InitiateResult struct {
+	UploadId string `xml:"UploadId"`
+}
+
+// s3CompletePart identifies one uploaded part when completing an upload
+type s3CompletePart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// s3CompleteUpload is the body of a request that completes an upload
+type s3CompleteUpload struct {
+	XMLName xml.Name         `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletePart `xml:"Part"`
+}
+
+// s3ErrorResult is the body s3 returns when a request fails
+type s3ErrorResult struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// List pages through ListObjectsV2 results for the prefix
+func (s *s3Remote) List(prefix string) ([]string, error) {
+	var names []string
+	token := ""
+
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", s.prefix+prefix)
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		resp, err := s.do("GET", "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var result s3ListResult
+		err = decodeResponse(resp, &result)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, object := range result.Contents {
+			names = append(names, strings.TrimPrefix(object.Key, s.prefix))
+		}
+
+		if !result.IsTruncated {
+			return names, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// Put uploads the object with a single request if it fits in one part,
+// otherwise with a multipart upload
+func (s *s3Remote) Put(name string, r io.Reader) error {
+	buf := make([]byte, s.partSize)
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		resp, err := s.do("PUT", s.prefix+name, nil, buf[:n])
+		if err != nil {
+			return err
+		}
+		return checkResponse(resp)
+	} else if err != nil {
+		return err
+	}
+
+	return s.putMultipart(s.prefix+name, buf, r)
+}
+
+// putMultipart uploads the first part from buf and the rest from r,
+// aborting the upload if anything fails
+func (s *s3Remote) putMultipart(key string, buf []byte, r io.Reader) error {
+	query := url.Values{}
+	query.Set("uploads", "")
+	resp, err := s.do("POST", key, query, nil)
+	if err != nil {
+		return err
+	}
+
+	var initiated s3InitiateResult
+	if err = decodeResponse(resp, &initiated); err != nil {
+		return err
+	}
+
+	complete := s3CompleteUpload{}
+	part := buf
+	for number := 1; len(part) > 0; number++ {
+		query = url.Values{}
+		query.Set("partNumber", fmt.Sprintf("%d", number))
+		query.Set("uploadId", initiated.UploadId)
+
+		resp, err = s.do("PUT", key, query, part)
+		if err == nil {
+			err = checkResponse(resp)
+		}
+		if err != nil {
+			s.abort(key, initiated.UploadId)
+			return err
+		}
+
+		complete.Parts = append(complete.Parts, s3CompletePart{
+			PartNumber: number,
+			ETag:       resp.Header.Get("ETag"),
+		})
+
+		n, err := io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			s.abort(key, initiated.UploadId)
+			return err
+		}
+		part = buf[:n]
+	}
+
+	body, err := xml.Marshal(&complete)
+	if err != nil {
+		s.abort(key, initiated.UploadId)
+		return err
+	}
+
+	query = url.Values{}
+	query.Set("uploadId", initiated.UploadId)
+	resp, err = s.do("POST", key, query, body)
+	if err != nil {
+		s.abort(key, initiated.UploadId)
+		return err
+	}
+
+	// completing can fail after the 200 status has been sent, in which
+	// case the error is in the body
+	var result s3ErrorResult
+	if err = decodeResponse(resp, &result); err != nil {
+		s.abort(key, initiated.UploadId)
+		return err
+	}
+	if result.Code != "" {
+		s.abort(key, initiated.UploadId)
+		return errors.New(fmt.Sprintf("s3: %s: %s", result.Code, result.Message))
+	}
+
+	return nil
+}
+
+// abort cancels a multipart upload so its parts do not linger
+func (s *s3Remote) abort(key string, uploadId string) {
+	query := url.Values{}
+	query.Set("uploadId", uploadId)
+	resp, err := s.do("DELETE", key, query, nil)
+	if err == nil {
+		resp.Body.Close()
+	}
+}
+
+// Get returns the body of the object
+func (s *s3Remote) Get(name string) (io.ReadCloser, error) {
+	resp, err := s.do("GET", s.prefix+name, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, responseError(resp)
+	}
+
+	return resp.Body, nil
+}
+
+// Delete removes the object
+func (s *s3Remote) Delete(name string) error {
+	resp, err := s.do("DELETE", s.prefix+name, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return ErrNotFound
+	}
+
+	return checkResponse(resp)
+}
+
+// do signs and sends a request, retrying with exponential backoff when the
+// request fails or the service returns a server error or throttles
+func (s *s3Remote) do(method string, key string, query url.Values, body []byte) (*http.Response, error) {
+	var lastErr error = nil
+
+	for attempt := 0; attempt < S3_MAX_ATTEMPTS; attempt++ {
+		if attempt > 0 {
+			time.Sleep(s.backoff << uint(attempt-1))
+		}
+
+		req, err := http.NewRequest(method, s.objectURL(key, query), bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		s.sign(req, body, time.Now())
+
+		resp, err := s.client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+			lastErr = responseError(resp)
+			continue
+		}
+
+		return resp, nil
+	}
+
+	return nil, lastErr
+}
+
+// objectURL returns the url of the key in the bucket, using either path
+// style (endpoint/bucket/key) or virtual host style (bucket.endpoint/key)
+func (s *s3Remote) objectURL(key string, query url.Values) string {
+	u := *s.endpoint
+	path := strings.TrimSuffix(u.Path, "/")
+	if s.pathStyle {
+		path += "/" + s.bucket
+	} else {
+		u.Host = s.bucket + "." + u.Host
+	}
+	path += "/" + key
+
+	u.Path = path
+	u.RawPath = s3Escape(path, false)
+	u.RawQuery = canonicalQuery(query)
+
+	return u.String()
+}
+
+// sign adds the aws signature version 4 headers to the request
+func (s *s3Remote) sign(req *http.Request, body []byte, now time.Time) {
+	payload := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(payload[:])
+	amzDate := now.UTC().Format("20060102T150405Z")
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	if s.creds.sessionToken != "" {
+		req.Header.Set("x-amz-security-token", s.creds.sessionToken)
+	}
+
+	signedHeaders := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	if s.creds.sessionToken != "" {
+		signedHeaders = append(signedHeaders, "x-amz-security-token")
+	}
+
+	signature, scope := signature(req.Method, req.URL.EscapedPath(), req.URL.Query(),
+		req.URL.Host, req.Header, signedHeaders, payloadHash, amzDate,
+		s.region, s.creds.secretKey)
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.creds.accessKey, scope, strings.Join(signedHeaders, ";"), signature))
+}
+
+// signature computes the aws signature version 4 of a request and returns it
+// along with the credential scope
+func signature(method string, escapedPath string, query url.Values, host string,
+	headers http.Header, signedHeaders []string, payloadHash string,
+	amzDate string, region string, secretKey string) (string, string) {
+
+	var canonicalHeaders strings.Builder
+	for _, name := range signedHeaders {
+		value := headers.Get(name)
+		if name == "host" {
+			value = host
+		}
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+
+	if escapedPath == "" {
+		escapedPath = "/"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		method,
+		escapedPath,
+		canonicalQuery(query),
+		canonicalHeaders.String(),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+
+	date := amzDate[:8]
+	scope := date + "/" + region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	return hex.EncodeToString(hmacSHA256(key, stringToSign)), scope
+}
+
+// hmacSHA256 returns the hmac of the data with the key
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalQuery encodes the query with sorted keys and s3's escaping
+func canonicalQuery(query url.Values) string {
+	var keys []string
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, key := range keys {
+		values := query[key]
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, s3Escape(key, true)+"="+s3Escape(value, true))
+		}
+	}
+
+	return strings.Join(pairs, "&")
+}
+
+// s3Escape percent-encodes everything except unreserved characters, and
+// slashes unless encodeSlash is set
+func s3Escape(s string, encodeSlash bool) string {
+	var escaped strings.Builder
+	for _, b := range []byte(s) {
+		switch {
+		case 'a' <= b && b <= 'z', 'A' <= b && b <= 'Z', '0' <= b && b <= '9',
+			b == '-', b == '_', b == '.', b == '~':
+			escaped.WriteByte(b)
+		case b == '/' && !encodeSlash:
+			escaped.WriteByte(b)
+		default:
+			fmt.Fprintf(&escaped, "%%%02X", b)
+		}
+	}
+
+	return escaped.String()
+}
+
+// checkResponse closes the response, returning an error if it failed
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode/100 != 2 {
+		return responseError(resp)
+	}
+
+	resp.Body.Close()
+	return nil
+}
+
+// decodeResponse parses a successful xml response into v
+func decodeResponse(resp *http.Response, v interface{}) error {
+	if resp.StatusCode/100 != 2 {
+		return responseError(resp)
+	}
+	defer resp.Body.Close()
+
+	return xml.NewDecoder(resp.Body).Decode(v)
+}
+
+// responseError builds an error from a failed response and closes it
+func responseError(resp *http.Response) error {
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	var result s3ErrorResult
+	if xml.Unmarshal(body, &result) == nil && result.Code != "" {
+		return errors.New(fmt.Sprintf("s3: %s: %s: %s", resp.Status, result.Code, result.Message))
+	}
+
+	return errors.New(fmt.Sprintf("s3: %s", resp.Status))
+}
@@ -0,0 +1,344 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package remote
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/andybug/abakus/pkg/blob"
+	"github.com/andybug/abakus/pkg/crypt"
+	"github.com/andybug/abakus/pkg/filelist"
+	"github.com/andybug/abakus/pkg/snapshot"
+)
+
+// TransferResult counts what a push or pull copied
+type TransferResult struct {
+	Snapshots []uint64
+	Blobs     uint64
+	Bytes     uint64
+}
+
+// Push uploads the snapshots with the given ids, or every snapshot the
+// remote lacks if ids is empty. For each snapshot the blobs that are not
+// already on the remote are uploaded first, then the snapshot itself, then
+// the manifest, so an interrupted push never leaves a dangling snapshot.
+// The remote is not locked; see addToManifest for what that allows. key is
+// nil for an unencrypted repository.
+func Push(r Remote, key *crypt.MasterKey, snapshots *snapshot.Store, blobs *blob.Store, ids []uint64) (*TransferResult, error) {
+	result := &TransferResult{}
+
+	manifest, err := ReadManifest(r, key)
+	if err != nil {
+		return result, err
+	}
+
+	if len(ids) == 0 {
+		for _, metadata := range snapshots.GetAllMetadata() {
+			ids = append(ids, metadata.Id)
+		}
+	}
+
+	remoteBlobs, err := listBlobs(r)
+	if err != nil {
+		return result, err
+	}
+
+	for _, id := range sortedIds(ids) {
+		s, err := snapshots.GetSnapshot(id)
+		if err != nil {
+			return result, err
+		}
+
+		if existing := manifest.Snapshots[id]; existing != nil {
+			if err = checkSame(existing, s.Metadata); err != nil {
+				return result, err
+			}
+			continue
+		}
+
+		it := s.Files.Files.Iterator()
+		for it.Next() {
+			metadata := it.Value().(*filelist.FileMetadata)
+			for _, hash := range metadata.Blobs() {
+				name := blobs.Name(hash)
+				if remoteBlobs[name] {
+					continue
+				}
+
+				n, err := pushBlob(r, blobs, name)
+				if err != nil {
+					return result, err
+				}
+
+				remoteBlobs[name] = true
+				result.Blobs += 1
+				result.Bytes += n
+			}
+		}
+
+		data, err := snapshot.Encode(s)
+		if err != nil {
+			return result, err
+		}
+		data, err = seal(key, data)
+		if err != nil {
+			return result, err
+		}
+		if err = r.Put(snapshotName(id), bytes.NewReader(data)); err != nil {
+			return result, err
+		}
+
+		if manifest, err = addToManifest(r, key, s.Metadata); err != nil {
+			return result, err
+		}
+
+		result.Snapshots = append(result.Snapshots, id)
+	}
+
+	return result, nil
+}
+
+// addToManifest lists the snapshot in the manifest. The manifest is read
+// again just before it is written, so that the snapshots another push has
+// listed since this one started are kept. Without a lock on the remote, a
+// push that writes the manifest between that read and the write can still
+// lose its entry, which pushing the snapshot again puts back.
+func addToManifest(r Remote, key *crypt.MasterKey, metadata *snapshot.SnapshotMetadata) (*Manifest, error) {
+	manifest, err := ReadManifest(r, key)
+	if err != nil {
+		return nil, err
+	}
+
+	// another push of the same id got there first
+	if existing := manifest.Snapshots[metadata.Id]; existing != nil {
+		if err = checkSame(existing, metadata); err != nil {
+			return nil, err
+		}
+	}
+
+	manifest.Snapshots[metadata.Id] = metadata
+	if err = WriteManifest(r, manifest, key); err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+// Pull downloads the snapshots with the given ids, or every snapshot in the
+// remote's manifest that is not in the local store if ids is empty. The
+// blobs a snapshot references are fetched and verified before the snapshot
+// is added to the local store. key is nil for an unencrypted repository.
+func Pull(r Remote, key *crypt.MasterKey, snapshots *snapshot.Store, blobs *blob.Store, ids []uint64) (*TransferResult, error) {
+	result := &TransferResult{}
+
+	manifest, err := ReadManifest(r, key)
+	if err != nil {
+		return result, err
+	}
+
+	if len(ids) == 0 {
+		for id := range manifest.Snapshots {
+			ids = append(ids, id)
+		}
+	}
+
+	for _, id := range sortedIds(ids) {
+		manifestMetadata := manifest.Snapshots[id]
+		if manifestMetadata == nil {
+			return result, errors.New(fmt.Sprintf("Remote has no snapshot with id %d", id))
+		}
+
+		if snapshots.HasSnapshot(id) {
+			local, err := snapshots.GetSnapshot(id)
+			if err != nil {
+				return result, err
+			}
+			if err = checkSame(manifestMetadata, local.Metadata); err != nil {
+				return result, err
+			}
+			continue
+		}
+
+		s, err := pullSnapshot(r, key, id)
+		if err != nil {
+			return result, err
+		}
+		if err = checkSame(manifestMetadata, s.Metadata); err != nil {
+			return result, err
+		}
+
+		it := s.Files.Files.Iterator()
+		for it.Next() {
+			metadata := it.Value().(*filelist.FileMetadata)
+			for _, hash := range metadata.Blobs() {
+				if blobs.Has(hash) {
+					continue
+				}
+
+				n, err := pullBlob(r, blobs, hash)
+				if err != nil {
+					return result, err
+				}
+
+				result.Blobs += 1
+				result.Bytes += n
+			}
+		}
+
+		// the blobs must be in the index before the snapshot refers to them
+		if err = blobs.Flush(); err != nil {
+			return result, err
+		}
+
+		if err = snapshots.ImportSnapshot(s); err != nil {
+			return result, err
+		}
+
+		result.Snapshots = append(result.Snapshots, id)
+	}
+
+	return result, nil
+}
+
+// listBlobs returns the set of blob names on the remote
+func listBlobs(r Remote) (map[string]bool, error) {
+	names, err := r.List(BLOBS_PREFIX)
+	if err != nil {
+		return nil, err
+	}
+
+	set := make(map[string]bool)
+	for _, name := range names {
+		set[strings.TrimPrefix(name, BLOBS_PREFIX)] = true
+	}
+
+	return set, nil
+}
+
+// pushBlob copies the stored bytes of the named blob to the remote and
+// returns how many bytes were copied
+func pushBlob(r Remote, blobs *blob.Store, name string) (uint64, error) {
+	raw, err := blobs.GetRaw(name)
+	if err != nil {
+		return 0, err
+	}
+	defer raw.Close()
+
+	counter := &countingReader{r: raw}
+	err = r.Put(BLOBS_PREFIX+name, counter)
+	return counter.n, err
+}
+
+// pullBlob copies the stored bytes of the blob from the remote into the
+// local store, removing it again if it does not verify
+func pullBlob(r Remote, blobs *blob.Store, hash []byte) (uint64, error) {
+	name := blobs.Name(hash)
+	raw, err := r.Get(BLOBS_PREFIX + name)
+	if err == ErrNotFound {
+		return 0, errors.New(fmt.Sprintf("Blob %s is missing from the remote", name))
+	} else if err != nil {
+		return 0, err
+	}
+	defer raw.Close()
+
+	counter := &countingReader{r: raw}
+	if err = blobs.PutRaw(name, counter); err != nil {
+		return counter.n, err
+	}
+
+	if err = blobs.Verify(hash); err != nil {
+		blobs.Remove(name)
+		return counter.n, err
+	}
+
+	return counter.n, nil
+}
+
+// pullSnapshot downloads and decodes a snapshot
+func pullSnapshot(r Remote, key *crypt.MasterKey, id uint64) (*snapshot.Snapshot, error) {
+	reader, err := r.Get(snapshotName(id))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err = open(key, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return snapshot.Decode(data)
+}
+
+// checkSame returns an error if two snapshots with the same id are not the
+// same snapshot (they were created independently in different repositories)
+func checkSame(a *snapshot.SnapshotMetadata, b *snapshot.SnapshotMetadata) error {
+	if a.Timestamp != b.Timestamp || !bytes.Equal(a.MerkleRoot, b.MerkleRoot) {
+		errMsg := fmt.Sprintf("Snapshot %d on the remote differs from the local snapshot", a.Id)
+		return errors.New(errMsg)
+	}
+
+	return nil
+}
+
+// snapshotName returns the object name of the snapshot with the given id
+func snapshotName(id uint64) string {
+	return fmt.Sprintf("%s%d.json", SNAPSHOTS_PREFIX, id)
+}
+
+// sortedIds returns a sorted copy of the ids without duplicates
+func sortedIds(ids []uint64) []uint64 {
+	seen := make(map[uint64]bool)
+	var sorted []uint64
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			sorted = append(sorted, id)
+		}
+	}
+
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n uint64
+}
+
+// Read reads from the underlying reader and adds to the count
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += uint64(n)
+	return n, err
+}
@@ -0,0 +1,318 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package remote
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/andybug/abakus/pkg/blob"
+	"github.com/andybug/abakus/pkg/filelist"
+	"github.com/andybug/abakus/pkg/repo"
+	"github.com/andybug/abakus/pkg/snapshot"
+	"github.com/stretchr/testify/assert"
+)
+
+// testRepo is an unencrypted repository with its stores open
+type testRepo struct {
+	root      string
+	snapshots *snapshot.Store
+	blobs     *blob.Store
+}
+
+// newTestRepo creates a repository in a temporary directory
+func newTestRepo(t *testing.T, name string) *testRepo {
+	root, _ := ioutil.TempDir("", name)
+	_, err := repo.Create(root)
+	assert.Nil(t, err)
+
+	snapshots, err := snapshot.GetStore(root, nil)
+	assert.Nil(t, err)
+	blobs, err := blob.GetStore(root, nil)
+	assert.Nil(t, err)
+
+	return &testRepo{root: root, snapshots: snapshots, blobs: blobs}
+}
+
+// close closes the stores and removes the repository
+func (tr *testRepo) close() {
+	tr.snapshots.Close()
+	tr.blobs.Close()
+	os.RemoveAll(tr.root)
+}
+
+// create writes the files into the repository and snapshots them
+func (tr *testRepo) create(t *testing.T, files map[string]string) uint64 {
+	for relPath, contents := range files {
+		path := filepath.Join(tr.root, relPath)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		assert.Nil(t, ioutil.WriteFile(path, []byte(contents), 0644))
+	}
+
+	fl, err := filelist.Scan(tr.root, nil)
+	assert.Nil(t, err)
+	_, err = tr.blobs.AddFiles(fl, nil, &blob.AddOptions{Jobs: 1, OnChange: blob.ON_CHANGE_FAIL})
+	assert.Nil(t, err)
+	assert.Nil(t, tr.blobs.Flush())
+
+	metadata, err := tr.snapshots.CreateSnapshot(fl, nil)
+	assert.Nil(t, err)
+	return metadata.Id
+}
+
+// putSnapshot encodes the snapshot with a merkle root that matches its
+// files, as anyone who can write to the remote could, and lists it in the
+// manifest
+func putSnapshot(t *testing.T, r Remote, s *snapshot.Snapshot) {
+	s.Metadata.MerkleRoot = s.Files.MerkleRoot()
+	data, err := snapshot.Encode(s)
+	assert.Nil(t, err)
+	assert.Nil(t, r.Put(snapshotName(s.Metadata.Id), bytes.NewReader(data)))
+
+	manifest, err := ReadManifest(r, nil)
+	assert.Nil(t, err)
+	manifest.Snapshots[s.Metadata.Id] = s.Metadata
+	assert.Nil(t, WriteManifest(r, manifest, nil))
+}
+
+func TestPushPull(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "TestPushPull")
+	defer os.RemoveAll(dir)
+	r := newDirRemote(dir)
+
+	src := newTestRepo(t, "TestPushPullSrc")
+	defer src.close()
+	dst := newTestRepo(t, "TestPushPullDst")
+	defer dst.close()
+
+	first := src.create(t, map[string]string{"a": "first", "dir/b": "second"})
+	second := src.create(t, map[string]string{"a": "changed"})
+
+	// a partial push only lists what it pushed
+	result, err := Push(r, nil, src.snapshots, src.blobs, []uint64{first})
+	assert.Nil(t, err)
+	assert.Equal(t, []uint64{first}, result.Snapshots)
+	assert.Equal(t, uint64(2), result.Blobs)
+
+	result, err = Pull(r, nil, dst.snapshots, dst.blobs, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []uint64{first}, result.Snapshots)
+	_, err = Pull(r, nil, dst.snapshots, dst.blobs, []uint64{second})
+	assert.NotNil(t, err)
+
+	// the rest only uploads the new blob, and pulling twice is a no-op
+	result, err = Push(r, nil, src.snapshots, src.blobs, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []uint64{second}, result.Snapshots)
+	assert.Equal(t, uint64(1), result.Blobs)
+
+	for i := 0; i < 2; i++ {
+		_, err = Pull(r, nil, dst.snapshots, dst.blobs, nil)
+		assert.Nil(t, err)
+	}
+
+	for _, id := range []uint64{first, second} {
+		want, _ := src.snapshots.GetSnapshot(id)
+		got, err := dst.snapshots.GetSnapshot(id)
+		assert.Nil(t, err)
+		assert.Equal(t, want.Metadata.MerkleRoot, got.Metadata.MerkleRoot)
+
+		it := got.Files.Files.Iterator()
+		for it.Next() {
+			if metadata := it.Value().(*filelist.FileMetadata); metadata.IsRegular() {
+				assert.Nil(t, dst.blobs.VerifyFile(metadata))
+			}
+		}
+	}
+}
+
+func TestPushPullMismatch(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "TestPushPullMismatch")
+	defer os.RemoveAll(dir)
+	r := newDirRemote(dir)
+
+	src := newTestRepo(t, "TestPushPullMismatchSrc")
+	defer src.close()
+	other := newTestRepo(t, "TestPushPullMismatchOther")
+	defer other.close()
+
+	id := src.create(t, map[string]string{"a": "first"})
+	_, err := Push(r, nil, src.snapshots, src.blobs, nil)
+	assert.Nil(t, err)
+
+	// a snapshot with the same id made elsewhere is neither pushed nor
+	// pulled over the remote's
+	other.create(t, map[string]string{"b": "other"})
+	_, err = Push(r, nil, other.snapshots, other.blobs, nil)
+	assert.NotNil(t, err)
+	_, err = Pull(r, nil, other.snapshots, other.blobs, nil)
+	assert.NotNil(t, err)
+
+	// nor is a snapshot that does not match its manifest entry
+	manifest, err := ReadManifest(r, nil)
+	assert.Nil(t, err)
+	manifest.Snapshots[id].Timestamp += 1
+	assert.Nil(t, WriteManifest(r, manifest, nil))
+
+	dst := newTestRepo(t, "TestPushPullMismatchDst")
+	defer dst.close()
+	_, err = Pull(r, nil, dst.snapshots, dst.blobs, nil)
+	assert.NotNil(t, err)
+	assert.False(t, dst.snapshots.HasSnapshot(id))
+}
+
+func TestPullMissingBlob(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "TestPullMissingBlob")
+	defer os.RemoveAll(dir)
+	r := newDirRemote(dir)
+
+	src := newTestRepo(t, "TestPullMissingBlobSrc")
+	defer src.close()
+	dst := newTestRepo(t, "TestPullMissingBlobDst")
+	defer dst.close()
+
+	id := src.create(t, map[string]string{"a": "first"})
+	_, err := Push(r, nil, src.snapshots, src.blobs, nil)
+	assert.Nil(t, err)
+
+	names, _ := r.List(BLOBS_PREFIX)
+	assert.Equal(t, 1, len(names))
+	assert.Nil(t, r.Delete(names[0]))
+
+	_, err = Pull(r, nil, dst.snapshots, dst.blobs, nil)
+	assert.NotNil(t, err)
+	assert.False(t, dst.snapshots.HasSnapshot(id))
+}
+
+func TestPullMalformed(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "TestPullMalformed")
+	defer os.RemoveAll(dir)
+	r := newDirRemote(dir)
+
+	dst := newTestRepo(t, "TestPullMalformedDst")
+	defer dst.close()
+
+	for _, paths := range [][]string{
+		{"../../escaped"},
+		{"/etc/passwd"},
+		{"a/../b"},
+		{"a//b"},
+		{"link", "link/file"},
+	} {
+		fl := filelist.New()
+		for _, relPath := range paths {
+			fl.Add(relPath, &filelist.FileMetadata{Type: filelist.TYPE_SYMLINK, Target: "/tmp"})
+		}
+		putSnapshot(t, r, &snapshot.Snapshot{
+			Metadata: &snapshot.SnapshotMetadata{Id: 1, Timestamp: 1},
+			Files:    fl,
+		})
+
+		_, err := Pull(r, nil, dst.snapshots, dst.blobs, nil)
+		assert.NotNil(t, err, paths[len(paths)-1])
+		assert.False(t, dst.snapshots.HasSnapshot(1))
+	}
+
+	// a null entry is an error rather than a crash
+	manifest, err := ReadManifest(r, nil)
+	assert.Nil(t, err)
+	data, _ := json.Marshal(map[string]interface{}{
+		"id":       1,
+		"metadata": manifest.Snapshots[1],
+		"files":    map[string]interface{}{"x": nil},
+	})
+	assert.Nil(t, r.Put(snapshotName(1), bytes.NewReader(data)))
+
+	_, err = Pull(r, nil, dst.snapshots, dst.blobs, nil)
+	assert.NotNil(t, err)
+	assert.False(t, dst.snapshots.HasSnapshot(1))
+}
+
+// hookRemote calls hook, once, before the named object is put
+type hookRemote struct {
+	Remote
+	name string
+	hook func()
+}
+
+func (r *hookRemote) Put(name string, reader io.Reader) error {
+	if name == r.name && r.hook != nil {
+		hook := r.hook
+		r.hook = nil
+		hook()
+	}
+	return r.Remote.Put(name, reader)
+}
+
+func TestPushConcurrent(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "TestPushConcurrent")
+	defer os.RemoveAll(dir)
+
+	src := newTestRepo(t, "TestPushConcurrentSrc")
+	defer src.close()
+	other := newTestRepo(t, "TestPushConcurrentOther")
+	defer other.close()
+
+	id := src.create(t, map[string]string{"a": "first"})
+	other.create(t, map[string]string{"b": "other"})
+	otherId := other.create(t, map[string]string{"b": "changed"})
+
+	// another push lists its snapshot while this one uploads
+	r := &hookRemote{Remote: newDirRemote(dir), name: snapshotName(id)}
+	r.hook = func() {
+		_, err := Push(r.Remote, nil, other.snapshots, other.blobs, []uint64{otherId})
+		assert.Nil(t, err)
+	}
+
+	result, err := Push(r, nil, src.snapshots, src.blobs, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []uint64{id}, result.Snapshots)
+
+	manifest, err := ReadManifest(r, nil)
+	assert.Nil(t, err)
+	assert.Len(t, manifest.Snapshots, 2)
+	assert.NotNil(t, manifest.Snapshots[id])
+	assert.NotNil(t, manifest.Snapshots[otherId])
+
+	// a different snapshot listed with the same id is not replaced
+	src.create(t, map[string]string{"a": "second"})
+	id = src.create(t, map[string]string{"a": "third"})
+	r.name = snapshotName(id)
+	r.hook = func() {
+		assert.Equal(t, id, other.create(t, map[string]string{"b": "again"}))
+		_, err := Push(r.Remote, nil, other.snapshots, other.blobs, []uint64{id})
+		assert.Nil(t, err)
+	}
+
+	_, err = Push(r, nil, src.snapshots, src.blobs, []uint64{id})
+	assert.NotNil(t, err)
+	assert.Nil(t, r.hook)
+	manifest, err = ReadManifest(r, nil)
+	assert.Nil(t, err)
+	otherMetadata, err := other.snapshots.GetSnapshot(id)
+	assert.Nil(t, err)
+	assert.Equal(t, otherMetadata.Metadata.MerkleRoot, manifest.Snapshots[id].MerkleRoot)
+}
@@ -0,0 +1,192 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v2"
+)
+
+// CONFIG_FILE is the name of the repository configuration file in HOME_DIR
+const CONFIG_FILE string = "config.yaml"
+
+// CONFIG_VERSION is the version of the configuration file format
+const CONFIG_VERSION uint32 = 1
+
+// FORMAT_FLAT and FORMAT_SHARDED are the repository format versions, which
+// describe how blobs are laid out on disk. Repositories without a format in
+// their config are FORMAT_FLAT.
+// FORMAT_FLAT - every loose blob and pack file directly in its directory
+// FORMAT_SHARDED - files fanned out by the first bytes of their names
+const (
+	FORMAT_FLAT    uint32 = 1
+	FORMAT_SHARDED uint32 = 2
+)
+
+// FORMAT_CURRENT is the format of newly created repositories
+const FORMAT_CURRENT = FORMAT_SHARDED
+
+// ENCRYPTION_NONE and ENCRYPTION_XCHACHA20 are the supported values for
+// Config.Encryption
+const (
+	ENCRYPTION_NONE      = ""
+	ENCRYPTION_XCHACHA20 = "xchacha20-poly1305"
+)
+
+// COMPRESSION_ZLIB, COMPRESSION_ZSTD and COMPRESSION_NONE are the supported
+// values for Config.Compression. Repositories without a compression in their
+// config use zlib, which is what every blob was stored with before the
+// algorithm could be chosen.
+const (
+	COMPRESSION_ZLIB = "zlib"
+	COMPRESSION_ZSTD = "zstd"
+	COMPRESSION_NONE = "none"
+)
+
+// COMPRESSION_DEFAULT is the compression of newly created repositories
+const COMPRESSION_DEFAULT = COMPRESSION_ZSTD
+
+// IsCompression returns true if name is a supported compression algorithm
+func IsCompression(name string) bool {
+	return name == COMPRESSION_ZLIB || name == COMPRESSION_ZSTD || name == COMPRESSION_NONE
+}
+
+// Config holds the repository configuration stored in CONFIG_FILE
+type Config struct {
+	Version     uint32                   `yaml:"version"`
+	Format      uint32                   `yaml:"format,omitempty"`
+	Encryption  string                   `yaml:"encryption,omitempty"`
+	Compression string                   `yaml:"compression,omitempty"`
+	Retention   RetentionPolicy          `yaml:"retention,omitempty"`
+	Remotes     map[string]*RemoteConfig `yaml:"remotes,omitempty"`
+}
+
+// RemoteConfig describes where a named remote stores its objects
+// Type - the kind of remote storage ("dir" or "s3")
+// Location - where the remote lives; an absolute path for dir remotes or
+// s3://bucket/prefix for s3 remotes
+// Endpoint, Region, PathStyle - how to reach an s3 compatible service
+// CredentialsFile, Profile - an aws style credentials file to read keys
+// from when they are not in the environment. keys are never stored here
+type RemoteConfig struct {
+	Type            string `yaml:"type"`
+	Location        string `yaml:"location"`
+	Endpoint        string `yaml:"endpoint,omitempty"`
+	Region          string `yaml:"region,omitempty"`
+	PathStyle       bool   `yaml:"path_style,omitempty"`
+	CredentialsFile string `yaml:"credentials_file,omitempty"`
+	Profile         string `yaml:"profile,omitempty"`
+}
+
+// RetentionPolicy describes how many snapshots to keep in each time window
+// Last - keep the most recent n snapshots
+// Hourly, Daily, Weekly, Monthly, Yearly - keep the most recent snapshot in
+// each of the last n hours, days, weeks, months, and years that have one
+// Prune - remove unreferenced blobs after forgetting snapshots
+type RetentionPolicy struct {
+	Last    int  `yaml:"last,omitempty"`
+	Hourly  int  `yaml:"hourly,omitempty"`
+	Daily   int  `yaml:"daily,omitempty"`
+	Weekly  int  `yaml:"weekly,omitempty"`
+	Monthly int  `yaml:"monthly,omitempty"`
+	Yearly  int  `yaml:"yearly,omitempty"`
+	Prune   bool `yaml:"prune,omitempty"`
+}
+
+// Empty returns true if the policy does not keep any snapshots
+func (p *RetentionPolicy) Empty() bool {
+	return p.Last == 0 && p.Hourly == 0 && p.Daily == 0 &&
+		p.Weekly == 0 && p.Monthly == 0 && p.Yearly == 0
+}
+
+// GetConfigPath returns the path to the config file with root as the base
+func GetConfigPath(root string) (config string) {
+	config = filepath.Join(root, HOME_DIR, CONFIG_FILE)
+	return
+}
+
+// ReadConfig reads the repository configuration. Repositories created before
+// the config file existed get the default configuration.
+func ReadConfig(root string) (*Config, error) {
+	config := &Config{
+		Version:     CONFIG_VERSION,
+		Format:      FORMAT_FLAT,
+		Compression: COMPRESSION_ZLIB,
+	}
+
+	bytes, err := ioutil.ReadFile(GetConfigPath(root))
+	if os.IsNotExist(err) {
+		return config, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err = yaml.Unmarshal(bytes, config); err != nil {
+		return nil, err
+	}
+
+	if config.Version != CONFIG_VERSION {
+		errMsg := fmt.Sprintf("Config version %d not supported", config.Version)
+		return nil, errors.New(errMsg)
+	}
+
+	if config.Format == 0 {
+		config.Format = FORMAT_FLAT
+	} else if config.Format > FORMAT_CURRENT {
+		errMsg := fmt.Sprintf("Repository format %d not supported", config.Format)
+		return nil, errors.New(errMsg)
+	}
+
+	if config.Compression == "" {
+		config.Compression = COMPRESSION_ZLIB
+	} else if !IsCompression(config.Compression) {
+		errMsg := fmt.Sprintf("Compression '%s' not supported", config.Compression)
+		return nil, errors.New(errMsg)
+	}
+
+	if config.Encryption != ENCRYPTION_NONE && config.Encryption != ENCRYPTION_XCHACHA20 {
+		errMsg := fmt.Sprintf("Encryption '%s' not supported", config.Encryption)
+		return nil, errors.New(errMsg)
+	}
+
+	return config, nil
+}
+
+// WriteConfig saves the repository configuration, replacing the config file
+func WriteConfig(root string, config *Config) error {
+	bytes, err := yaml.Marshal(config)
+	if err != nil {
+		return err
+	}
+
+	path := GetConfigPath(root)
+	tmpPath := path + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, bytes, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
@@ -0,0 +1,313 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package repo
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// LOCKS_DIR is the name of the directory inside HOME_DIR that holds a file
+// for every lock on the repository
+const LOCKS_DIR string = "locks"
+
+// kinds of lock
+// LOCK_SHARED - held by commands that only read the repository; any number
+// can be held at once
+// LOCK_EXCLUSIVE - held by commands that change it; no other lock can be
+// held at the same time
+const (
+	LOCK_SHARED    = "shared"
+	LOCK_EXCLUSIVE = "exclusive"
+)
+
+// LOCK_REFRESH_INTERVAL is how often a held lock's time is updated
+const LOCK_REFRESH_INTERVAL = 5 * time.Minute
+
+// LOCK_STALE_AGE is how long a lock can go without being refreshed before
+// it is considered stale. Locks from this host are also stale as soon as
+// their process has exited.
+const LOCK_STALE_AGE = 30 * time.Minute
+
+// LOCK_POLL_INTERVAL is about how often a conflicting lock is checked again
+// while waiting for it; each wait is randomly up to half of it shorter or
+// longer
+const LOCK_POLL_INTERVAL = 500 * time.Millisecond
+
+// LockInfo is the contents of a lock file
+// Id - the name of the lock file
+// Time - when the lock was taken or last refreshed (unix seconds)
+type LockInfo struct {
+	Id   string `json:"-"`
+	Kind string `json:"kind"`
+	PID  int    `json:"pid"`
+	Host string `json:"host"`
+	Time int64  `json:"time"`
+}
+
+// String describes who holds the lock
+func (info *LockInfo) String() string {
+	return fmt.Sprintf("%s lock held by PID %d on %s since %s",
+		info.Kind, info.PID, info.Host, time.Unix(info.Time, 0).Format(time.RFC3339))
+}
+
+// Stale returns true if the process that took the lock is gone: it has not
+// refreshed the lock for LOCK_STALE_AGE, or it ran on this host and has
+// exited. The age is checked on this host too, since a reused PID would
+// otherwise keep the lock alive forever.
+func (info *LockInfo) Stale() bool {
+	if time.Since(time.Unix(info.Time, 0)) > LOCK_STALE_AGE {
+		return true
+	}
+
+	if host, _ := os.Hostname(); info.Host == host && info.PID != 0 {
+		return !processExists(info.PID)
+	}
+
+	return false
+}
+
+// LockedError is returned by Lock when a conflicting lock is held
+type LockedError struct {
+	Holder *LockInfo
+}
+
+func (err *LockedError) Error() string {
+	return fmt.Sprintf("Repository is locked: %s", err.Holder)
+}
+
+// Lock is a lock held by this process. It is refreshed in the background
+// until it is released.
+type Lock struct {
+	dir  string
+	info *LockInfo
+	stop chan struct{}
+	done chan struct{}
+}
+
+// GetLocksDir returns the path to the locks directory with root as the base
+func GetLocksDir(root string) (locks string) {
+	locks = filepath.Join(root, HOME_DIR, LOCKS_DIR)
+	return
+}
+
+// Acquire takes a lock of the given kind in dir, which holds the lock
+// files of a repository. Stale locks in the way are removed. If a lock that
+// conflicts is held, Acquire waits up to wait for it to be released before
+// returning a *LockedError.
+// A lock only needs files that can be created, listed and removed, so a
+// remote can be locked the same way.
+func Acquire(dir string, kind string, wait time.Duration) (*Lock, error) {
+	deadline := time.Now().Add(wait)
+
+	for {
+		lock, err := tryAcquire(dir, kind)
+		if _, locked := err.(*LockedError); !locked || time.Now().After(deadline) {
+			return lock, err
+		}
+
+		time.Sleep(pollInterval())
+	}
+}
+
+// pollInterval returns how long to wait before trying to take a lock again.
+// Two processes racing for an exclusive lock each see the other's lock file
+// and back off, so they must not retry in step.
+func pollInterval() time.Duration {
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return LOCK_POLL_INTERVAL
+	}
+
+	jitter := time.Duration(binary.BigEndian.Uint64(random) % uint64(LOCK_POLL_INTERVAL))
+	return LOCK_POLL_INTERVAL/2 + jitter
+}
+
+// tryAcquire writes a lock file and then checks the other locks. If any of
+// them conflicts the lock file is removed again, so of two processes that
+// race, neither gets an exclusive lock rather than both.
+func tryAcquire(dir string, kind string) (*Lock, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	host, _ := os.Hostname()
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	lock := &Lock{
+		dir: dir,
+		info: &LockInfo{
+			Id:   kind + "-" + hex.EncodeToString(id),
+			Kind: kind,
+			PID:  os.Getpid(),
+			Host: host,
+			Time: time.Now().Unix(),
+		},
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	if err := lock.write(); err != nil {
+		return nil, err
+	}
+
+	locks, err := Locks(dir)
+	if err != nil {
+		lock.remove()
+		return nil, err
+	}
+
+	for _, other := range locks {
+		if other.Id == lock.info.Id || (kind == LOCK_SHARED && other.Kind == LOCK_SHARED) {
+			continue
+		}
+
+		if other.Stale() {
+			if err = os.Remove(filepath.Join(dir, other.Id)); err != nil && !os.IsNotExist(err) {
+				lock.remove()
+				return nil, err
+			}
+			continue
+		}
+
+		lock.remove()
+		return nil, &LockedError{Holder: other}
+	}
+
+	go lock.refresh()
+	return lock, nil
+}
+
+// Release stops refreshing the lock and removes its file
+func (lock *Lock) Release() error {
+	close(lock.stop)
+	<-lock.done
+
+	return lock.remove()
+}
+
+// refresh updates the lock's time every LOCK_REFRESH_INTERVAL so that other
+// hosts do not think it is stale
+func (lock *Lock) refresh() {
+	defer close(lock.done)
+
+	ticker := time.NewTicker(LOCK_REFRESH_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-lock.stop:
+			return
+		case <-ticker.C:
+			lock.info.Time = time.Now().Unix()
+			lock.write()
+		}
+	}
+}
+
+// write writes the lock file through a temporary file, so that it is never
+// seen half written
+func (lock *Lock) write() error {
+	data, err := json.Marshal(lock.info)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := filepath.Join(lock.dir, "."+lock.info.Id)
+	if err = ioutil.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, filepath.Join(lock.dir, lock.info.Id))
+}
+
+// remove deletes the lock file
+func (lock *Lock) remove() error {
+	return os.Remove(filepath.Join(lock.dir, lock.info.Id))
+}
+
+// Locks returns the locks in dir. A lock file that cannot be read is
+// reported as an exclusive lock held by an unknown process since the file
+// was modified.
+func Locks(dir string) ([]*LockInfo, error) {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var locks []*LockInfo
+	for _, file := range files {
+		// temporary files of locks being written
+		if strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+
+		info := &LockInfo{}
+		data, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil || json.Unmarshal(data, info) != nil {
+			info = &LockInfo{Kind: LOCK_EXCLUSIVE, Host: "unknown host", Time: file.ModTime().Unix()}
+		}
+
+		info.Id = file.Name()
+		locks = append(locks, info)
+	}
+
+	return locks, nil
+}
+
+// RemoveLocks removes the stale locks in dir, or every lock if all is true,
+// and returns the locks that were removed
+func RemoveLocks(dir string, all bool) ([]*LockInfo, error) {
+	locks, err := Locks(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []*LockInfo
+	for _, info := range locks {
+		if !all && !info.Stale() {
+			continue
+		}
+
+		err = os.Remove(filepath.Join(dir, info.Id))
+		if err != nil && !os.IsNotExist(err) {
+			return removed, errors.New(fmt.Sprintf("Could not remove lock %s: %s", info.Id, err))
+		}
+		removed = append(removed, info)
+	}
+
+	return removed, nil
+}
@@ -0,0 +1,146 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package repo
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLock(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "TestLock")
+	defer os.RemoveAll(dir)
+
+	// shared locks can be held together, but not with an exclusive one
+	shared1, err := Acquire(dir, LOCK_SHARED, 0)
+	assert.Nil(t, err)
+	shared2, err := Acquire(dir, LOCK_SHARED, 0)
+	assert.Nil(t, err)
+
+	_, err = Acquire(dir, LOCK_EXCLUSIVE, 0)
+	assert.IsType(t, &LockedError{}, err)
+
+	assert.Nil(t, shared1.Release())
+	assert.Nil(t, shared2.Release())
+
+	exclusive, err := Acquire(dir, LOCK_EXCLUSIVE, 0)
+	assert.Nil(t, err)
+
+	_, err = Acquire(dir, LOCK_SHARED, 0)
+	assert.IsType(t, &LockedError{}, err)
+
+	// waiting succeeds once the lock is released
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		exclusive.Release()
+	}()
+	shared1, err = Acquire(dir, LOCK_SHARED, 5*time.Second)
+	assert.Nil(t, err)
+	assert.Nil(t, shared1.Release())
+
+	locks, err := Locks(dir)
+	assert.Nil(t, err)
+	assert.Empty(t, locks)
+}
+
+func TestStaleLock(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "TestStaleLock")
+	defer os.RemoveAll(dir)
+
+	// a lock from another host that has not been refreshed for too long,
+	// and one from another host that is still fresh
+	host, _ := os.Hostname()
+	writeLock := func(id string, info *LockInfo) {
+		data, _ := json.Marshal(info)
+		ioutil.WriteFile(filepath.Join(dir, id), data, 0644)
+	}
+	writeLock("old", &LockInfo{Kind: LOCK_EXCLUSIVE, PID: 1, Host: host + "-other",
+		Time: time.Now().Add(-2 * LOCK_STALE_AGE).Unix()})
+	writeLock("fresh", &LockInfo{Kind: LOCK_SHARED, PID: 1, Host: host + "-other",
+		Time: time.Now().Unix()})
+
+	// the stale exclusive lock is removed when a shared lock is taken
+	lock, err := Acquire(dir, LOCK_SHARED, 0)
+	assert.Nil(t, err)
+	assert.Nil(t, lock.Release())
+
+	locks, err := Locks(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(locks))
+	assert.Equal(t, "fresh", locks[0].Id)
+
+	// only RemoveLocks with all removes a lock that is not stale
+	removed, err := RemoveLocks(dir, false)
+	assert.Nil(t, err)
+	assert.Empty(t, removed)
+
+	removed, err = RemoveLocks(dir, true)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(removed))
+
+	// a lock from this host is stale once its process has exited, or once
+	// it is too old, in case its PID was reused
+	live := &LockInfo{Kind: LOCK_EXCLUSIVE, PID: os.Getpid(), Host: host, Time: time.Now().Unix()}
+	assert.False(t, live.Stale())
+	live.Time = time.Now().Add(-2 * LOCK_STALE_AGE).Unix()
+	assert.True(t, live.Stale())
+}
+
+func TestLockContention(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "TestLockContention")
+	defer os.RemoveAll(dir)
+
+	for i := 0; i < 100; i++ {
+		interval := pollInterval()
+		assert.True(t, interval >= LOCK_POLL_INTERVAL/2)
+		assert.True(t, interval < LOCK_POLL_INTERVAL*3/2)
+	}
+
+	// processes that keep colliding over an exclusive lock all get it
+	// in the end
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			lock, err := Acquire(dir, LOCK_EXCLUSIVE, 30*time.Second)
+			if err == nil {
+				time.Sleep(10 * time.Millisecond)
+				err = lock.Release()
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		assert.Nil(t, err)
+	}
+}
@@ -34,6 +34,22 @@ const HOME_DIR string = ".abakus"
 // BLOBS_DIR is the name of the blobs directory inside HOME_DIR
 const BLOBS_DIR string = "blobs"
 
+// PACKS_DIR is the name of the directory inside HOME_DIR that holds the
+// pack files
+const PACKS_DIR string = "packs"
+
+// INDEX_DB is the name of the database in the home dir that maps blobs to
+// their location in the pack files
+const INDEX_DB string = "index.db"
+
+// KEYS_DIR is the name of the directory inside HOME_DIR that holds the
+// wrapped master keys of an encrypted repository
+const KEYS_DIR string = "keys"
+
+// STAT_CACHE_DB is the name of the database in the home dir that remembers
+// the hashes of files in the working directory
+const STAT_CACHE_DB string = "statcache.db"
+
 // SNAPSHOTS_DB is the name of the local database in the home dir
 const SNAPSHOTS_DB string = "snapshots.db"
 
@@ -49,6 +65,30 @@ func GetBlobsDir(root string) (blobs string) {
 	return
 }
 
+// GetPacksDir returns the path to the packs directory with root as the base
+func GetPacksDir(root string) (packs string) {
+	packs = filepath.Join(root, HOME_DIR, PACKS_DIR)
+	return
+}
+
+// GetIndexDbPath returns the path to the pack index db with root as the base
+func GetIndexDbPath(root string) (index_db string) {
+	index_db = filepath.Join(root, HOME_DIR, INDEX_DB)
+	return
+}
+
+// GetKeysDir returns the path to the keys directory with root as the base
+func GetKeysDir(root string) (keys string) {
+	keys = filepath.Join(root, HOME_DIR, KEYS_DIR)
+	return
+}
+
+// GetStatCacheDbPath returns the path to the stat cache db with root as the base
+func GetStatCacheDbPath(root string) (stat_cache_db string) {
+	stat_cache_db = filepath.Join(root, HOME_DIR, STAT_CACHE_DB)
+	return
+}
+
 // GetSnapshotsDbPath returns the path to the local snapshot db with root as the base
 func GetSnapshotsDbPath(root string) (snapshots_db string) {
 	snapshots_db = filepath.Join(root, HOME_DIR, SNAPSHOTS_DB)
@@ -109,6 +149,16 @@ func Create(root string) (string, error) {
 		return home, err
 	}
 
+	// write the default config
+	config := &Config{
+		Version:     CONFIG_VERSION,
+		Format:      FORMAT_CURRENT,
+		Compression: COMPRESSION_DEFAULT,
+	}
+	if err := WriteConfig(root, config); err != nil {
+		return home, err
+	}
+
 	return home, nil
 }
 
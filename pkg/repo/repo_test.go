@@ -94,6 +94,10 @@ func TestCreateSuccess(t *testing.T) {
 	snapshots_db := GetSnapshotsDbPath(dir)
 	_, err = os.Stat(snapshots_db)
 	assert.Nil(t, err)
+
+	config, err := ReadConfig(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, CONFIG_VERSION, config.Version)
 }
 
 func TestCreateMissingDir(t *testing.T) {
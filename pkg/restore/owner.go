@@ -0,0 +1,75 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package restore
+
+import (
+	"os/user"
+	"strconv"
+	"sync"
+
+	"github.com/andybug/abakus/pkg/filelist"
+)
+
+// ids caches the ids of the user and group names looked up by owner
+var ids = struct {
+	sync.Mutex
+	users  map[string]int
+	groups map[string]int
+}{users: make(map[string]int), groups: make(map[string]int)}
+
+// owner returns the uid and gid to give a restored file: those of its user
+// and group names on this system, or its numeric ids if numeric is true or
+// the names are unknown here
+func owner(metadata *filelist.FileMetadata, numeric bool) (int, int) {
+	uid, gid := int(metadata.UID), int(metadata.GID)
+	if numeric {
+		return uid, gid
+	}
+
+	ids.Lock()
+	defer ids.Unlock()
+
+	if metadata.User != "" {
+		if _, ok := ids.users[metadata.User]; !ok {
+			ids.users[metadata.User] = -1
+			if u, err := user.Lookup(metadata.User); err == nil {
+				ids.users[metadata.User], _ = strconv.Atoi(u.Uid)
+			}
+		}
+		if id := ids.users[metadata.User]; id >= 0 {
+			uid = id
+		}
+	}
+
+	if metadata.Group != "" {
+		if _, ok := ids.groups[metadata.Group]; !ok {
+			ids.groups[metadata.Group] = -1
+			if g, err := user.LookupGroup(metadata.Group); err == nil {
+				ids.groups[metadata.Group], _ = strconv.Atoi(g.Gid)
+			}
+		}
+		if id := ids.groups[metadata.Group]; id >= 0 {
+			gid = id
+		}
+	}
+
+	return uid, gid
+}
@@ -0,0 +1,461 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package restore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/andybug/abakus/pkg/blob"
+	"github.com/andybug/abakus/pkg/filelist"
+	"github.com/golang/crypto/blake2b"
+)
+
+// Options controls how a snapshot is restored
+// Target - absolute path of the directory to restore into
+// Paths - relative paths (files or dirs) to restore; empty means all files
+// Force - overwrite working files even if they have unsaved changes
+// Latest - file list of the latest snapshot; working files that match it
+// are considered unmodified and may be overwritten. may be nil
+// NumericOwner - restore the owner by uid and gid, rather than by the user
+// and group names when this system has them
+// NoXattrs - do not restore extended attributes and ACLs
+type Options struct {
+	Target       string
+	Paths        []string
+	Force        bool
+	Latest       *filelist.FileList
+	NumericOwner bool
+	NoXattrs     bool
+}
+
+// Result counts the files handled by a restore
+// Skipped - sockets, which cannot be recreated, and devices when not
+// running as root
+type Result struct {
+	Restored  uint64
+	Unchanged uint64
+	Skipped   uint64
+}
+
+// Restore writes the files in the file list to the target directory,
+// streaming the contents from the blob store, and recreates directories,
+// symlinks, FIFOs and (as root) devices. Each file is verified against its
+// hash before it replaces anything on disk. All of the working files are
+// checked for modifications before anything is written. The metadata of
+// directories is set last, deepest first, so that writing their contents
+// does not change their mtimes. Hard links are recreated as links to the
+// first file of their group, when it is restored too. Nothing is written
+// outside of the target or through a symlink inside it.
+func Restore(fl *filelist.FileList, blobs *blob.Store, opts *Options) (*Result, error) {
+	result := &Result{}
+	var pending []string
+	var dirs []string
+	isPending := make(map[string]bool)
+
+	fl = fl.Select(opts.Paths)
+	it := fl.Files.Iterator()
+	for it.Next() {
+		relPath := it.Key().(string)
+		metadata := it.Value().(*filelist.FileMetadata)
+
+		if metadata.Type == filelist.TYPE_SOCKET || (metadata.IsDevice() && os.Geteuid() != 0) {
+			result.Skipped += 1
+			continue
+		}
+
+		absPath, err := resolve(opts.Target, relPath)
+		if err != nil {
+			return result, err
+		}
+
+		// what is at the far end of a symlink is not ours to look at. if
+		// the link is not replaced by a directory first, the write fails
+		var current *filelist.FileMetadata
+		if symlink, err := throughSymlink(opts.Target, absPath); err != nil {
+			return result, err
+		} else if symlink == "" {
+			if current, err = currentEntry(absPath); err != nil {
+				return result, err
+			}
+		}
+
+		// a hard link whose first file is replaced, or which is not linked
+		// to it, has to be linked again
+		link := linkTarget(fl, relPath, metadata)
+		relink := link != "" && (isPending[link] || !sameFile(absPath, filepath.Join(opts.Target, link)))
+
+		if current != nil && current.SameContents(metadata) && !relink {
+			// contents are already correct, just fix up the metadata
+			if metadata.Type == filelist.TYPE_DIRECTORY {
+				dirs = append(dirs, relPath)
+			} else if err = setMetadata(absPath, metadata, opts); err != nil {
+				return result, err
+			}
+			result.Unchanged += 1
+			continue
+		}
+
+		// replacing a file with the same contents by a link loses nothing
+		if current != nil && !current.SameContents(metadata) && !opts.Force && !matchesLatest(relPath, current, opts.Latest) {
+			errMsg := fmt.Sprintf("%s has been modified, use --force to overwrite", relPath)
+			return result, errors.New(errMsg)
+		}
+
+		pending = append(pending, relPath)
+		isPending[relPath] = true
+	}
+
+	for _, relPath := range pending {
+		value, _ := fl.Files.Get(relPath)
+		metadata := value.(*filelist.FileMetadata)
+
+		absPath := filepath.Join(opts.Target, relPath)
+		symlink, err := throughSymlink(opts.Target, absPath)
+		if err != nil {
+			return result, err
+		} else if symlink != "" {
+			errMsg := fmt.Sprintf("%s is inside the symlink %s", relPath, symlink)
+			return result, errors.New(errMsg)
+		}
+
+		link := linkTarget(fl, relPath, metadata)
+		switch {
+		case link != "":
+			err = restoreLink(absPath, filepath.Join(opts.Target, link))
+		case metadata.IsRegular():
+			err = restoreFile(absPath, metadata, blobs, opts)
+		case metadata.Type == filelist.TYPE_DIRECTORY:
+			err = restoreDir(absPath)
+			dirs = append(dirs, relPath)
+		case metadata.Type == filelist.TYPE_SYMLINK:
+			err = restoreSymlink(absPath, metadata, opts)
+		default:
+			err = restoreSpecial(absPath, metadata, opts)
+		}
+		if err != nil {
+			return result, err
+		}
+		result.Restored += 1
+	}
+
+	// a directory sorts before everything inside it
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, relPath := range dirs {
+		value, _ := fl.Files.Get(relPath)
+		metadata := value.(*filelist.FileMetadata)
+		if err := setMetadata(filepath.Join(opts.Target, relPath), metadata, opts); err != nil {
+			return result, err
+		}
+	}
+
+	return result, nil
+}
+
+// resolve returns the absolute path of relPath in the target directory, or
+// an error if that would be outside of it
+func resolve(target string, relPath string) (string, error) {
+	absPath := filepath.Join(target, relPath)
+	rel, err := filepath.Rel(target, absPath)
+	if err != nil || rel == "." || rel == ".." ||
+		strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errors.New(fmt.Sprintf("%s is outside of %s", relPath, target))
+	}
+
+	return absPath, nil
+}
+
+// throughSymlink returns the first directory between the target and path
+// that is a symlink, or "" if there is none
+func throughSymlink(target string, path string) (string, error) {
+	rel, _ := filepath.Rel(target, filepath.Dir(path))
+	if rel == "." {
+		return "", nil
+	}
+
+	dir := target
+	for _, element := range strings.Split(rel, string(filepath.Separator)) {
+		dir = filepath.Join(dir, element)
+		info, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			return "", nil
+		} else if err != nil {
+			return "", err
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			return dir, nil
+		}
+	}
+
+	return "", nil
+}
+
+// currentEntry returns the type and hash (or target, or device numbers) of
+// what is at path, or nil if nothing is. A directory's contents are not
+// looked at; they are entries of their own.
+func currentEntry(path string) (*filelist.FileMetadata, error) {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if info.IsDir() {
+		return &filelist.FileMetadata{Type: filelist.TYPE_DIRECTORY}, nil
+	}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(path)
+		if err != nil {
+			return nil, err
+		}
+		return &filelist.FileMetadata{Type: filelist.TYPE_SYMLINK, Target: target}, nil
+	}
+
+	if special := filelist.SpecialMetadata(info); special != nil {
+		return special, nil
+	}
+
+	if !info.Mode().IsRegular() {
+		return nil, errors.New(fmt.Sprintf("%s exists and is not a file", path))
+	}
+
+	hash, err := filelist.HashFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &filelist.FileMetadata{Hash: hash}, nil
+}
+
+// matchesLatest returns true if the working file has the same contents as
+// it did in the latest snapshot (so overwriting it loses nothing)
+func matchesLatest(relPath string, current *filelist.FileMetadata, latest *filelist.FileList) bool {
+	if latest == nil {
+		return false
+	}
+
+	value, found := latest.Files.Get(relPath)
+	if !found {
+		return false
+	}
+
+	return current.SameContents(value.(*filelist.FileMetadata))
+}
+
+// restoreFile streams the blob into a temporary file next to path, checks
+// the hash of what was written, then moves it into place
+func restoreFile(path string, metadata *filelist.FileMetadata, blobs *blob.Store, opts *Options) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	reader, err := blobs.Open(metadata)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	tmp, err := ioutil.TempFile(dir, ".abakus-restore-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	hasher, _ := blake2b.New256(nil)
+	_, err = io.Copy(io.MultiWriter(tmp, hasher), reader)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	if !bytes.Equal(hasher.Sum(nil), metadata.Hash) {
+		return errors.New(fmt.Sprintf("%s: restored contents do not match hash", path))
+	}
+
+	if err = setMetadata(tmp.Name(), metadata, opts); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// restoreDir creates the directory at path, replacing what is there. Its
+// metadata is set once everything inside it has been restored.
+func restoreDir(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return os.MkdirAll(path, 0755)
+}
+
+// linkTarget returns the path of the earlier entry in the list that the
+// file at relPath is a hard link to, or "" if it is not a link or that entry
+// is not being restored
+func linkTarget(fl *filelist.FileList, relPath string, metadata *filelist.FileMetadata) string {
+	link := metadata.LinkedTo(relPath)
+	if link == "" {
+		return ""
+	}
+
+	if _, found := fl.Files.Get(link); !found {
+		return ""
+	}
+	return link
+}
+
+// sameFile returns true if both paths are the same file
+func sameFile(path string, other string) bool {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return false
+	}
+
+	otherInfo, err := os.Lstat(other)
+	if err != nil {
+		return false
+	}
+
+	return os.SameFile(info, otherInfo)
+}
+
+// restoreLink creates a hard link to target next to path, then moves it
+// into place
+func restoreLink(path string, target string) error {
+	return createAndMove(path, func(tmp string) error {
+		return os.Link(target, tmp)
+	})
+}
+
+// restoreSymlink creates the link next to path, then moves it into place
+func restoreSymlink(path string, metadata *filelist.FileMetadata, opts *Options) error {
+	return createAndMove(path, func(tmp string) error {
+		if err := os.Symlink(metadata.Target, tmp); err != nil {
+			return err
+		}
+		return setMetadata(tmp, metadata, opts)
+	})
+}
+
+// restoreSpecial creates the FIFO or device next to path, then moves it
+// into place
+func restoreSpecial(path string, metadata *filelist.FileMetadata, opts *Options) error {
+	return createAndMove(path, func(tmp string) error {
+		if err := mknod(tmp, metadata); err != nil {
+			return err
+		}
+		return setMetadata(tmp, metadata, opts)
+	})
+}
+
+// unsupported returns the error for an entry that cannot be created here
+func unsupported(path string, metadata *filelist.FileMetadata) error {
+	return errors.New(fmt.Sprintf("%s: cannot restore a %s", path, metadata.Type))
+}
+
+// createAndMove calls create with a temporary path next to path, then moves
+// what it created into place
+func createAndMove(path string, create func(tmp string) error) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(dir, ".abakus-restore-"+filepath.Base(path))
+	os.Remove(tmp)
+	if err := create(tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
+
+// setMetadata applies the owner (when running as root), extended
+// attributes, ACLs, mode and access and modification times to the file.
+// Symlinks only get their owner and times, since changing the rest would
+// change what they point to.
+func setMetadata(path string, metadata *filelist.FileMetadata, opts *Options) error {
+	// the owner goes first, as changing it clears the setuid bits
+	if os.Geteuid() == 0 {
+		uid, gid := owner(metadata, opts.NumericOwner)
+		if err := os.Lchown(path, uid, gid); err != nil {
+			return err
+		}
+	}
+
+	if metadata.Type == filelist.TYPE_SYMLINK {
+		if metadata.ModTime == 0 {
+			return nil
+		}
+		atime, mtime := times(metadata)
+		return lchtimes(path, atime, mtime)
+	}
+
+	if !opts.NoXattrs {
+		if err := writeXattrs(path, metadata); err != nil {
+			return err
+		}
+	}
+
+	mode := os.FileMode(metadata.Mode) & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	if err := os.Chmod(path, mode); err != nil {
+		return err
+	}
+
+	// snapshots taken before mtimes were stored have none to restore
+	if metadata.ModTime == 0 {
+		return nil
+	}
+
+	atime, mtime := times(metadata)
+	return os.Chtimes(path, atime, mtime)
+}
+
+// times returns the access and modification times to restore. Snapshots
+// taken before access times were stored use the mtime for both.
+func times(metadata *filelist.FileMetadata) (time.Time, time.Time) {
+	mtime := metadata.MTime()
+	if metadata.ATime == 0 {
+		return mtime, mtime
+	}
+
+	return time.Unix(0, metadata.ATime), mtime
+}
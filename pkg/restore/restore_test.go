@@ -0,0 +1,186 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package restore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/andybug/abakus/pkg/blob"
+	"github.com/andybug/abakus/pkg/filelist"
+	"github.com/andybug/abakus/pkg/repo"
+	"github.com/stretchr/testify/assert"
+)
+
+// newRepo creates a repository in a temporary directory and opens its blob
+// store
+func newRepo(t *testing.T, name string) (string, *blob.Store) {
+	root, _ := ioutil.TempDir("", name)
+	_, err := repo.Create(root)
+	assert.Nil(t, err)
+
+	blobs, err := blob.GetStore(root, nil)
+	assert.Nil(t, err)
+	return root, blobs
+}
+
+// store writes the files into the repository and returns the file list of
+// everything in it, with the contents in the blob store
+func store(t *testing.T, root string, blobs *blob.Store, files map[string]string) *filelist.FileList {
+	for relPath, contents := range files {
+		path := filepath.Join(root, relPath)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		assert.Nil(t, ioutil.WriteFile(path, []byte(contents), 0640))
+	}
+
+	fl, err := filelist.Scan(root, nil)
+	assert.Nil(t, err)
+	_, err = blobs.AddFiles(fl, nil, &blob.AddOptions{Jobs: 1, OnChange: blob.ON_CHANGE_FAIL})
+	assert.Nil(t, err)
+	assert.Nil(t, blobs.Flush())
+	return fl
+}
+
+// readFile returns the contents of the file, or "" if it cannot be read
+func readFile(path string) string {
+	contents, _ := ioutil.ReadFile(path)
+	return string(contents)
+}
+
+func TestRestore(t *testing.T) {
+	root, blobs := newRepo(t, "TestRestore")
+	defer os.RemoveAll(root)
+	defer blobs.Close()
+	target, _ := ioutil.TempDir("", "TestRestoreTarget")
+	defer os.RemoveAll(target)
+
+	fl := store(t, root, blobs, map[string]string{"a": "first", "dir/b": "second"})
+	opts := &Options{Target: target}
+
+	result, err := Restore(fl, blobs, opts)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3), result.Restored)
+	assert.Equal(t, "first", readFile(filepath.Join(target, "a")))
+	assert.Equal(t, "second", readFile(filepath.Join(target, "dir", "b")))
+
+	info, err := os.Stat(filepath.Join(target, "a"))
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+
+	// restored files come out the same as they went in
+	restored, err := filelist.NewFromRoot(target)
+	assert.Nil(t, err)
+	assert.Empty(t, filelist.Diff(fl, restored).Modified)
+	assert.Empty(t, filelist.Diff(fl, restored).Metadata)
+
+	result, err = Restore(fl, blobs, opts)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), result.Restored)
+	assert.Equal(t, uint64(3), result.Unchanged)
+}
+
+func TestRestoreModified(t *testing.T) {
+	root, blobs := newRepo(t, "TestRestoreModified")
+	defer os.RemoveAll(root)
+	defer blobs.Close()
+	target, _ := ioutil.TempDir("", "TestRestoreModifiedTarget")
+	defer os.RemoveAll(target)
+
+	fl := store(t, root, blobs, map[string]string{"a": "first"})
+	_, err := Restore(fl, blobs, &Options{Target: target})
+	assert.Nil(t, err)
+
+	path := filepath.Join(target, "a")
+	ioutil.WriteFile(path, []byte("unsaved"), 0644)
+	_, err = Restore(fl, blobs, &Options{Target: target})
+	assert.NotNil(t, err)
+	assert.Equal(t, "unsaved", readFile(path))
+
+	// a file that matches the latest snapshot has nothing to lose
+	latest := store(t, root, blobs, map[string]string{"a": "unsaved"})
+	_, err = Restore(fl, blobs, &Options{Target: target, Latest: latest})
+	assert.Nil(t, err)
+	assert.Equal(t, "first", readFile(path))
+
+	ioutil.WriteFile(path, []byte("unsaved again"), 0644)
+	_, err = Restore(fl, blobs, &Options{Target: target, Latest: latest})
+	assert.NotNil(t, err)
+	_, err = Restore(fl, blobs, &Options{Target: target, Force: true})
+	assert.Nil(t, err)
+	assert.Equal(t, "first", readFile(path))
+}
+
+func TestRestoreSelect(t *testing.T) {
+	root, blobs := newRepo(t, "TestRestoreSelect")
+	defer os.RemoveAll(root)
+	defer blobs.Close()
+	target, _ := ioutil.TempDir("", "TestRestoreSelectTarget")
+	defer os.RemoveAll(target)
+
+	fl := store(t, root, blobs, map[string]string{"a": "first", "dir/b": "second", "dir2/c": "third"})
+
+	result, err := Restore(fl, blobs, &Options{Target: target, Paths: []string{"dir"}})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), result.Restored)
+
+	names, _ := filelist.Scan(target, nil)
+	assert.Equal(t, []interface{}{"dir", "dir/b"}, names.Files.Keys())
+}
+
+func TestRestoreOutsideTarget(t *testing.T) {
+	root, blobs := newRepo(t, "TestRestoreOutsideTarget")
+	defer os.RemoveAll(root)
+	defer blobs.Close()
+	parent, _ := ioutil.TempDir("", "TestRestoreOutsideTargetParent")
+	defer os.RemoveAll(parent)
+	target := filepath.Join(parent, "target")
+	outside := filepath.Join(parent, "outside")
+	os.Mkdir(target, 0755)
+	os.Mkdir(outside, 0755)
+
+	stored := store(t, root, blobs, map[string]string{"a": "first"})
+	value, _ := stored.Files.Get("a")
+	file := value.(*filelist.FileMetadata)
+
+	// a path that climbs out of the target
+	fl := filelist.New()
+	fl.Add("../outside/escaped", file)
+	_, err := Restore(fl, blobs, &Options{Target: target})
+	assert.NotNil(t, err)
+
+	// a file behind a symlink that the same restore creates
+	fl = filelist.New()
+	fl.Add("link", &filelist.FileMetadata{Type: filelist.TYPE_SYMLINK, Target: outside})
+	fl.Add("link/escaped", file)
+	_, err = Restore(fl, blobs, &Options{Target: target})
+	assert.NotNil(t, err)
+
+	// or one that was already there
+	fl = filelist.New()
+	fl.Add("link/escaped", file)
+	_, err = Restore(fl, blobs, &Options{Target: target, Force: true})
+	assert.NotNil(t, err)
+
+	files, _ := ioutil.ReadDir(outside)
+	assert.Empty(t, files)
+}
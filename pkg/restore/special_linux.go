@@ -0,0 +1,60 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+//go:build linux
+// +build linux
+
+package restore
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/andybug/abakus/pkg/filelist"
+)
+
+// mknod creates the FIFO or device node described by the metadata at path
+func mknod(path string, metadata *filelist.FileMetadata) error {
+	perm := uint32(os.FileMode(metadata.Mode).Perm())
+
+	var err error
+	switch metadata.Type {
+	case filelist.TYPE_FIFO:
+		err = syscall.Mkfifo(path, perm)
+	case filelist.TYPE_CHAR_DEVICE:
+		err = syscall.Mknod(path, syscall.S_IFCHR|perm, mkdev(metadata.Major, metadata.Minor))
+	case filelist.TYPE_BLOCK_DEVICE:
+		err = syscall.Mknod(path, syscall.S_IFBLK|perm, mkdev(metadata.Major, metadata.Minor))
+	default:
+		return unsupported(path, metadata)
+	}
+
+	if err != nil {
+		return &os.PathError{Op: "mknod", Path: path, Err: err}
+	}
+	return nil
+}
+
+// mkdev combines major and minor device numbers the way glibc does
+func mkdev(major uint32, minor uint32) int {
+	dev := (uint64(major)&0xfff)<<8 | (uint64(major)&^0xfff)<<32 |
+		uint64(minor)&0xff | (uint64(minor)&^0xff)<<12
+	return int(dev)
+}
@@ -0,0 +1,104 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+//go:build linux
+// +build linux
+
+package restore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/andybug/abakus/pkg/filelist"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRestoreEntries(t *testing.T) {
+	root, blobs := newRepo(t, "TestRestoreEntries")
+	defer os.RemoveAll(root)
+	defer blobs.Close()
+	target, _ := ioutil.TempDir("", "TestRestoreEntriesTarget")
+	defer os.RemoveAll(target)
+
+	os.MkdirAll(filepath.Join(root, "dir", "empty"), 0755)
+	ioutil.WriteFile(filepath.Join(root, "dir", "file"), []byte("contents"), 0644)
+	os.Link(filepath.Join(root, "dir", "file"), filepath.Join(root, "hardlink"))
+	os.Symlink("dir/file", filepath.Join(root, "symlink"))
+	assert.Nil(t, syscall.Mkfifo(filepath.Join(root, "fifo"), 0600))
+
+	// the directory's mtime survives its contents being written, and its
+	// mode does not stop them being written
+	mtime := time.Unix(1500000000, 123456789)
+	os.Chtimes(filepath.Join(root, "dir"), mtime, mtime)
+	os.Chmod(filepath.Join(root, "dir"), 0555)
+	defer os.Chmod(filepath.Join(root, "dir"), 0755)
+	defer os.Chmod(filepath.Join(target, "dir"), 0755)
+
+	fl := store(t, root, blobs, nil)
+	result, err := Restore(fl, blobs, &Options{Target: target})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(fl.Files.Size()), result.Restored)
+
+	info, err := os.Stat(filepath.Join(target, "dir"))
+	assert.Nil(t, err)
+	assert.True(t, mtime.Equal(info.ModTime()))
+	assert.Equal(t, os.FileMode(0555), info.Mode().Perm())
+
+	info, err = os.Stat(filepath.Join(target, "dir", "empty"))
+	assert.Nil(t, err)
+	assert.True(t, info.IsDir())
+
+	// the hard link is linked to the first file of its group
+	first, _ := os.Stat(filepath.Join(target, "dir", "file"))
+	second, _ := os.Stat(filepath.Join(target, "hardlink"))
+	assert.True(t, os.SameFile(first, second))
+
+	link, err := os.Readlink(filepath.Join(target, "symlink"))
+	assert.Nil(t, err)
+	assert.Equal(t, "dir/file", link)
+
+	info, err = os.Lstat(filepath.Join(target, "fifo"))
+	assert.Nil(t, err)
+	assert.NotZero(t, info.Mode()&os.ModeNamedPipe)
+
+	// everything matches what was scanned
+	restored, err := filelist.Scan(target, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, restored.Hash(target, 1))
+	diff := filelist.Diff(fl, restored)
+	assert.Empty(t, diff.Added)
+	assert.Empty(t, diff.Modified)
+	assert.Empty(t, diff.Metadata)
+	assert.Empty(t, diff.Deleted)
+
+	// a copy where a hard link should be becomes a link again
+	os.Remove(filepath.Join(target, "hardlink"))
+	ioutil.WriteFile(filepath.Join(target, "hardlink"), []byte("contents"), 0644)
+	result, err = Restore(fl, blobs, &Options{Target: target})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), result.Restored)
+	second, _ = os.Stat(filepath.Join(target, "hardlink"))
+	assert.True(t, os.SameFile(first, second))
+}
@@ -0,0 +1,58 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+//go:build linux
+// +build linux
+
+package restore
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/andybug/abakus/pkg/filelist"
+)
+
+// writeXattrs sets the extended attributes and ACLs of the file at path.
+// Attributes that the filesystem does not support, or that need privileges
+// this process does not have, are skipped.
+func writeXattrs(path string, metadata *filelist.FileMetadata) error {
+	xattrs := make(map[string][]byte)
+	for name, value := range metadata.Xattrs {
+		xattrs[name] = value
+	}
+	if metadata.ACL != nil {
+		xattrs[filelist.XATTR_ACL_ACCESS] = metadata.ACL
+	}
+	if metadata.DefaultACL != nil {
+		xattrs[filelist.XATTR_ACL_DEFAULT] = metadata.DefaultACL
+	}
+
+	for name, value := range xattrs {
+		err := syscall.Setxattr(path, name, value, 0)
+		if err == syscall.ENOTSUP || err == syscall.EPERM {
+			continue
+		} else if err != nil {
+			return &os.PathError{Op: "setxattr " + name, Path: path, Err: err}
+		}
+	}
+
+	return nil
+}
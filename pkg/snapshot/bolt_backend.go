@@ -28,6 +28,7 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/andybug/abakus/pkg/crypt"
 	"github.com/andybug/abakus/pkg/filelist"
 	"github.com/boltdb/bolt"
 )
@@ -36,14 +37,35 @@ import (
 // a SnapshotMetadata object in json
 const BOLT_METADATA_KEY = "__abakus.metadata"
 
-// bolt_backend wraps the bolt db handle
+// BOLT_META_BUCKET is the bucket that holds repository-wide bookkeeping
+// rather than a snapshot
+const BOLT_META_BUCKET = "abakus:meta"
+
+// BOLT_LATEST_KEY is the key in the meta bucket that holds the highest
+// snapshot id ever created, so ids are not reused after a delete
+const BOLT_LATEST_KEY = "latest"
+
+// BOLT_CHECKPOINT_BUCKET is the bucket that holds the files stored so far
+// by a create that has not finished
+const BOLT_CHECKPOINT_BUCKET = "abakus:checkpoint"
+
+// bolt_backend wraps the bolt db handle. If key is set, every record is
+// sealed and file records are stored under keyed hashes of their paths.
 type bolt_backend struct {
 	dbPath string
 	db     *bolt.DB
+	key    *crypt.MasterKey
+}
+
+// bolt_fileRecord is the value stored for a file in an encrypted snapshot,
+// since the bucket key no longer holds the path
+type bolt_fileRecord struct {
+	Path     string                 `json:"path"`
+	Metadata *filelist.FileMetadata `json:"metadata"`
 }
 
 // newBoltBackend opens the snapshot db and returns the bolt_backend
-func newBoltBackend(dbPath string) (backend, error) {
+func newBoltBackend(dbPath string, key *crypt.MasterKey) (backend, error) {
 	db, err := bolt.Open(dbPath, 0644, nil)
 	if err != nil {
 		return nil, err
@@ -52,6 +74,7 @@ func newBoltBackend(dbPath string) (backend, error) {
 	b := &bolt_backend{
 		dbPath: dbPath,
 		db:     db,
+		key:    key,
 	}
 
 	return b, nil
@@ -67,6 +90,19 @@ func (b bolt_backend) readMetadata(metadataMap map[uint64]*SnapshotMetadata) (ui
 	err := b.db.View(func(tx *bolt.Tx) error {
 		// iterate over every bucket
 		return tx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+			// the meta bucket remembers the latest id even if that
+			// snapshot has since been deleted
+			if string(name) == BOLT_META_BUCKET {
+				id := bolt_readLatest(bucket)
+				if id > latest {
+					latest = id
+				}
+				return nil
+			}
+			if string(name) == BOLT_CHECKPOINT_BUCKET {
+				return nil
+			}
+
 			// match bucket name to expected format
 			groups := re.FindStringSubmatch(string(name))
 			if len(groups) != 2 {
@@ -83,9 +119,12 @@ func (b bolt_backend) readMetadata(metadataMap map[uint64]*SnapshotMetadata) (ui
 				latest = id
 			}
 
-			metadataJson := bucket.Get([]byte(BOLT_METADATA_KEY))
-			metadata := new(SnapshotMetadata)
+			metadataJson, err := b.open(bucket.Get([]byte(BOLT_METADATA_KEY)))
+			if err != nil {
+				return err
+			}
 
+			metadata := new(SnapshotMetadata)
 			err = json.Unmarshal(metadataJson, metadata)
 			if err != nil {
 				return err
@@ -108,60 +147,223 @@ func (b bolt_backend) readMetadata(metadataMap map[uint64]*SnapshotMetadata) (ui
 // createSnapshot takes a file list and id and writes a new snapshot to the
 // database. each snapshot is in its own bucket. it returns the metadata for
 // the created snapshot
-func (b bolt_backend) createSnapshot(fl *filelist.FileList, id uint64) (*SnapshotMetadata, error) {
-	timestamp := time.Now().Unix()
-	merkle := fl.MerkleRoot()
+func (b bolt_backend) createSnapshot(fl *filelist.FileList, id uint64, warnings []string) (*SnapshotMetadata, error) {
 	var size uint64 = 0
 	var fileCount uint64 = 0
-	var snapshotMetadata *SnapshotMetadata = nil
 
-	err := b.db.Update(func(tx *bolt.Tx) error {
+	it := fl.Files.Iterator()
+	for it.Next() {
+		metadata := it.Value().(*filelist.FileMetadata)
+		if metadata.Type == filelist.TYPE_DIRECTORY {
+			continue
+		}
+		fileCount += 1
+		size += metadata.Size
+	}
+
+	snapshotMetadata := &SnapshotMetadata{
+		Id:         id,
+		Timestamp:  time.Now().Unix(),
+		MerkleRoot: fl.MerkleRoot(),
+		FileCount:  fileCount,
+		Size:       size,
+		Warnings:   warnings,
+	}
+
+	// the checkpoint of the create is dropped in the same transaction
+	err := b.writeSnapshot(fl, snapshotMetadata, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return snapshotMetadata, nil
+}
+
+// importSnapshot writes a snapshot that was created elsewhere (such as one
+// pulled from a remote), keeping its id and metadata
+func (b bolt_backend) importSnapshot(snapshot *Snapshot) error {
+	return b.writeSnapshot(snapshot.Files, snapshot.Metadata, false)
+}
+
+// writeSnapshot creates the bucket for the snapshot and fills it with the
+// file list and metadata, and deletes any checkpoint if clearCheckpoint is
+// true
+func (b bolt_backend) writeSnapshot(fl *filelist.FileList, snapshotMetadata *SnapshotMetadata, clearCheckpoint bool) error {
+	id := snapshotMetadata.Id
+
+	return b.db.Update(func(tx *bolt.Tx) error {
 		bucketName := fmt.Sprintf("snapshot:%d", id)
 		bucket, err := tx.CreateBucket([]byte(bucketName))
 		if err != nil {
 			return err
 		}
 
-		it := fl.Files.Iterator()
-		for it.Next() {
-			metadata := it.Value().(*filelist.FileMetadata)
-			jsonMetadata, err := json.Marshal(metadata)
+		jsonSnapshotMetadata, err := json.Marshal(snapshotMetadata)
+		if err != nil {
+			return err
+		}
+
+		err = b.writeBucket(bucket, fl, jsonSnapshotMetadata)
+		if err != nil {
+			return err
+		}
+
+		if clearCheckpoint {
+			if err = bolt_deleteCheckpoint(tx); err != nil {
+				return err
+			}
+		}
+
+		return bolt_writeLatest(tx, id)
+	})
+}
+
+// writeBucket fills a snapshot bucket with the file list and the json
+// snapshot metadata. The checkpoint bucket has no metadata, so it is nil.
+func (b bolt_backend) writeBucket(bucket *bolt.Bucket, fl *filelist.FileList, jsonSnapshotMetadata []byte) error {
+	it := fl.Files.Iterator()
+	for it.Next() {
+		metadata := it.Value().(*filelist.FileMetadata)
+		key, value, err := b.encodeFile(it.Key().(string), metadata)
+		if err != nil {
+			return err
+		}
+
+		err = bucket.Put(key, value)
+		if err != nil {
+			return err
+		}
+	}
+
+	if jsonSnapshotMetadata == nil {
+		return nil
+	}
+
+	sealed, err := b.seal(jsonSnapshotMetadata)
+	if err != nil {
+		return err
+	}
+
+	return bucket.Put([]byte(BOLT_METADATA_KEY), sealed)
+}
+
+// rekey rewrites every snapshot sealed with the new key. The new key must
+// still be able to open the old records (see crypt.MasterKey.Rotate).
+func (b *bolt_backend) rekey(key *crypt.MasterKey) error {
+	next := bolt_backend{dbPath: b.dbPath, db: b.db, key: key}
+
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		var names []string
+		err := tx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+			if string(name) != BOLT_META_BUCKET {
+				names = append(names, string(name))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			bucket := tx.Bucket([]byte(name))
+			fl, err := b.readFileList(bucket)
 			if err != nil {
 				return err
 			}
 
-			err = bucket.Put([]byte(it.Key().(string)), []byte(jsonMetadata))
+			var jsonSnapshotMetadata []byte
+			if name != BOLT_CHECKPOINT_BUCKET {
+				jsonSnapshotMetadata, err = b.open(bucket.Get([]byte(BOLT_METADATA_KEY)))
+				if err != nil {
+					return err
+				}
+			}
+
+			if err = tx.DeleteBucket([]byte(name)); err != nil {
+				return err
+			}
+
+			bucket, err = tx.CreateBucket([]byte(name))
 			if err != nil {
 				return err
 			}
 
-			fileCount += 1
-			size += metadata.Size
+			err = next.writeBucket(bucket, fl, jsonSnapshotMetadata)
+			if err != nil {
+				return err
+			}
 		}
 
-		snapshotMetadata = &SnapshotMetadata{
-			Id:         id,
-			Timestamp:  timestamp,
-			MerkleRoot: merkle,
-			FileCount:  fileCount,
-			Size:       size,
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	b.key = key
+	return nil
+}
+
+// deleteSnapshot removes the bucket for the snapshot id
+func (b bolt_backend) deleteSnapshot(id uint64) error {
+	bucketName := fmt.Sprintf("snapshot:%d", id)
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+		err := tx.DeleteBucket([]byte(bucketName))
+		if err == bolt.ErrBucketNotFound {
+			return errors.New(fmt.Sprintf("No snapshot with id %d", id))
 		}
 
-		jsonSnapshotMetadata, err := json.Marshal(snapshotMetadata)
+		return err
+	})
+}
+
+// addCheckpoint adds the files to the checkpoint bucket, creating it if
+// needed
+func (b bolt_backend) addCheckpoint(fl *filelist.FileList) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(BOLT_CHECKPOINT_BUCKET))
 		if err != nil {
 			return err
 		}
-		err = bucket.Put([]byte(BOLT_METADATA_KEY), jsonSnapshotMetadata)
 
+		return b.writeBucket(bucket, fl, nil)
+	})
+}
+
+// getCheckpoint returns the files in the checkpoint bucket, or nil if there
+// is no checkpoint
+func (b bolt_backend) getCheckpoint() (*filelist.FileList, error) {
+	var fl *filelist.FileList
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(BOLT_CHECKPOINT_BUCKET))
+		if bucket == nil {
+			return nil
+		}
+
+		var err error
+		fl, err = b.readFileList(bucket)
 		return err
 	})
 
-	if err != nil {
-		return nil, err
-	}
+	return fl, err
+}
 
-	return snapshotMetadata, nil
+// clearCheckpoint deletes the checkpoint bucket
+func (b bolt_backend) clearCheckpoint() error {
+	return b.db.Update(bolt_deleteCheckpoint)
+}
 
+// bolt_deleteCheckpoint deletes the checkpoint bucket if there is one
+func bolt_deleteCheckpoint(tx *bolt.Tx) error {
+	err := tx.DeleteBucket([]byte(BOLT_CHECKPOINT_BUCKET))
+	if err == bolt.ErrBucketNotFound {
+		return nil
+	}
+
+	return err
 }
 
 // getSnapshotFiles returns the file list associated with the snapshot id. the
@@ -178,7 +380,7 @@ func (b bolt_backend) getSnapshotFiles(id uint64) (*filelist.FileList, error) {
 		}
 
 		var err error
-		fl, err = bolt_readFileList(bucket)
+		fl, err = b.readFileList(bucket)
 
 		return err
 	})
@@ -190,19 +392,16 @@ func (b bolt_backend) getSnapshotFiles(id uint64) (*filelist.FileList, error) {
 	return fl, nil
 }
 
-// bolt_readFileList iterates over the keys in a bucket, ignore the metadata
+// readFileList iterates over the keys in a bucket, ignore the metadata
 // key, and builds a file list from the rest
-func bolt_readFileList(bucket *bolt.Bucket) (*filelist.FileList, error) {
+func (b bolt_backend) readFileList(bucket *bolt.Bucket) (*filelist.FileList, error) {
 	var fl = filelist.New()
 	err := bucket.ForEach(func(key []byte, value []byte) error {
-		path := string(key)
-		if path == BOLT_METADATA_KEY {
+		if string(key) == BOLT_METADATA_KEY {
 			return nil
 		}
 
-		metadata := new(filelist.FileMetadata)
-
-		err := json.Unmarshal(value, metadata)
+		path, metadata, err := b.decodeFile(key, value)
 		if err != nil {
 			return err
 		}
@@ -218,6 +417,100 @@ func bolt_readFileList(bucket *bolt.Bucket) (*filelist.FileList, error) {
 	return fl, nil
 }
 
+// encodeFile returns the bucket key and value for a file. Unencrypted
+// snapshots use the path as the key and the json metadata as the value.
+func (b bolt_backend) encodeFile(path string, metadata *filelist.FileMetadata) ([]byte, []byte, error) {
+	if b.key == nil {
+		value, err := json.Marshal(metadata)
+		return []byte(path), value, err
+	}
+
+	value, err := json.Marshal(&bolt_fileRecord{Path: path, Metadata: metadata})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	value, err = b.key.Seal(value)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return []byte(b.key.Name([]byte(path))), value, nil
+}
+
+// decodeFile returns the path and metadata stored in a bucket entry
+func (b bolt_backend) decodeFile(key []byte, value []byte) (string, *filelist.FileMetadata, error) {
+	if b.key == nil {
+		metadata := new(filelist.FileMetadata)
+		err := json.Unmarshal(value, metadata)
+		return string(key), metadata, err
+	}
+
+	plaintext, err := b.key.Open(value)
+	if err != nil {
+		return "", nil, err
+	}
+
+	record := new(bolt_fileRecord)
+	if err = json.Unmarshal(plaintext, record); err != nil {
+		return "", nil, err
+	}
+
+	if record.Metadata == nil {
+		return "", nil, errors.New(fmt.Sprintf("invalid file record for '%s'", record.Path))
+	}
+
+	return record.Path, record.Metadata, nil
+}
+
+// seal encrypts a value if the backend has a key
+func (b bolt_backend) seal(value []byte) ([]byte, error) {
+	if b.key == nil {
+		return value, nil
+	}
+
+	return b.key.Seal(value)
+}
+
+// open decrypts a value sealed by seal
+func (b bolt_backend) open(value []byte) ([]byte, error) {
+	if b.key == nil {
+		return value, nil
+	}
+
+	return b.key.Open(value)
+}
+
+// bolt_readLatest returns the latest id recorded in the meta bucket
+func bolt_readLatest(bucket *bolt.Bucket) uint64 {
+	value := bucket.Get([]byte(BOLT_LATEST_KEY))
+	if value == nil {
+		return 0
+	}
+
+	id, err := strconv.ParseUint(string(value), 10, 64)
+	if err != nil {
+		return 0
+	}
+
+	return id
+}
+
+// bolt_writeLatest records id in the meta bucket if it is higher than the
+// one already there
+func bolt_writeLatest(tx *bolt.Tx, id uint64) error {
+	bucket, err := tx.CreateBucketIfNotExists([]byte(BOLT_META_BUCKET))
+	if err != nil {
+		return err
+	}
+
+	if bolt_readLatest(bucket) >= id {
+		return nil
+	}
+
+	return bucket.Put([]byte(BOLT_LATEST_KEY), []byte(strconv.FormatUint(id, 10)))
+}
+
 // close closes the bolt database
 func (b bolt_backend) close() {
 	b.db.Close()
@@ -0,0 +1,99 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package snapshot
+
+import (
+	"github.com/andybug/abakus/pkg/filelist"
+)
+
+// FileVersion describes a run of consecutive snapshots in which a file was
+// unchanged (or absent)
+// Event - "added", "modified", or "deleted" compared to the previous run
+// First, Last - the metadata of the first and last snapshot in the run
+// Ids - the ids of every snapshot in the run, which need not be contiguous
+// once snapshots are deleted
+// Metadata - the file's metadata in the run, nil if deleted
+type FileVersion struct {
+	Event    string
+	First    *SnapshotMetadata
+	Last     *SnapshotMetadata
+	Ids      []uint64
+	Metadata *filelist.FileMetadata
+}
+
+// FileHistory walks the snapshots in id order and returns every version of
+// the file at the relative path. A new version starts whenever the file's
+// hash or mode changes, or it is deleted or re-created.
+func (store *Store) FileHistory(relPath string) ([]*FileVersion, error) {
+	var versions []*FileVersion
+	var current *FileVersion = nil
+
+	for _, metadata := range store.GetAllMetadata() {
+		fl, err := store.backend.getSnapshotFiles(metadata.Id)
+		if err != nil {
+			return nil, err
+		}
+
+		var fileMetadata *filelist.FileMetadata = nil
+		if value, found := fl.Files.Get(relPath); found {
+			fileMetadata = value.(*filelist.FileMetadata)
+		}
+
+		if current == nil && fileMetadata == nil {
+			// the file has not been created yet
+			continue
+		}
+
+		if current != nil && sameVersion(current.Metadata, fileMetadata) {
+			current.Last = metadata
+			current.Ids = append(current.Ids, metadata.Id)
+			continue
+		}
+
+		event := "modified"
+		if current == nil || current.Metadata == nil {
+			event = "added"
+		} else if fileMetadata == nil {
+			event = "deleted"
+		}
+
+		current = &FileVersion{
+			Event:    event,
+			First:    metadata,
+			Last:     metadata,
+			Ids:      []uint64{metadata.Id},
+			Metadata: fileMetadata,
+		}
+		versions = append(versions, current)
+	}
+
+	return versions, nil
+}
+
+// sameVersion returns true if both are absent or have the same contents and
+// mode
+func sameVersion(a *filelist.FileMetadata, b *filelist.FileMetadata) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+
+	return a.SameContents(b) && a.Mode == b.Mode
+}
@@ -0,0 +1,112 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package snapshot
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/andybug/abakus/pkg/filelist"
+	"github.com/andybug/abakus/pkg/repo"
+	"github.com/stretchr/testify/assert"
+)
+
+// scanSnapshot scans the repository and creates a snapshot of it
+func scanSnapshot(t *testing.T, store *Store, root string) {
+	fl, err := filelist.NewFromRoot(root)
+	assert.Nil(t, err)
+	_, err = store.CreateSnapshot(fl, nil)
+	assert.Nil(t, err)
+}
+
+// versionIds returns the ids of the snapshots in each version
+func versionIds(versions []*FileVersion) [][]uint64 {
+	ids := make([][]uint64, 0, len(versions))
+	for _, version := range versions {
+		ids = append(ids, version.Ids)
+	}
+	return ids
+}
+
+func TestFileHistory(t *testing.T) {
+	root, _ := ioutil.TempDir("", "TestFileHistory")
+	defer os.RemoveAll(root)
+	repo.Create(root)
+
+	store, err := GetStore(root, nil)
+	assert.Nil(t, err)
+	defer store.Close()
+
+	path := filepath.Join(root, "a")
+	ioutil.WriteFile(filepath.Join(root, "other"), []byte("other"), 0644)
+
+	scanSnapshot(t, store, root) // 1: not created yet
+	ioutil.WriteFile(path, []byte("first"), 0644)
+	scanSnapshot(t, store, root) // 2: added
+	scanSnapshot(t, store, root) // 3: unchanged
+	ioutil.WriteFile(path, []byte("second"), 0644)
+	scanSnapshot(t, store, root) // 4: modified
+	os.Chmod(path, 0600)
+	scanSnapshot(t, store, root) // 5: mode changed
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(path, later, later)
+	scanSnapshot(t, store, root) // 6: only the mtime changed
+	os.Remove(path)
+	scanSnapshot(t, store, root) // 7: deleted
+	scanSnapshot(t, store, root) // 8: still deleted
+	ioutil.WriteFile(path, []byte("first"), 0644)
+	scanSnapshot(t, store, root) // 9: re-created
+
+	// a deleted snapshot leaves a gap in the ids of its version
+	assert.Nil(t, store.DeleteSnapshot(3))
+
+	versions, err := store.FileHistory("a")
+	assert.Nil(t, err)
+	assert.Equal(t, [][]uint64{{2}, {4}, {5, 6}, {7, 8}, {9}}, versionIds(versions))
+
+	events := make([]string, 0, len(versions))
+	for _, version := range versions {
+		events = append(events, version.Event)
+	}
+	assert.Equal(t, []string{"added", "modified", "modified", "deleted", "added"}, events)
+
+	assert.Equal(t, uint64(5), versions[0].Metadata.Size)
+	assert.Equal(t, uint64(6), versions[1].Metadata.Size)
+	assert.Equal(t, versions[1].Metadata.Hash, versions[2].Metadata.Hash)
+	assert.Equal(t, uint32(0600), versions[2].Metadata.Mode&0777)
+	assert.Nil(t, versions[3].Metadata)
+	assert.Equal(t, versions[0].Metadata.Hash, versions[4].Metadata.Hash)
+	assert.Equal(t, uint64(2), versions[0].First.Id)
+	assert.Equal(t, uint64(6), versions[2].Last.Id)
+
+	// an unchanged file is a single version
+	versions, err = store.FileHistory("other")
+	assert.Nil(t, err)
+	assert.Equal(t, [][]uint64{{1, 2, 4, 5, 6, 7, 8, 9}}, versionIds(versions))
+	assert.Equal(t, "added", versions[0].Event)
+
+	versions, err = store.FileHistory("missing")
+	assert.Nil(t, err)
+	assert.Empty(t, versions)
+}
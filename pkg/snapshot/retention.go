@@ -0,0 +1,118 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package snapshot
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/andybug/abakus/pkg/repo"
+)
+
+// RetentionResult lists the snapshots that a retention policy keeps, the
+// reasons each was kept, and the snapshots that should be removed. Both
+// lists are ordered from newest to oldest.
+type RetentionResult struct {
+	Keep    []*SnapshotMetadata
+	Remove  []*SnapshotMetadata
+	Reasons map[uint64][]string
+}
+
+// retentionWindow maps a snapshot time to the bucket it falls in for one
+// of the policy's windows (hour, day, ...)
+type retentionWindow struct {
+	reason string
+	count  int
+	bucket func(time.Time) string
+}
+
+// ApplyRetention sorts the snapshots into those the policy keeps and those it
+// removes. Snapshots are walked from newest to oldest; for each window, the
+// newest snapshot in each distinct bucket is kept until the window's count
+// is used up (grandfather-father-son). An empty policy keeps everything.
+func ApplyRetention(policy *repo.RetentionPolicy, metadataList []*SnapshotMetadata) *RetentionResult {
+	sorted := make([]*SnapshotMetadata, len(metadataList))
+	copy(sorted, metadataList)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Timestamp == sorted[j].Timestamp {
+			return sorted[i].Id > sorted[j].Id
+		}
+		return sorted[i].Timestamp > sorted[j].Timestamp
+	})
+
+	result := &RetentionResult{
+		Reasons: make(map[uint64][]string),
+	}
+
+	if policy.Empty() {
+		result.Keep = sorted
+		return result
+	}
+
+	windows := []*retentionWindow{
+		{"last", policy.Last, func(t time.Time) string { return "" }},
+		{"hourly", policy.Hourly, func(t time.Time) string { return t.Format("2006-01-02 15") }},
+		{"daily", policy.Daily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{"weekly", policy.Weekly, weekBucket},
+		{"monthly", policy.Monthly, func(t time.Time) string { return t.Format("2006-01") }},
+		{"yearly", policy.Yearly, func(t time.Time) string { return t.Format("2006") }},
+	}
+	lastBuckets := make([]string, len(windows))
+
+	for i, metadata := range sorted {
+		t := time.Unix(metadata.Timestamp, 0)
+
+		for w, window := range windows {
+			if window.count <= 0 {
+				continue
+			}
+
+			// every snapshot is its own bucket for keep-last
+			bucket := window.bucket(t)
+			if window.reason == "last" {
+				bucket = fmt.Sprintf("%d", i)
+			}
+
+			if i > 0 && bucket == lastBuckets[w] {
+				continue
+			}
+
+			lastBuckets[w] = bucket
+			window.count -= 1
+			result.Reasons[metadata.Id] = append(result.Reasons[metadata.Id], window.reason)
+		}
+
+		if len(result.Reasons[metadata.Id]) > 0 {
+			result.Keep = append(result.Keep, metadata)
+		} else {
+			result.Remove = append(result.Remove, metadata)
+		}
+	}
+
+	return result
+}
+
+// weekBucket returns the ISO year and week of the time
+func weekBucket(t time.Time) string {
+	year, week := t.ISOWeek()
+	return fmt.Sprintf("%d-%02d", year, week)
+}
@@ -0,0 +1,104 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package snapshot
+
+import (
+	"testing"
+	"time"
+
+	"github.com/andybug/abakus/pkg/repo"
+	"github.com/stretchr/testify/assert"
+)
+
+// dailySnapshots returns one snapshot per day at noon going back n days
+// from the given day; id 1 is the oldest
+func dailySnapshots(from time.Time, n int) []*SnapshotMetadata {
+	var list []*SnapshotMetadata
+	for i := 0; i < n; i++ {
+		t := from.AddDate(0, 0, -(n - 1 - i))
+		list = append(list, &SnapshotMetadata{
+			Id:        uint64(i + 1),
+			Timestamp: t.Unix(),
+		})
+	}
+
+	return list
+}
+
+func keptIds(result *RetentionResult) []uint64 {
+	var ids []uint64
+	for _, metadata := range result.Keep {
+		ids = append(ids, metadata.Id)
+	}
+
+	return ids
+}
+
+func TestRetentionEmptyPolicy(t *testing.T) {
+	from := time.Date(2018, 6, 15, 12, 0, 0, 0, time.Local)
+	list := dailySnapshots(from, 5)
+
+	result := ApplyRetention(&repo.RetentionPolicy{}, list)
+	assert.Equal(t, 5, len(result.Keep))
+	assert.Equal(t, 0, len(result.Remove))
+}
+
+func TestRetentionKeepLast(t *testing.T) {
+	from := time.Date(2018, 6, 15, 12, 0, 0, 0, time.Local)
+	list := dailySnapshots(from, 5)
+
+	result := ApplyRetention(&repo.RetentionPolicy{Last: 2}, list)
+	assert.Equal(t, []uint64{5, 4}, keptIds(result))
+	assert.Equal(t, 3, len(result.Remove))
+	assert.Equal(t, []string{"last"}, result.Reasons[5])
+}
+
+func TestRetentionDailySameDay(t *testing.T) {
+	day := time.Date(2018, 6, 15, 0, 0, 0, 0, time.Local)
+	list := []*SnapshotMetadata{
+		{Id: 1, Timestamp: day.Add(1 * time.Hour).Unix()},
+		{Id: 2, Timestamp: day.Add(2 * time.Hour).Unix()},
+		{Id: 3, Timestamp: day.Add(26 * time.Hour).Unix()},
+	}
+
+	// only the newest snapshot of each day is kept
+	result := ApplyRetention(&repo.RetentionPolicy{Daily: 7}, list)
+	assert.Equal(t, []uint64{3, 2}, keptIds(result))
+	assert.Equal(t, uint64(1), result.Remove[0].Id)
+}
+
+func TestRetentionGrandfatherFatherSon(t *testing.T) {
+	from := time.Date(2018, 6, 15, 12, 0, 0, 0, time.Local)
+	list := dailySnapshots(from, 90)
+
+	policy := &repo.RetentionPolicy{Daily: 7, Weekly: 4, Monthly: 3}
+	result := ApplyRetention(policy, list)
+
+	// the newest snapshot is kept by every window
+	assert.Equal(t, []string{"daily", "weekly", "monthly"}, result.Reasons[90])
+
+	// the last day of may is the newest snapshot in that month
+	may31 := uint64(90 - 15)
+	assert.Contains(t, result.Reasons[may31], "monthly")
+
+	assert.Equal(t, 90, len(result.Keep)+len(result.Remove))
+	assert.True(t, len(result.Keep) <= 7+4+3)
+}
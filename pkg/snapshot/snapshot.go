@@ -21,18 +21,25 @@
 package snapshot
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
 	"github.com/andybug/abakus/pkg/filelist"
 )
 
 // SnapshotMetadata contains all of the metadata about a snapshot
 // It only lacks the file list. The snapshot store maintains a mapping
-// of all of the metadata.
+// of all of the metadata. Warnings describes anything that went wrong while
+// the snapshot was created, such as files that changed as they were read.
 type SnapshotMetadata struct {
-	Id         uint64 `json:"-"`
-	Timestamp  int64  `json:"timestamp"`
-	MerkleRoot []byte `json:"merkle"`
-	FileCount  uint64 `json:"files"`
-	Size       uint64 `json:"size"`
+	Id         uint64   `json:"-"`
+	Timestamp  int64    `json:"timestamp"`
+	MerkleRoot []byte   `json:"merkle"`
+	FileCount  uint64   `json:"files"`
+	Size       uint64   `json:"size"`
+	Warnings   []string `json:"warnings,omitempty"`
 }
 
 // Snapshot contains the metadata and data of a snapshot
@@ -40,3 +47,67 @@ type Snapshot struct {
 	Metadata *SnapshotMetadata
 	Files    *filelist.FileList
 }
+
+// encodedSnapshot is the json representation of a complete snapshot that is
+// used to move snapshots between repositories
+type encodedSnapshot struct {
+	Id       uint64                            `json:"id"`
+	Metadata *SnapshotMetadata                 `json:"metadata"`
+	Files    map[string]*filelist.FileMetadata `json:"files"`
+}
+
+// Encode serializes the snapshot's metadata and file list to json
+func Encode(snapshot *Snapshot) ([]byte, error) {
+	encoded := encodedSnapshot{
+		Id:       snapshot.Metadata.Id,
+		Metadata: snapshot.Metadata,
+		Files:    make(map[string]*filelist.FileMetadata),
+	}
+
+	it := snapshot.Files.Files.Iterator()
+	for it.Next() {
+		encoded.Files[it.Key().(string)] = it.Value().(*filelist.FileMetadata)
+	}
+
+	return json.Marshal(&encoded)
+}
+
+// Decode deserializes a snapshot created by Encode and checks that the file
+// list matches the merkle root in the metadata. Since anyone who can write
+// the snapshot can recompute its merkle root, the paths are checked too.
+func Decode(data []byte) (*Snapshot, error) {
+	var encoded encodedSnapshot
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return nil, err
+	}
+
+	if encoded.Metadata == nil {
+		return nil, errors.New("Snapshot has no metadata")
+	}
+	encoded.Metadata.Id = encoded.Id
+
+	fl := filelist.New()
+	for path, metadata := range encoded.Files {
+		if metadata == nil {
+			errMsg := fmt.Sprintf("Snapshot %d has no metadata for %q", encoded.Id, path)
+			return nil, errors.New(errMsg)
+		}
+		fl.Add(path, metadata)
+	}
+
+	if err := fl.CheckPaths(); err != nil {
+		return nil, errors.New(fmt.Sprintf("Snapshot %d: %s", encoded.Id, err))
+	}
+
+	if !bytes.Equal(fl.MerkleRoot(), encoded.Metadata.MerkleRoot) {
+		errMsg := fmt.Sprintf("Snapshot %d does not match its merkle root", encoded.Id)
+		return nil, errors.New(errMsg)
+	}
+
+	snapshot := &Snapshot{
+		Metadata: encoded.Metadata,
+		Files:    fl,
+	}
+
+	return snapshot, nil
+}
@@ -23,7 +23,9 @@ package snapshot
 import (
 	"errors"
 	"fmt"
+	"sort"
 
+	"github.com/andybug/abakus/pkg/crypt"
 	"github.com/andybug/abakus/pkg/filelist"
 	"github.com/andybug/abakus/pkg/repo"
 )
@@ -31,24 +33,32 @@ import (
 // backend is an interface that snapshot storage mechanisms must implement
 type backend interface {
 	readMetadata(map[uint64]*SnapshotMetadata) (uint64, error)
-	createSnapshot(*filelist.FileList, uint64) (*SnapshotMetadata, error)
+	createSnapshot(*filelist.FileList, uint64, []string) (*SnapshotMetadata, error)
 	getSnapshotFiles(uint64) (*filelist.FileList, error)
+	importSnapshot(*Snapshot) error
+	deleteSnapshot(uint64) error
+	rekey(*crypt.MasterKey) error
+	addCheckpoint(*filelist.FileList) error
+	getCheckpoint() (*filelist.FileList, error)
+	clearCheckpoint() error
 	close()
 }
 
 // Store maintains a mapping of snapshot metadata for all snapshots, the
-// database backend, and the latest snapshot
+// database backend, the latest snapshot, and the highest id ever assigned
 type Store struct {
 	root     string
 	backend  backend
 	metadata map[uint64]*SnapshotMetadata
 	latest   uint64
+	lastId   uint64
 }
 
-// GetStore returns a new snapshot Store
-func GetStore(root string) (*Store, error) {
+// GetStore returns a new snapshot Store. key is nil for an unencrypted
+// repository.
+func GetStore(root string, key *crypt.MasterKey) (*Store, error) {
 	dbPath := repo.GetSnapshotsDbPath(root)
-	backend, err := newBoltBackend(dbPath)
+	backend, err := newBoltBackend(dbPath, key)
 	if err != nil {
 		return nil, err
 	}
@@ -60,28 +70,32 @@ func GetStore(root string) (*Store, error) {
 		latest:   0,
 	}
 
-	latest, err := store.backend.readMetadata(store.metadata)
+	lastId, err := store.backend.readMetadata(store.metadata)
 	if err != nil {
+		backend.close()
 		return nil, err
 	}
 
-	store.latest = latest
+	store.lastId = lastId
+	store.updateLatest()
 	return &store, nil
 }
 
 // CreateSnapshot asks the backend to write a new snapshot with the given
-// file list and id (latest + 1). The metadata for the new snapshot is added
-// to the internal mapping and returned.
-func (store *Store) CreateSnapshot(fl *filelist.FileList) (*SnapshotMetadata, error) {
-	id := store.latest + 1
+// file list and the next unused id, recording the warnings (which may be nil)
+// in its metadata. The metadata for the new snapshot is added to the internal
+// mapping and returned.
+func (store *Store) CreateSnapshot(fl *filelist.FileList, warnings []string) (*SnapshotMetadata, error) {
+	id := store.lastId + 1
 
-	snapshotMetadata, err := store.backend.createSnapshot(fl, id)
+	snapshotMetadata, err := store.backend.createSnapshot(fl, id, warnings)
 	if err != nil {
 		return nil, err
 	}
 
 	store.metadata[id] = snapshotMetadata
 	store.latest = id
+	store.lastId = id
 	return snapshotMetadata, nil
 }
 
@@ -107,6 +121,105 @@ func (store *Store) GetSnapshot(id uint64) (*Snapshot, error) {
 	return snapshot, nil
 }
 
+// ImportSnapshot asks the backend to write a snapshot that was created in
+// another repository, keeping its id. It is an error if a snapshot with
+// that id already exists.
+func (store *Store) ImportSnapshot(snapshot *Snapshot) error {
+	id := snapshot.Metadata.Id
+	if store.metadata[id] != nil {
+		return errors.New(fmt.Sprintf("Snapshot %d already exists", id))
+	}
+
+	if err := store.backend.importSnapshot(snapshot); err != nil {
+		return err
+	}
+
+	store.metadata[id] = snapshot.Metadata
+	if id > store.lastId {
+		store.lastId = id
+	}
+	store.updateLatest()
+	return nil
+}
+
+// DeleteSnapshot asks the backend to remove the snapshot and drops its
+// metadata from the internal mapping. The id of a deleted snapshot is never
+// reused, even if it was the latest.
+func (store *Store) DeleteSnapshot(id uint64) error {
+	if store.metadata[id] == nil {
+		return errors.New(fmt.Sprintf("No snapshot with id %d", id))
+	}
+
+	if err := store.backend.deleteSnapshot(id); err != nil {
+		return err
+	}
+
+	delete(store.metadata, id)
+	store.updateLatest()
+	return nil
+}
+
+// ReferencedBlobs returns the names of all of the blobs used by the
+// snapshots in the store, as given by name (such as blob.Store.Name)
+func (store *Store) ReferencedBlobs(name func(hash []byte) string) (map[string]bool, error) {
+	referenced := make(map[string]bool)
+
+	for _, metadata := range store.GetAllMetadata() {
+		fl, err := store.backend.getSnapshotFiles(metadata.Id)
+		if err != nil {
+			return nil, err
+		}
+
+		it := fl.Files.Iterator()
+		for it.Next() {
+			fileMetadata := it.Value().(*filelist.FileMetadata)
+			for _, hash := range fileMetadata.Blobs() {
+				referenced[name(hash)] = true
+			}
+		}
+	}
+
+	return referenced, nil
+}
+
+// Rekey re-encrypts the metadata of every snapshot with a new master key,
+// such as one from crypt.MasterKey.Rotate
+func (store *Store) Rekey(key *crypt.MasterKey) error {
+	return store.backend.rekey(key)
+}
+
+// AddCheckpoint records files whose blobs are safely stored by a create that
+// has not finished yet. CreateSnapshot drops the checkpoint.
+func (store *Store) AddCheckpoint(fl *filelist.FileList) error {
+	return store.backend.addCheckpoint(fl)
+}
+
+// GetCheckpoint returns the files recorded by an interrupted create, or nil
+// if there are none
+func (store *Store) GetCheckpoint() (*filelist.FileList, error) {
+	return store.backend.getCheckpoint()
+}
+
+// ClearCheckpoint forgets the files recorded by an interrupted create
+func (store *Store) ClearCheckpoint() error {
+	return store.backend.clearCheckpoint()
+}
+
+// updateLatest sets latest to the highest id in the metadata mapping
+func (store *Store) updateLatest() {
+	store.latest = 0
+	for id := range store.metadata {
+		if id > store.latest {
+			store.latest = id
+		}
+	}
+}
+
+// HasSnapshot returns true if there is a snapshot with the given id
+func (store *Store) HasSnapshot(id uint64) bool {
+	return store.metadata[id] != nil
+}
+
 // GetLatestSnapshot returns the Snapshot object associated with the latest
 // snapshot
 func (store *Store) GetLatestSnapshot() (*Snapshot, error) {
@@ -124,13 +237,14 @@ func (store *Store) GetLatestId() uint64 {
 }
 
 // GetAllMetadata returns a list containing the metadata of all snapshots
+// ordered by id
 func (store *Store) GetAllMetadata() []*SnapshotMetadata {
 	list := make([]*SnapshotMetadata, 0, len(store.metadata))
 	for _, metadata := range store.metadata {
 		list = append(list, metadata)
 	}
 
-	//FIXME: sort the list
+	sort.Slice(list, func(i, j int) bool { return list[i].Id < list[j].Id })
 	return list
 }
 
@@ -0,0 +1,156 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package snapshot
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/andybug/abakus/pkg/filelist"
+	"github.com/andybug/abakus/pkg/repo"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckpoint(t *testing.T) {
+	root, _ := ioutil.TempDir("", "TestCheckpoint")
+	defer os.RemoveAll(root)
+	repo.Create(root)
+
+	store, err := GetStore(root, nil)
+	assert.Nil(t, err)
+
+	checkpoint, err := store.GetCheckpoint()
+	assert.Nil(t, err)
+	assert.Nil(t, checkpoint)
+
+	fl := filelist.New()
+	fl.Add("a", &filelist.FileMetadata{Hash: []byte("a"), Size: 1})
+	assert.Nil(t, store.AddCheckpoint(fl))
+	fl = filelist.New()
+	fl.Add("b", &filelist.FileMetadata{Hash: []byte("b"), Size: 1})
+	assert.Nil(t, store.AddCheckpoint(fl))
+	store.Close()
+
+	// the checkpoint is not mistaken for a snapshot
+	store, err = GetStore(root, nil)
+	assert.Nil(t, err)
+	defer store.Close()
+	assert.Equal(t, uint64(0), store.GetLatestId())
+
+	checkpoint, err = store.GetCheckpoint()
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{"a", "b"}, checkpoint.Files.Keys())
+
+	// creating the snapshot drops the checkpoint
+	_, err = store.CreateSnapshot(checkpoint, nil)
+	assert.Nil(t, err)
+	checkpoint, err = store.GetCheckpoint()
+	assert.Nil(t, err)
+	assert.Nil(t, checkpoint)
+}
+
+func TestDeleteSnapshot(t *testing.T) {
+	root, _ := ioutil.TempDir("", "TestDeleteSnapshot")
+	defer os.RemoveAll(root)
+	repo.Create(root)
+
+	store, err := GetStore(root, nil)
+	assert.Nil(t, err)
+
+	for _, name := range []string{"a", "b", "c"} {
+		fl := filelist.New()
+		fl.Add(name, &filelist.FileMetadata{Hash: []byte(name), Size: 1})
+		_, err = store.CreateSnapshot(fl, nil)
+		assert.Nil(t, err)
+	}
+
+	assert.Nil(t, store.DeleteSnapshot(2))
+	assert.NotNil(t, store.DeleteSnapshot(2))
+	assert.False(t, store.HasSnapshot(2))
+	_, err = store.GetSnapshot(2)
+	assert.NotNil(t, err)
+
+	// the others are left as they were
+	for id, name := range map[uint64]string{1: "a", 3: "c"} {
+		snapshot, err := store.GetSnapshot(id)
+		assert.Nil(t, err)
+		assert.Equal(t, []interface{}{name}, snapshot.Files.Files.Keys())
+		assert.Equal(t, snapshot.Files.MerkleRoot(), snapshot.Metadata.MerkleRoot)
+	}
+
+	// deleting the latest does not free its id, even after reopening
+	assert.Nil(t, store.DeleteSnapshot(3))
+	assert.Equal(t, uint64(1), store.GetLatestId())
+	store.Close()
+
+	store, err = GetStore(root, nil)
+	assert.Nil(t, err)
+	defer store.Close()
+	assert.Len(t, store.GetAllMetadata(), 1)
+	assert.Equal(t, uint64(1), store.GetLatestId())
+
+	metadata, err := store.CreateSnapshot(filelist.New(), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(4), metadata.Id)
+}
+
+func TestReferencedBlobs(t *testing.T) {
+	root, _ := ioutil.TempDir("", "TestReferencedBlobs")
+	defer os.RemoveAll(root)
+	repo.Create(root)
+
+	store, err := GetStore(root, nil)
+	assert.Nil(t, err)
+	defer store.Close()
+
+	name := func(hash []byte) string { return string(hash) }
+
+	fl := filelist.New()
+	fl.Add("a", &filelist.FileMetadata{Hash: []byte("shared"), Size: 1})
+	fl.Add("dir", &filelist.FileMetadata{Type: filelist.TYPE_DIRECTORY})
+	_, err = store.CreateSnapshot(fl, nil)
+	assert.Nil(t, err)
+
+	fl = filelist.New()
+	fl.Add("a", &filelist.FileMetadata{Hash: []byte("shared"), Size: 1})
+	fl.Add("b", &filelist.FileMetadata{
+		Hash: []byte("whole"),
+		Size: 2,
+		Chunks: []filelist.Chunk{
+			{Hash: []byte("chunk1"), Size: 1},
+			{Hash: []byte("chunk2"), Size: 1},
+		},
+	})
+	_, err = store.CreateSnapshot(fl, nil)
+	assert.Nil(t, err)
+
+	// chunked files reference their chunks rather than the whole file
+	referenced, err := store.ReferencedBlobs(name)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]bool{"shared": true, "chunk1": true, "chunk2": true}, referenced)
+
+	// only the remaining snapshots count
+	assert.Nil(t, store.DeleteSnapshot(2))
+	referenced, err = store.ReferencedBlobs(name)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]bool{"shared": true}, referenced)
+}
@@ -0,0 +1,192 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package validate
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/andybug/abakus/pkg/blob"
+	"github.com/andybug/abakus/pkg/filelist"
+	"github.com/andybug/abakus/pkg/snapshot"
+)
+
+// Options controls what is validated
+// ReadData - decompress and re-hash the contents of every blob, and
+// reassemble and re-hash chunked files
+// Snapshot - only validate the snapshot with this id; 0 means all of them,
+// which is needed to find orphaned blobs
+// Fix - remove the pack files left behind by interrupted runs
+type Options struct {
+	ReadData bool
+	Snapshot uint64
+	Fix      bool
+}
+
+// Report describes what was checked and the problems found
+// Snapshots, Blobs - the number of snapshots and blobs checked
+// Problems - a description of every problem, in the order they were found
+// Mismatched - snapshots whose merkle root does not match their files
+// Missing, Corrupt - referenced blobs that are not there, or (with
+// ReadData) do not match their hash
+// Unassembled - chunked files whose chunks do not reassemble the file
+// Orphaned - blobs that no snapshot references
+// Resumable - files stored by an interrupted create; their blobs are not
+// orphaned
+// Leftovers, LeftoverBytes - pack files left behind by interrupted runs,
+// which were removed if Fix was set
+type Report struct {
+	Snapshots     uint64
+	Blobs         uint64
+	Problems      []string
+	Mismatched    uint64
+	Missing       uint64
+	Corrupt       uint64
+	Unassembled   uint64
+	Orphaned      uint64
+	Resumable     uint64
+	Leftovers     uint64
+	LeftoverBytes uint64
+}
+
+// Ok returns true if no problems were found. Leftovers are not a problem,
+// since they are never referenced.
+func (report *Report) Ok() bool {
+	return len(report.Problems) == 0
+}
+
+// problem records a problem in the report
+func (report *Report) problem(format string, args ...interface{}) {
+	report.Problems = append(report.Problems, fmt.Sprintf(format, args...))
+}
+
+// Validate recomputes the merkle root of each snapshot and checks that
+// every blob it references exists, and with ReadData that its contents
+// still match. When all snapshots are checked, blobs that none of them
+// reference are reported as orphaned. An error is only returned if the
+// stores cannot be read; the problems found are in the report.
+func Validate(snapshots *snapshot.Store, blobs *blob.Store, opts *Options) (*Report, error) {
+	report := &Report{}
+
+	metadataList := snapshots.GetAllMetadata()
+	if opts.Snapshot != 0 {
+		selected, err := snapshots.GetSnapshot(opts.Snapshot)
+		if err != nil {
+			return nil, err
+		}
+		metadataList = []*snapshot.SnapshotMetadata{selected.Metadata}
+	}
+
+	// blobs that have been checked, mapped to whether they are ok
+	checked := make(map[string]bool)
+	// chunked files whose reassembled contents have been checked
+	reassembled := make(map[string]bool)
+
+	for _, metadata := range metadataList {
+		snapshot, err := snapshots.GetSnapshot(metadata.Id)
+		if err != nil {
+			return nil, err
+		}
+		report.Snapshots += 1
+
+		if !bytes.Equal(snapshot.Files.MerkleRoot(), metadata.MerkleRoot) {
+			report.problem("snapshot %d: merkle root does not match", metadata.Id)
+			report.Mismatched += 1
+		}
+
+		it := snapshot.Files.Files.Iterator()
+		for it.Next() {
+			relPath := it.Key().(string)
+			fileMetadata := it.Value().(*filelist.FileMetadata)
+			allOk := true
+			for _, hash := range fileMetadata.Blobs() {
+				name := blobs.Name(hash)
+
+				ok, seen := checked[name]
+				if !seen {
+					if !blobs.Has(hash) {
+						report.Missing += 1
+					} else if opts.ReadData && blobs.Verify(hash) != nil {
+						report.Corrupt += 1
+					} else {
+						ok = true
+					}
+					checked[name] = ok
+				}
+
+				if !ok {
+					report.problem("snapshot %d: %s: blob %s is missing or corrupt",
+						metadata.Id, relPath, name)
+					allOk = false
+				}
+			}
+
+			// the chunks may all be fine but not add up to the file
+			hashString := fmt.Sprintf("%x", fileMetadata.Hash)
+			if opts.ReadData && allOk && len(fileMetadata.Chunks) > 0 && !reassembled[hashString] {
+				reassembled[hashString] = true
+				if blobs.VerifyFile(fileMetadata) != nil {
+					report.problem("snapshot %d: %s: chunks do not reassemble the file",
+						metadata.Id, relPath)
+					report.Unassembled += 1
+				}
+			}
+		}
+	}
+	report.Blobs = uint64(len(checked))
+
+	// orphans can only be found when every snapshot was checked
+	if opts.Snapshot == 0 {
+		// blobs stored by an interrupted create
+		resumable := make(map[string]bool)
+		checkpoint, err := snapshots.GetCheckpoint()
+		if err != nil {
+			return nil, err
+		}
+		if checkpoint != nil {
+			report.Resumable = uint64(checkpoint.Files.Size())
+
+			it := checkpoint.Files.Iterator()
+			for it.Next() {
+				fileMetadata := it.Value().(*filelist.FileMetadata)
+				for _, hash := range fileMetadata.Blobs() {
+					resumable[blobs.Name(hash)] = true
+				}
+			}
+		}
+
+		for _, name := range blobs.Names() {
+			if _, seen := checked[name]; !seen && !resumable[name] {
+				report.problem("blob %s is not referenced by any snapshot", name)
+				report.Orphaned += 1
+			}
+		}
+	}
+
+	count, size, err := blobs.CleanLeftovers(nil, !opts.Fix)
+	if err != nil {
+		return nil, err
+	}
+	report.Leftovers = count
+	report.LeftoverBytes = size
+
+	return report, nil
+}
@@ -0,0 +1,192 @@
+// Copyright © 2018 Andrew Fields <andy@andybug.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package validate
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/andybug/abakus/pkg/blob"
+	"github.com/andybug/abakus/pkg/filelist"
+	"github.com/andybug/abakus/pkg/repo"
+	"github.com/andybug/abakus/pkg/snapshot"
+	"github.com/stretchr/testify/assert"
+)
+
+// testRepo is a repository with a snapshot of the files "a" and "b"
+type testRepo struct {
+	root      string
+	blobs     *blob.Store
+	snapshots *snapshot.Store
+	files     *filelist.FileList
+}
+
+// newTestRepo creates a repository in a temporary directory, stores the
+// files and snapshots them
+func newTestRepo(t *testing.T, name string) *testRepo {
+	root, _ := ioutil.TempDir("", name)
+	_, err := repo.Create(root)
+	assert.Nil(t, err)
+
+	r := &testRepo{root: root}
+	r.blobs, err = blob.GetStore(root, nil)
+	assert.Nil(t, err)
+	r.snapshots, err = snapshot.GetStore(root, nil)
+	assert.Nil(t, err)
+
+	r.files = r.store(t, map[string]string{"a": "first", "b": "second"})
+	_, err = r.snapshots.CreateSnapshot(r.files, nil)
+	assert.Nil(t, err)
+	return r
+}
+
+// close closes the stores and removes the repository
+func (r *testRepo) close() {
+	r.blobs.Close()
+	r.snapshots.Close()
+	os.RemoveAll(r.root)
+}
+
+// store writes the files into the repository and stores their contents,
+// returning the file list of everything in it
+func (r *testRepo) store(t *testing.T, files map[string]string) *filelist.FileList {
+	for relPath, contents := range files {
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(r.root, relPath), []byte(contents), 0644))
+	}
+
+	fl, err := filelist.Scan(r.root, nil)
+	assert.Nil(t, err)
+	_, err = r.blobs.AddFiles(fl, nil, &blob.AddOptions{Jobs: 1, OnChange: blob.ON_CHANGE_FAIL})
+	assert.Nil(t, err)
+	assert.Nil(t, r.blobs.Flush())
+	return fl
+}
+
+// hash returns the hash of the file in the snapshot
+func (r *testRepo) hash(relPath string) []byte {
+	value, _ := r.files.Files.Get(relPath)
+	return value.(*filelist.FileMetadata).Hash
+}
+
+func TestValidate(t *testing.T) {
+	r := newTestRepo(t, "TestValidate")
+	defer r.close()
+
+	report, err := Validate(r.snapshots, r.blobs, &Options{ReadData: true})
+	assert.Nil(t, err)
+	assert.True(t, report.Ok())
+	assert.Equal(t, uint64(1), report.Snapshots)
+	assert.Equal(t, uint64(2), report.Blobs)
+	assert.Empty(t, report.Problems)
+
+	_, err = Validate(r.snapshots, r.blobs, &Options{Snapshot: 2})
+	assert.NotNil(t, err)
+}
+
+func TestValidateMissing(t *testing.T) {
+	r := newTestRepo(t, "TestValidateMissing")
+	defer r.close()
+
+	assert.Nil(t, r.blobs.Remove(r.blobs.Name(r.hash("a"))))
+
+	report, err := Validate(r.snapshots, r.blobs, &Options{})
+	assert.Nil(t, err)
+	assert.False(t, report.Ok())
+	assert.Equal(t, uint64(1), report.Missing)
+	assert.Equal(t, uint64(0), report.Corrupt)
+	assert.Equal(t, uint64(0), report.Orphaned)
+	assert.Len(t, report.Problems, 1)
+	assert.Contains(t, report.Problems[0], "snapshot 1: a:")
+}
+
+func TestValidateCorrupt(t *testing.T) {
+	r := newTestRepo(t, "TestValidateCorrupt")
+	defer r.close()
+
+	// replace the contents of a with those of b
+	reader, err := r.blobs.GetRaw(r.blobs.Name(r.hash("b")))
+	assert.Nil(t, err)
+	raw, err := ioutil.ReadAll(reader)
+	reader.Close()
+	assert.Nil(t, err)
+	name := r.blobs.Name(r.hash("a"))
+	assert.Nil(t, r.blobs.Remove(name))
+	assert.Nil(t, r.blobs.PutRaw(name, bytes.NewReader(raw)))
+	assert.Nil(t, r.blobs.Flush())
+
+	// the blob is only read with ReadData
+	report, err := Validate(r.snapshots, r.blobs, &Options{})
+	assert.Nil(t, err)
+	assert.True(t, report.Ok())
+
+	report, err = Validate(r.snapshots, r.blobs, &Options{ReadData: true})
+	assert.Nil(t, err)
+	assert.False(t, report.Ok())
+	assert.Equal(t, uint64(1), report.Corrupt)
+	assert.Equal(t, uint64(0), report.Missing)
+	assert.Len(t, report.Problems, 1)
+}
+
+func TestValidateOrphaned(t *testing.T) {
+	r := newTestRepo(t, "TestValidateOrphaned")
+	defer r.close()
+
+	r.store(t, map[string]string{"c": "third"})
+
+	report, err := Validate(r.snapshots, r.blobs, &Options{})
+	assert.Nil(t, err)
+	assert.False(t, report.Ok())
+	assert.Equal(t, uint64(1), report.Orphaned)
+	assert.Len(t, report.Problems, 1)
+
+	// orphans are not looked for when only one snapshot is checked
+	report, err = Validate(r.snapshots, r.blobs, &Options{Snapshot: 1})
+	assert.Nil(t, err)
+	assert.True(t, report.Ok())
+
+	// nor are the blobs of an interrupted create
+	assert.Nil(t, r.snapshots.AddCheckpoint(r.store(t, nil).Select([]string{"c"})))
+	report, err = Validate(r.snapshots, r.blobs, &Options{})
+	assert.Nil(t, err)
+	assert.True(t, report.Ok())
+	assert.Equal(t, uint64(1), report.Resumable)
+}
+
+func TestValidateBadSnapshot(t *testing.T) {
+	r := newTestRepo(t, "TestValidateBadSnapshot")
+	defer r.close()
+
+	metadata := &snapshot.SnapshotMetadata{Id: 2, MerkleRoot: []byte("wrong")}
+	assert.Nil(t, r.snapshots.ImportSnapshot(&snapshot.Snapshot{Metadata: metadata, Files: r.files}))
+
+	report, err := Validate(r.snapshots, r.blobs, &Options{})
+	assert.Nil(t, err)
+	assert.False(t, report.Ok())
+	assert.Equal(t, uint64(1), report.Mismatched)
+	assert.Equal(t, []string{"snapshot 2: merkle root does not match"}, report.Problems)
+
+	report, err = Validate(r.snapshots, r.blobs, &Options{Snapshot: 1})
+	assert.Nil(t, err)
+	assert.True(t, report.Ok())
+}